@@ -0,0 +1,76 @@
+package cluster
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"regexp"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// DefaultActivityPattern matches log lines which galactus and automuteus
+// write while players are in voice channel.
+const DefaultActivityPattern = `(?i)\b(mute|unmute|deafen|undeafen)`
+
+// ActivitySelectors are label selectors of pods whose logs tell activity of players.
+var ActivitySelectors = []string{"app=galactus", "app=automuteus"}
+
+// LogActivityProbe finds activity of players in container logs.
+type LogActivityProbe struct {
+	Client    kubernetes.Interface
+	Namespace string
+	Selectors []string
+	Pattern   *regexp.Regexp
+}
+
+// ActiveSince returns true if a line matching Pattern is logged after since.
+// Pods started after since are considered active, since their logs are too short to tell.
+func (probe LogActivityProbe) ActiveSince(ctx context.Context, since time.Time) (bool, error) {
+	pods := probe.Client.CoreV1().Pods(probe.Namespace)
+
+	for _, selector := range probe.Selectors {
+		list, e := pods.List(ctx, metav1.ListOptions{LabelSelector: selector})
+		if e != nil {
+			return false, e
+		}
+
+		for _, pod := range list.Items {
+			if pod.Status.Phase != corev1.PodRunning {
+				continue
+			}
+			if pod.Status.StartTime != nil && pod.Status.StartTime.Time.After(since) {
+				return true, nil
+			}
+
+			sinceTime := metav1.NewTime(since)
+			stream, e := pods.GetLogs(pod.Name, &corev1.PodLogOptions{SinceTime: &sinceTime}).Stream(ctx)
+			if e != nil {
+				return false, e
+			}
+			active, e := probe.scan(stream)
+			stream.Close()
+			if e != nil {
+				return false, e
+			}
+			if active {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+func (probe LogActivityProbe) scan(stream io.Reader) (bool, error) {
+	scanner := bufio.NewScanner(stream)
+	for scanner.Scan() {
+		if probe.Pattern.Match(scanner.Bytes()) {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
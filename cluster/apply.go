@@ -0,0 +1,287 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/google/go-cmp/cmp"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
+)
+
+// InventoryLabel marks resources applied by Applier, so that
+// resources removed from kubernetes/base can be found and pruned.
+const InventoryLabel = "automutek8s.oakcask.github.io/inventory"
+
+// FieldManager is field manager of server-side apply.
+const FieldManager = "automutek8s"
+
+// DefaultInventory is value of InventoryLabel for the stack.
+const DefaultInventory = "automutek8s"
+
+// PruneKinds are kinds looked up for pruning in addition to
+// kinds being applied. PersistentVolumeClaim is never pruned
+// so that game stats survive, nor is Namespace.
+var PruneKinds = []schema.GroupVersionKind{
+	{Version: "v1", Kind: "ConfigMap"},
+	{Version: "v1", Kind: "Secret"},
+	{Version: "v1", Kind: "Service"},
+	{Version: "v1", Kind: "ServiceAccount"},
+	{Group: "apps", Version: "v1", Kind: "Deployment"},
+	{Group: "apps", Version: "v1", Kind: "StatefulSet"},
+	{Group: "rbac.authorization.k8s.io", Version: "v1", Kind: "Role"},
+	{Group: "rbac.authorization.k8s.io", Version: "v1", Kind: "RoleBinding"},
+}
+
+const (
+	// ActionCreate creates the object.
+	ActionCreate = "create"
+	// ActionUpdate updates the object.
+	ActionUpdate = "update"
+	// ActionUnchanged leaves the object as it is.
+	ActionUnchanged = "unchanged"
+	// ActionPrune deletes the object removed from manifests.
+	ActionPrune = "prune"
+)
+
+// Change is what Apply does to an object.
+type Change struct {
+	Action string
+	Object *unstructured.Unstructured
+	Diff   string
+}
+
+// String returns action and identity of the object, like "update apps/v1 Deployment default/galactus".
+func (change Change) String() string {
+	obj := change.Object
+	return fmt.Sprintf("%s %s %s %s/%s", change.Action, obj.GetAPIVersion(), obj.GetKind(), obj.GetNamespace(), obj.GetName())
+}
+
+// Applier applies manifests with server-side apply and prunes
+// resources labeled with the inventory but no longer in manifests.
+type Applier struct {
+	Client    dynamic.Interface
+	Mapper    meta.RESTMapper
+	Namespace string
+	Inventory string
+}
+
+// NewApplier builds Applier talking to the cluster configured by restConfig.
+func NewApplier(restConfig *rest.Config, namespace string) (*Applier, error) {
+	client, e := dynamic.NewForConfig(restConfig)
+	if e != nil {
+		return nil, e
+	}
+	discoveryClient, e := discovery.NewDiscoveryClientForConfig(restConfig)
+	if e != nil {
+		return nil, e
+	}
+
+	return &Applier{
+		Client:    client,
+		Mapper:    restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(discoveryClient)),
+		Namespace: namespace,
+		Inventory: DefaultInventory,
+	}, nil
+}
+
+func objectKey(gvk schema.GroupVersionKind, namespace string, name string) string {
+	return fmt.Sprintf("%s/%s/%s/%s", gvk.Group, gvk.Kind, namespace, name)
+}
+
+// resource returns client for the object, setting namespace of namespaced object.
+func (a *Applier) resource(obj *unstructured.Unstructured) (dynamic.ResourceInterface, error) {
+	gvk := obj.GroupVersionKind()
+	mapping, e := a.Mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if e != nil {
+		return nil, e
+	}
+
+	if mapping.Scope.Name() != meta.RESTScopeNameNamespace {
+		return a.Client.Resource(mapping.Resource), nil
+	}
+	if obj.GetNamespace() == "" {
+		obj.SetNamespace(a.Namespace)
+	}
+	return a.Client.Resource(mapping.Resource).Namespace(obj.GetNamespace()), nil
+}
+
+func (a *Applier) label(obj *unstructured.Unstructured) {
+	labels := obj.GetLabels()
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	labels[InventoryLabel] = a.Inventory
+	obj.SetLabels(labels)
+}
+
+func (a *Applier) apply(ctx context.Context, obj *unstructured.Unstructured, dryRun bool) (*unstructured.Unstructured, error) {
+	ri, e := a.resource(obj)
+	if e != nil {
+		return nil, e
+	}
+	data, e := json.Marshal(obj)
+	if e != nil {
+		return nil, e
+	}
+
+	force := true
+	options := metav1.PatchOptions{FieldManager: FieldManager, Force: &force}
+	if dryRun {
+		options.DryRun = []string{metav1.DryRunAll}
+	}
+	return ri.Patch(ctx, obj.GetName(), types.ApplyPatchType, data, options)
+}
+
+// normalize drops fields which always differ between live and applied object.
+func normalize(obj *unstructured.Unstructured) map[string]interface{} {
+	out := obj.DeepCopy()
+	for _, field := range []string{"managedFields", "resourceVersion", "generation", "creationTimestamp", "uid", "selfLink"} {
+		unstructured.RemoveNestedField(out.Object, "metadata", field)
+	}
+	unstructured.RemoveNestedField(out.Object, "status")
+	return out.Object
+}
+
+// Plan labels objects with the inventory and tells what Apply will do,
+// comparing live objects with results of dry-run.
+func (a *Applier) Plan(ctx context.Context, objs []*unstructured.Unstructured) ([]Change, error) {
+	changes := make([]Change, 0, len(objs))
+	for _, obj := range objs {
+		a.label(obj)
+		ri, e := a.resource(obj)
+		if e != nil {
+			return nil, e
+		}
+
+		live, e := ri.Get(ctx, obj.GetName(), metav1.GetOptions{})
+		if k8serrors.IsNotFound(e) {
+			changes = append(changes, Change{Action: ActionCreate, Object: obj})
+			continue
+		} else if e != nil {
+			return nil, e
+		}
+
+		applied, e := a.apply(ctx, obj, true)
+		if e != nil {
+			return nil, fmt.Errorf("dry-run of %s %s failed: %v", obj.GetKind(), obj.GetName(), e)
+		}
+
+		diff := cmp.Diff(normalize(live), normalize(applied))
+		if diff == "" {
+			changes = append(changes, Change{Action: ActionUnchanged, Object: obj})
+		} else {
+			changes = append(changes, Change{Action: ActionUpdate, Object: obj, Diff: diff})
+		}
+	}
+
+	pruned, e := a.prunable(ctx, objs)
+	if e != nil {
+		return nil, e
+	}
+	for _, obj := range pruned {
+		changes = append(changes, Change{Action: ActionPrune, Object: obj})
+	}
+
+	return changes, nil
+}
+
+// prunable finds objects labeled with the inventory but not in objs.
+// Namespaced objects are looked up in every namespace, so that resources
+// of removed tenants are pruned as well.
+func (a *Applier) prunable(ctx context.Context, objs []*unstructured.Unstructured) ([]*unstructured.Unstructured, error) {
+	desired := map[string]bool{}
+	kinds := map[schema.GroupVersionKind]bool{}
+	for _, gvk := range PruneKinds {
+		kinds[gvk] = true
+	}
+	for _, obj := range objs {
+		gvk := obj.GroupVersionKind()
+		desired[objectKey(gvk, obj.GetNamespace(), obj.GetName())] = true
+		kinds[gvk] = true
+	}
+
+	gvks := make([]schema.GroupVersionKind, 0, len(kinds))
+	for gvk := range kinds {
+		if gvk.Kind == "PersistentVolumeClaim" || gvk.Kind == "Namespace" {
+			continue
+		}
+		gvks = append(gvks, gvk)
+	}
+	sort.Slice(gvks, func(i, j int) bool { return gvks[i].String() < gvks[j].String() })
+
+	selector := fmt.Sprintf("%s=%s", InventoryLabel, a.Inventory)
+	pruned := make([]*unstructured.Unstructured, 0)
+	for _, gvk := range gvks {
+		mapping, e := a.Mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+		if e != nil {
+			return nil, e
+		}
+		list, e := a.Client.Resource(mapping.Resource).List(ctx, metav1.ListOptions{LabelSelector: selector})
+		if e != nil {
+			return nil, e
+		}
+		for i := range list.Items {
+			item := &list.Items[i]
+			item.SetGroupVersionKind(gvk)
+			if !desired[objectKey(gvk, item.GetNamespace(), item.GetName())] {
+				pruned = append(pruned, item)
+			}
+		}
+	}
+	return pruned, nil
+}
+
+// Apply performs changes planned by Plan.
+func (a *Applier) Apply(ctx context.Context, changes []Change) error {
+	for _, change := range changes {
+		switch change.Action {
+		case ActionCreate, ActionUpdate:
+			if _, e := a.apply(ctx, change.Object, false); e != nil {
+				return fmt.Errorf("failed to apply %s %s: %v", change.Object.GetKind(), change.Object.GetName(), e)
+			}
+		case ActionPrune:
+			ri, e := a.resource(change.Object)
+			if e != nil {
+				return e
+			}
+			propagation := metav1.DeletePropagationBackground
+			e = ri.Delete(ctx, change.Object.GetName(), metav1.DeleteOptions{PropagationPolicy: &propagation})
+			if e != nil && !k8serrors.IsNotFound(e) {
+				return fmt.Errorf("failed to prune %s %s: %v", change.Object.GetKind(), change.Object.GetName(), e)
+			}
+		}
+	}
+	return nil
+}
+
+// WriteChanges writes changes and diffs of updated objects.
+// Unchanged objects are omitted.
+func WriteChanges(out io.Writer, changes []Change) error {
+	for _, change := range changes {
+		if change.Action == ActionUnchanged {
+			continue
+		}
+		if _, e := fmt.Fprintln(out, change.String()); e != nil {
+			return e
+		}
+		if change.Diff != "" {
+			if _, e := fmt.Fprintln(out, change.Diff); e != nil {
+				return e
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func newConfigMap(name string, labels map[string]string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion("v1")
+	obj.SetKind("ConfigMap")
+	obj.SetName(name)
+	if labels != nil {
+		obj.SetNamespace("default")
+		obj.SetLabels(labels)
+	}
+	return obj
+}
+
+func newFakeApplier(objects ...runtime.Object) *Applier {
+	mapper := meta.NewDefaultRESTMapper(nil)
+	listKinds := map[schema.GroupVersionResource]string{}
+	for _, gvk := range PruneKinds {
+		mapper.Add(gvk, meta.RESTScopeNamespace)
+		mapping, _ := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+		listKinds[mapping.Resource] = gvk.Kind + "List"
+	}
+
+	return &Applier{
+		Client:    dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), listKinds, objects...),
+		Mapper:    mapper,
+		Namespace: "default",
+		Inventory: "automutek8s",
+	}
+}
+
+func TestApplierPlansCreateAndPrune(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	a := newFakeApplier(
+		newConfigMap("galactus-config-old", map[string]string{InventoryLabel: "automutek8s"}),
+		newConfigMap("created-by-hand", map[string]string{"app": "other"}),
+	)
+
+	desired := newConfigMap("galactus-config-new", nil)
+	changes, e := a.Plan(ctx, []*unstructured.Unstructured{desired})
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	if len(changes) != 2 {
+		t.Fatalf("expected create and prune; got %v", changes)
+	}
+	if changes[0].Action != ActionCreate || changes[0].Object.GetNamespace() != "default" {
+		t.Errorf("expected new ConfigMap to be created in default namespace; got %v", changes[0])
+	}
+	if desired.GetLabels()[InventoryLabel] != "automutek8s" {
+		t.Errorf("expected inventory label to be added; got %v", desired.GetLabels())
+	}
+	if changes[1].Action != ActionPrune || changes[1].Object.GetName() != "galactus-config-old" {
+		t.Errorf("expected old ConfigMap to be pruned; got %v", changes[1])
+	}
+
+	var buf bytes.Buffer
+	if e = WriteChanges(&buf, changes); e != nil {
+		t.Fatal(e)
+	}
+	if !strings.Contains(buf.String(), "prune v1 ConfigMap default/galactus-config-old") {
+		t.Errorf("expected prune to be shown; got %q", buf.String())
+	}
+
+	if e = a.Apply(ctx, changes[1:]); e != nil {
+		t.Fatal(e)
+	}
+	configMaps := a.Client.Resource(schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}).Namespace("default")
+	if _, e = configMaps.Get(ctx, "galactus-config-old", metav1.GetOptions{}); e == nil {
+		t.Errorf("expected old ConfigMap to be deleted")
+	}
+	if _, e = configMaps.Get(ctx, "created-by-hand", metav1.GetOptions{}); e != nil {
+		t.Errorf("expected ConfigMap without inventory label to be kept; got %v", e)
+	}
+}
+
+func TestApplierPrunesRemovedTenants(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	removed := newConfigMap("discovery", map[string]string{InventoryLabel: "automutek8s"})
+	removed.SetNamespace("tenant-a")
+	other := newConfigMap("discovery", map[string]string{InventoryLabel: "automutek8s-b"})
+	other.SetNamespace("community-b")
+	a := newFakeApplier(removed, other)
+
+	changes, e := a.Plan(ctx, []*unstructured.Unstructured{newConfigMap("discovery", nil)})
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(changes) != 2 || changes[1].Action != ActionPrune || changes[1].Object.GetNamespace() != "tenant-a" {
+		t.Errorf("expected resources of removed tenant to be pruned; got %v", changes)
+	}
+}
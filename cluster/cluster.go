@@ -0,0 +1,74 @@
+// Package cluster operates the GKE cluster hosting automuteus
+// and workloads deployed from kubernetes/base.
+package cluster
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+
+	"golang.org/x/oauth2"
+	googleauth "golang.org/x/oauth2/google"
+	"google.golang.org/api/container/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// Cluster identifies the GKE cluster.
+type Cluster struct {
+	ProjectID string
+	Location  string
+	Name      string
+}
+
+// Path returns resource name of the cluster for Container API.
+func (c Cluster) Path() string {
+	return fmt.Sprintf("projects/%s/locations/%s/clusters/%s", c.ProjectID, c.Location, c.Name)
+}
+
+// NodePoolPath returns resource name of the node pool for Container API.
+func (c Cluster) NodePoolPath(nodePool string) string {
+	return fmt.Sprintf("%s/nodePools/%s", c.Path(), nodePool)
+}
+
+// NewKubernetesClient builds Kubernetes client talking to master of the cluster
+// with Google default credentials, without kubectl configuration.
+func NewKubernetesClient(ctx context.Context, service *container.Service, c Cluster) (kubernetes.Interface, error) {
+	restConfig, e := NewRESTConfig(ctx, service, c)
+	if e != nil {
+		return nil, e
+	}
+	return kubernetes.NewForConfig(restConfig)
+}
+
+// NewRESTConfig builds configuration of clients talking to master of the cluster
+// with Google default credentials.
+func NewRESTConfig(ctx context.Context, service *container.Service, c Cluster) (*rest.Config, error) {
+	cluster, e := service.Projects.Locations.Clusters.Get(c.Path()).Context(ctx).Do()
+	if e != nil {
+		return nil, e
+	}
+
+	ca, e := base64.StdEncoding.DecodeString(cluster.MasterAuth.ClusterCaCertificate)
+	if e != nil {
+		return nil, fmt.Errorf("failed to decode CA certificate of cluster %s: %v", c.Name, e)
+	}
+
+	tokenSource, e := googleauth.DefaultTokenSource(ctx, cloudPlatformScope)
+	if e != nil {
+		return nil, e
+	}
+
+	return &rest.Config{
+		Host: fmt.Sprintf("https://%s", cluster.Endpoint),
+		TLSClientConfig: rest.TLSClientConfig{
+			CAData: ca,
+		},
+		WrapTransport: func(rt http.RoundTripper) http.RoundTripper {
+			return &oauth2.Transport{Source: tokenSource, Base: rt}
+		},
+	}, nil
+}
@@ -0,0 +1,6 @@
+package cluster
+
+// DiscordAPIBase is base URL of Discord API.
+// It lives here rather than in tools, since App Engine uploads only cluster/
+// along with the slash command service.
+const DiscordAPIBase = "https://discord.com/api/v10"
@@ -0,0 +1,11 @@
+package cluster
+
+// GetenvOr returns the environment variable key read by getenv,
+// or defaultValue if it is empty.
+// Commands scaling the stack take their settings with it.
+func GetenvOr(getenv func(string) string, key string, defaultValue string) string {
+	if value := getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
@@ -0,0 +1,53 @@
+package cluster
+
+import (
+	"context"
+	"io"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// PodExecutor runs commands in a container of a pod, as `kubectl exec` does.
+type PodExecutor struct {
+	RESTConfig *rest.Config
+	Namespace  string
+	Pod        string
+	Container  string
+}
+
+// Exec runs command streaming stdin and stdout, and stderr of the command.
+// Stdin may be nil. The command is not aborted when ctx is done,
+// since the stream doesn't support cancellation.
+func (x PodExecutor) Exec(ctx context.Context, command []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	client, e := kubernetes.NewForConfig(x.RESTConfig)
+	if e != nil {
+		return e
+	}
+
+	req := client.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Namespace(x.Namespace).
+		Name(x.Pod).
+		SubResource("exec").
+		VersionedParams(&corev1.PodExecOptions{
+			Container: x.Container,
+			Command:   command,
+			Stdin:     stdin != nil,
+			Stdout:    true,
+			Stderr:    true,
+		}, scheme.ParameterCodec)
+
+	executor, e := remotecommand.NewSPDYExecutor(x.RESTConfig, "POST", req.URL())
+	if e != nil {
+		return e
+	}
+	return executor.Stream(remotecommand.StreamOptions{
+		Stdin:  stdin,
+		Stdout: stdout,
+		Stderr: stderr,
+	})
+}
@@ -0,0 +1,275 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"google.golang.org/api/container/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// ReplicasAnnotation remembers replica count of the workload before it is stopped.
+const ReplicasAnnotation = "automutek8s.oakcask.github.io/replicas"
+
+const defaultPollInterval = 5 * time.Second
+
+// Workload is Deployment or StatefulSet in kubernetes/base.
+type Workload struct {
+	Kind string
+	Name string
+}
+
+const (
+	// KindDeployment is kind of apps/v1 Deployment.
+	KindDeployment = "Deployment"
+	// KindStatefulSet is kind of apps/v1 StatefulSet.
+	KindStatefulSet = "StatefulSet"
+)
+
+// SharedPostgres is postgres of the default stack, which tenants share.
+var SharedPostgres = Workload{Kind: KindStatefulSet, Name: "postgres"}
+
+// Stages are workloads of automuteus stack in dependency order.
+// Workloads in a stage depend on ones in former stages.
+var Stages = [][]Workload{
+	{SharedPostgres, {Kind: KindStatefulSet, Name: "redis"}},
+	{{Kind: KindDeployment, Name: "galactus"}},
+	{{Kind: KindDeployment, Name: "automuteus"}},
+}
+
+// NodePoolResizer resizes node pool hosting the workloads.
+type NodePoolResizer interface {
+	Resize(ctx context.Context, nodeCount int64) error
+}
+
+// GKENodePool is node pool of the GKE cluster.
+type GKENodePool struct {
+	Service *container.Service
+	Cluster Cluster
+	Name    string
+}
+
+// Resize sets size of the node pool through Container API.
+func (pool GKENodePool) Resize(ctx context.Context, nodeCount int64) error {
+	log.Printf("resizing node pool %s to %d", pool.Name, nodeCount)
+	req := &container.SetNodePoolSizeRequest{
+		NodeCount: nodeCount,
+	}
+	_, e := pool.Service.Projects.Locations.Clusters.NodePools.SetSize(pool.Cluster.NodePoolPath(pool.Name), req).Context(ctx).Do()
+	return e
+}
+
+// Scaler stops the stack, scaling workloads and node pool to zero,
+// and starts it again.
+// Node pool is left as it is if NodePool is nil.
+// Missing workloads, such as postgres replaced by Cloud SQL, are skipped.
+// NamePrefix is prepended to names of workloads, as namePrefix of kustomization does.
+// If KeepPostgres is true, Stop leaves postgres and node pool running for tenants sharing them.
+type Scaler struct {
+	NodePool     NodePoolResizer
+	NodeCount    int64
+	Namespace    string
+	NamePrefix   string
+	KeepPostgres bool
+	Client       kubernetes.Interface
+	PollInterval time.Duration
+}
+
+// name returns name of the workload in the cluster.
+func (s *Scaler) name(workload Workload) string {
+	return s.NamePrefix + workload.Name
+}
+
+// Stop scales workloads to zero in reverse dependency order,
+// remembering their replica counts in ReplicasAnnotation,
+// then resizes node pool to zero.
+func (s *Scaler) Stop(ctx context.Context) error {
+	for i := len(Stages) - 1; i >= 0; i-- {
+		for _, workload := range Stages[i] {
+			if s.KeepPostgres && workload == SharedPostgres {
+				log.Printf("%s %s is shared with tenants; left running", workload.Kind, workload.Name)
+				continue
+			}
+			if e := s.stopWorkload(ctx, workload); e != nil {
+				return e
+			}
+		}
+	}
+
+	if s.NodePool == nil || s.KeepPostgres {
+		return nil
+	}
+	return s.NodePool.Resize(ctx, 0)
+}
+
+// StopClients scales workloads depending on the first stage to zero
+// in reverse dependency order, leaving postgres, redis and node pool running,
+// such as while restoring the database. Start brings them back.
+func (s *Scaler) StopClients(ctx context.Context) error {
+	for i := len(Stages) - 1; i > 0; i-- {
+		for _, workload := range Stages[i] {
+			if e := s.stopWorkload(ctx, workload); e != nil {
+				return e
+			}
+		}
+	}
+	return nil
+}
+
+// Running returns true if any workload of the stack has replicas.
+func (s *Scaler) Running(ctx context.Context) (bool, error) {
+	for _, stage := range Stages {
+		for _, workload := range stage {
+			status, e := s.GetStatus(ctx, workload)
+			if k8serrors.IsNotFound(e) {
+				continue
+			}
+			if e != nil {
+				return false, e
+			}
+			if status.Replicas > 0 {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// Start resizes node pool to NodeCount, then restores replica counts
+// of workloads in dependency order, waiting for each stage to be ready.
+func (s *Scaler) Start(ctx context.Context) error {
+	if s.NodePool != nil {
+		if e := s.NodePool.Resize(ctx, s.NodeCount); e != nil {
+			return e
+		}
+	}
+
+	for _, stage := range Stages {
+		for _, workload := range stage {
+			if e := s.startWorkload(ctx, workload); e != nil {
+				return e
+			}
+		}
+		for _, workload := range stage {
+			if e := s.waitReady(ctx, workload); e != nil {
+				return e
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *Scaler) stopWorkload(ctx context.Context, workload Workload) error {
+	status, e := s.GetStatus(ctx, workload)
+	if k8serrors.IsNotFound(e) {
+		log.Printf("%s %s is missing; skipped", workload.Kind, workload.Name)
+		return nil
+	}
+	if e != nil {
+		return e
+	}
+	if status.Replicas == 0 {
+		log.Printf("%s %s is already stopped", workload.Kind, workload.Name)
+		return nil
+	}
+
+	log.Printf("stopping %s %s (%d replicas)", workload.Kind, workload.Name, status.Replicas)
+	return s.patch(ctx, workload, map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{
+				ReplicasAnnotation: strconv.Itoa(int(status.Replicas)),
+			},
+		},
+		"spec": map[string]interface{}{
+			"replicas": 0,
+		},
+	})
+}
+
+func (s *Scaler) startWorkload(ctx context.Context, workload Workload) error {
+	status, e := s.GetStatus(ctx, workload)
+	if k8serrors.IsNotFound(e) {
+		log.Printf("%s %s is missing; skipped", workload.Kind, workload.Name)
+		return nil
+	}
+	if e != nil {
+		return e
+	}
+
+	replicas := status.Replicas
+	if remembered, ok := status.Annotations[ReplicasAnnotation]; ok {
+		n, e := strconv.Atoi(remembered)
+		if e != nil {
+			return fmt.Errorf("malformed %s annotation of %s %s: %v", ReplicasAnnotation, workload.Kind, workload.Name, e)
+		}
+		replicas = int32(n)
+	}
+	if replicas == 0 {
+		replicas = 1
+	}
+
+	log.Printf("starting %s %s (%d replicas)", workload.Kind, workload.Name, replicas)
+	return s.patch(ctx, workload, map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{
+				ReplicasAnnotation: nil,
+			},
+		},
+		"spec": map[string]interface{}{
+			"replicas": replicas,
+		},
+	})
+}
+
+func (s *Scaler) waitReady(ctx context.Context, workload Workload) error {
+	interval := s.PollInterval
+	if interval == 0 {
+		interval = defaultPollInterval
+	}
+
+	for {
+		status, e := s.GetStatus(ctx, workload)
+		if k8serrors.IsNotFound(e) {
+			return nil
+		}
+		if e != nil {
+			return e
+		}
+		if status.Ready() {
+			log.Printf("%s %s is ready", workload.Kind, workload.Name)
+			return nil
+		}
+
+		log.Printf("waiting for %s %s: %d/%d ready", workload.Kind, workload.Name, status.ReadyReplicas, status.Replicas)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s %s did not become ready: %v", workload.Kind, workload.Name, ctx.Err())
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (s *Scaler) patch(ctx context.Context, workload Workload, patch map[string]interface{}) error {
+	data, e := json.Marshal(patch)
+	if e != nil {
+		return e
+	}
+
+	switch workload.Kind {
+	case KindDeployment:
+		_, e = s.Client.AppsV1().Deployments(s.Namespace).Patch(ctx, s.name(workload), types.MergePatchType, data, metav1.PatchOptions{})
+	case KindStatefulSet:
+		_, e = s.Client.AppsV1().StatefulSets(s.Namespace).Patch(ctx, s.name(workload), types.MergePatchType, data, metav1.PatchOptions{})
+	default:
+		e = fmt.Errorf("unknown kind of workload: %s", workload.Kind)
+	}
+	return e
+}
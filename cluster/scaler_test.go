@@ -0,0 +1,212 @@
+package cluster
+
+import (
+	"context"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+type fakeNodePool struct {
+	sizes []int64
+}
+
+func (pool *fakeNodePool) Resize(ctx context.Context, nodeCount int64) error {
+	pool.sizes = append(pool.sizes, nodeCount)
+	return nil
+}
+
+func newFakeStack(replicas int32) []runtime.Object {
+	return newFakePrefixedStack("default", "", replicas)
+}
+
+func newFakePrefixedStack(namespace string, namePrefix string, replicas int32) []runtime.Object {
+	objects := make([]runtime.Object, 0)
+	for _, stage := range Stages {
+		for _, workload := range stage {
+			meta := metav1.ObjectMeta{Name: namePrefix + workload.Name, Namespace: namespace}
+			r := replicas
+			if workload.Kind == KindDeployment {
+				objects = append(objects, &appsv1.Deployment{
+					ObjectMeta: meta,
+					Spec:       appsv1.DeploymentSpec{Replicas: &r},
+					Status:     appsv1.DeploymentStatus{ReadyReplicas: r},
+				})
+			} else {
+				objects = append(objects, &appsv1.StatefulSet{
+					ObjectMeta: meta,
+					Spec:       appsv1.StatefulSetSpec{Replicas: &r},
+					Status:     appsv1.StatefulSetStatus{ReadyReplicas: r},
+				})
+			}
+		}
+	}
+	return objects
+}
+
+func patchedNames(client *fake.Clientset) []string {
+	names := make([]string, 0)
+	for _, action := range client.Actions() {
+		if patch, ok := action.(k8stesting.PatchAction); ok {
+			names = append(names, patch.GetName())
+		}
+	}
+	return names
+}
+
+func TestScalerStopAndStart(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	client := fake.NewSimpleClientset(newFakeStack(2)...)
+	pool := &fakeNodePool{}
+	s := &Scaler{NodePool: pool, NodeCount: 1, Namespace: "default", Client: client}
+
+	if e := s.Stop(ctx); e != nil {
+		t.Fatal(e)
+	}
+
+	expected := []string{"automuteus", "galactus", "postgres", "redis"}
+	if names := patchedNames(client); len(names) != 4 || names[0] != expected[0] || names[1] != expected[1] {
+		t.Errorf("expected workloads to be stopped in reverse dependency order %v; got %v", expected, names)
+	}
+	if len(pool.sizes) != 1 || pool.sizes[0] != 0 {
+		t.Errorf("expected node pool to be resized to zero; got %v", pool.sizes)
+	}
+
+	galactus, e := client.AppsV1().Deployments("default").Get(ctx, "galactus", metav1.GetOptions{})
+	if e != nil {
+		t.Fatal(e)
+	}
+	if *galactus.Spec.Replicas != 0 || galactus.Annotations[ReplicasAnnotation] != "2" {
+		t.Errorf("expected galactus to be stopped remembering 2 replicas; got %d %v", *galactus.Spec.Replicas, galactus.Annotations)
+	}
+
+	// stopping again should not forget replica counts
+	if e = s.Stop(ctx); e != nil {
+		t.Fatal(e)
+	}
+
+	client.ClearActions()
+	if e = s.Start(ctx); e != nil {
+		t.Fatal(e)
+	}
+
+	expected = []string{"postgres", "redis", "galactus", "automuteus"}
+	names := patchedNames(client)
+	if len(names) != len(expected) {
+		t.Fatalf("expected workloads to be started in dependency order %v; got %v", expected, names)
+	}
+	for i := range expected {
+		if names[i] != expected[i] {
+			t.Errorf("expected workloads to be started in dependency order %v; got %v", expected, names)
+			break
+		}
+	}
+	if pool.sizes[len(pool.sizes)-1] != 1 {
+		t.Errorf("expected node pool to be resized to 1; got %v", pool.sizes)
+	}
+
+	postgres, e := client.AppsV1().StatefulSets("default").Get(ctx, "postgres", metav1.GetOptions{})
+	if e != nil {
+		t.Fatal(e)
+	}
+	if *postgres.Spec.Replicas != 2 {
+		t.Errorf("expected postgres to be restored to 2 replicas; got %d", *postgres.Spec.Replicas)
+	}
+	if _, ok := postgres.Annotations[ReplicasAnnotation]; ok {
+		t.Errorf("expected annotation to be removed; got %v", postgres.Annotations)
+	}
+}
+
+func TestScalerWithNamePrefix(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	client := fake.NewSimpleClientset(newFakePrefixedStack("community-b", "b-", 1)...)
+	s := &Scaler{Namespace: "community-b", NamePrefix: "b-", Client: client}
+
+	if e := s.Stop(ctx); e != nil {
+		t.Fatal(e)
+	}
+	if names := patchedNames(client); len(names) != 4 || names[0] != "b-automuteus" {
+		t.Errorf("expected prefixed workloads to be stopped without node pool; got %v", names)
+	}
+}
+
+func TestScalerSkipsMissingWorkloads(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	objects := make([]runtime.Object, 0)
+	for _, obj := range newFakeStack(1) {
+		if set, ok := obj.(*appsv1.StatefulSet); ok && set.Name == "postgres" {
+			continue
+		}
+		objects = append(objects, obj)
+	}
+	client := fake.NewSimpleClientset(objects...)
+	s := &Scaler{Namespace: "default", Client: client}
+
+	if e := s.Stop(ctx); e != nil {
+		t.Fatal(e)
+	}
+	if running, e := s.Running(ctx); e != nil || running {
+		t.Errorf("expected the stack to be stopped; got %v %v", running, e)
+	}
+	if e := s.Start(ctx); e != nil {
+		t.Fatal(e)
+	}
+	for _, name := range patchedNames(client) {
+		if name == "postgres" {
+			t.Errorf("expected missing postgres not to be patched")
+		}
+	}
+}
+
+func TestScalerKeepsPostgresForTenants(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	client := fake.NewSimpleClientset(newFakeStack(1)...)
+	pool := &fakeNodePool{}
+	s := &Scaler{NodePool: pool, Namespace: "default", KeepPostgres: true, Client: client}
+
+	if e := s.Stop(ctx); e != nil {
+		t.Fatal(e)
+	}
+	if names := patchedNames(client); len(names) != 3 {
+		t.Errorf("expected workloads except postgres to be stopped; got %v", names)
+	}
+	for _, name := range patchedNames(client) {
+		if name == "postgres" {
+			t.Errorf("expected postgres shared with tenants not to be stopped")
+		}
+	}
+	if len(pool.sizes) != 0 {
+		t.Errorf("expected node pool to be left for postgres; got %v", pool.sizes)
+	}
+}
+
+func TestScalerStopClients(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	client := fake.NewSimpleClientset(newFakeStack(1)...)
+	pool := &fakeNodePool{}
+	s := &Scaler{NodePool: pool, Namespace: "default", Client: client}
+
+	if e := s.StopClients(ctx); e != nil {
+		t.Fatal(e)
+	}
+	if names := patchedNames(client); len(names) != 2 || names[0] != "automuteus" || names[1] != "galactus" {
+		t.Errorf("expected only automuteus and galactus to be stopped; got %v", names)
+	}
+	if len(pool.sizes) != 0 {
+		t.Errorf("expected node pool to be left; got %v", pool.sizes)
+	}
+}
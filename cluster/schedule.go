@@ -0,0 +1,140 @@
+package cluster
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ScheduleRule is time of the day on days of the week
+// when the stack should be stopped.
+type ScheduleRule struct {
+	Days   [7]bool
+	Hour   int
+	Minute int
+}
+
+// Schedule is set of ScheduleRule in the time zone.
+type Schedule struct {
+	Rules    []ScheduleRule
+	Location *time.Location
+}
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+var scheduleTimeRegexp = regexp.MustCompile(`\A([01]?[0-9]|2[0-3]):([0-5][0-9])\z`)
+
+// ParseScheduleRule parses rule like "weekdays 23:00", "sat,sun 02:30",
+// "mon-thu 23:00" or "daily 04:00".
+func ParseScheduleRule(text string) (ScheduleRule, error) {
+	var rule ScheduleRule
+
+	fields := strings.Fields(text)
+	if len(fields) != 2 {
+		return rule, fmt.Errorf("schedule should be like \"weekdays 23:00\": %s", text)
+	}
+
+	m := scheduleTimeRegexp.FindStringSubmatch(fields[1])
+	if m == nil {
+		return rule, fmt.Errorf("time of schedule should be HH:MM: %s", fields[1])
+	}
+	rule.Hour, _ = strconv.Atoi(m[1])
+	rule.Minute, _ = strconv.Atoi(m[2])
+
+	for _, days := range strings.Split(strings.ToLower(fields[0]), ",") {
+		switch days {
+		case "daily":
+			for d := time.Sunday; d <= time.Saturday; d++ {
+				rule.Days[d] = true
+			}
+			continue
+		case "weekdays":
+			for d := time.Monday; d <= time.Friday; d++ {
+				rule.Days[d] = true
+			}
+			continue
+		case "weekends":
+			rule.Days[time.Saturday] = true
+			rule.Days[time.Sunday] = true
+			continue
+		}
+
+		bounds := strings.SplitN(days, "-", 2)
+		first, ok := weekdayNames[bounds[0]]
+		if !ok {
+			return rule, fmt.Errorf("unknown day of week in schedule: %s", bounds[0])
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, ok = weekdayNames[bounds[1]]; !ok {
+				return rule, fmt.Errorf("unknown day of week in schedule: %s", bounds[1])
+			}
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			rule.Days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+
+	return rule, nil
+}
+
+// ParseSchedule parses rules separated by semicolon, like
+// "weekdays 23:00; weekends 03:00", in time zone named tz.
+func ParseSchedule(text string, tz string) (Schedule, error) {
+	location, e := time.LoadLocation(tz)
+	if e != nil {
+		return Schedule{}, e
+	}
+
+	schedule := Schedule{Location: location}
+	for _, ruleText := range strings.Split(text, ";") {
+		if strings.TrimSpace(ruleText) == "" {
+			continue
+		}
+		rule, e := ParseScheduleRule(ruleText)
+		if e != nil {
+			return Schedule{}, e
+		}
+		schedule.Rules = append(schedule.Rules, rule)
+	}
+
+	return schedule, nil
+}
+
+// Matches returns true if t, truncated to minutes, is scheduled time.
+func (schedule Schedule) Matches(t time.Time) bool {
+	local := t.In(schedule.Location)
+	for _, rule := range schedule.Rules {
+		if rule.Days[local.Weekday()] && rule.Hour == local.Hour() && rule.Minute == local.Minute() {
+			return true
+		}
+	}
+	return false
+}
+
+// Between returns true if scheduled time comes after from, until to.
+// Only the last week before to is examined.
+func (schedule Schedule) Between(from time.Time, to time.Time) bool {
+	if week := to.Add(-7 * 24 * time.Hour); from.Before(week) {
+		from = week
+	}
+	for t := from.Truncate(time.Minute).Add(time.Minute); !t.After(to); t = t.Add(time.Minute) {
+		if schedule.Matches(t) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,75 @@
+package cluster
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseScheduleRule(t *testing.T) {
+	t.Parallel()
+
+	examples := []struct {
+		text  string
+		days  string
+		valid bool
+	}{
+		{"weekdays 23:00", "-MTWTF-", true},
+		{"weekends 3:30", "S-----S", true},
+		{"sat,sun 02:30", "S-----S", true},
+		{"fri-mon 23:00", "SM---FS", true},
+		{"daily 04:00", "SMTWTFS", true},
+		{"weekdays 24:00", "", false},
+		{"someday 23:00", "", false},
+		{"23:00", "", false},
+	}
+
+	for _, example := range examples {
+		rule, e := ParseScheduleRule(example.text)
+		if (e == nil) != example.valid {
+			t.Errorf("expected valid to be %v for %q; got %v", example.valid, example.text, e)
+			continue
+		}
+		if e != nil {
+			continue
+		}
+		days := []byte("-------")
+		for d, on := range rule.Days {
+			if on {
+				days[d] = "SMTWTFS"[d]
+			}
+		}
+		if string(days) != example.days {
+			t.Errorf("expected days of %q to be %v; got %s", example.text, example.days, days)
+		}
+	}
+}
+
+func TestScheduleBetween(t *testing.T) {
+	t.Parallel()
+
+	schedule, e := ParseSchedule("weekdays 23:00; weekends 02:00", "Asia/Tokyo")
+	if e != nil {
+		t.Fatal(e)
+	}
+	jst := schedule.Location
+
+	// 2021-01-08 is Friday
+	examples := []struct {
+		from     time.Time
+		to       time.Time
+		expected bool
+	}{
+		{time.Date(2021, 1, 8, 22, 59, 0, 0, jst), time.Date(2021, 1, 8, 23, 0, 0, 0, jst), true},
+		{time.Date(2021, 1, 8, 23, 0, 0, 0, jst), time.Date(2021, 1, 8, 23, 1, 0, 0, jst), false},
+		{time.Date(2021, 1, 8, 22, 0, 0, 0, jst), time.Date(2021, 1, 8, 22, 59, 0, 0, jst), false},
+		{time.Date(2021, 1, 9, 1, 59, 30, 0, jst), time.Date(2021, 1, 9, 2, 0, 30, 0, jst), true},
+		{time.Date(2021, 1, 9, 22, 59, 0, 0, jst), time.Date(2021, 1, 9, 23, 0, 0, 0, jst), false},
+		{time.Date(2021, 1, 8, 13, 59, 0, 0, time.UTC), time.Date(2021, 1, 8, 14, 0, 0, 0, time.UTC), true},
+	}
+
+	for _, example := range examples {
+		if actual := schedule.Between(example.from, example.to); actual != example.expected {
+			t.Errorf("expected Between(%v, %v) to be %v; got %v", example.from, example.to, example.expected, actual)
+		}
+	}
+}
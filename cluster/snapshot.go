@@ -0,0 +1,285 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+// VolumeSnapshotGVR is resource of VolumeSnapshot served by snapshot CRDs of the cluster.
+var VolumeSnapshotGVR = schema.GroupVersionResource{Group: "snapshot.storage.k8s.io", Version: "v1beta1", Resource: "volumesnapshots"}
+
+// VolumeLabel labels VolumeSnapshots with the claim they are taken from.
+const VolumeLabel = "automutek8s.oakcask.github.io/volume"
+
+const snapshotTimeFormat = "20060102t150405z"
+
+// Volume is PersistentVolumeClaim made from volumeClaimTemplates of the StatefulSet.
+type Volume struct {
+	Template    string
+	StatefulSet string
+}
+
+// Volumes are volumes of StatefulSets in kubernetes/base.
+var Volumes = []Volume{
+	{Template: "postgres-storage", StatefulSet: "postgres"},
+	{Template: "redis-storage", StatefulSet: "redis"},
+}
+
+// Snapshot is VolumeSnapshot of a Volume.
+type Snapshot struct {
+	Name       string
+	Claim      string
+	Created    time.Time
+	ReadyToUse bool
+}
+
+func (snapshot Snapshot) String() string {
+	return fmt.Sprintf("%s\t%s\t%s\tready=%v", snapshot.Name, snapshot.Claim, snapshot.Created.Local().Format(time.RFC3339), snapshot.ReadyToUse)
+}
+
+// Snapshotter takes VolumeSnapshots of Volumes and restores Volumes from them.
+// NamePrefix is prepended to names of StatefulSets, as namePrefix of kustomization does.
+type Snapshotter struct {
+	Client       kubernetes.Interface
+	Dynamic      dynamic.Interface
+	Namespace    string
+	NamePrefix   string
+	ClassName    string
+	PollInterval time.Duration
+}
+
+// ClaimName returns name of PersistentVolumeClaim of the first replica of the volume.
+func (s *Snapshotter) ClaimName(volume Volume) string {
+	return fmt.Sprintf("%s-%s%s-0", volume.Template, s.NamePrefix, volume.StatefulSet)
+}
+
+// FindVolume returns the volume of the StatefulSet named name.
+func FindVolume(name string) (Volume, error) {
+	for _, volume := range Volumes {
+		if volume.StatefulSet == name {
+			return volume, nil
+		}
+	}
+	return Volume{}, fmt.Errorf("no volume of %s; it should be one of postgres and redis", name)
+}
+
+func (s *Snapshotter) snapshots() dynamic.ResourceInterface {
+	return s.Dynamic.Resource(VolumeSnapshotGVR).Namespace(s.Namespace)
+}
+
+// Take creates VolumeSnapshot of the volume named after now.
+// The snapshot becomes ready to use asynchronously.
+func (s *Snapshotter) Take(ctx context.Context, volume Volume, now time.Time) (Snapshot, error) {
+	claim := s.ClaimName(volume)
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion(VolumeSnapshotGVR.GroupVersion().String())
+	obj.SetKind("VolumeSnapshot")
+	obj.SetName(fmt.Sprintf("%s-%s", claim, now.UTC().Format(snapshotTimeFormat)))
+	obj.SetLabels(map[string]string{VolumeLabel: claim})
+	obj.Object["spec"] = map[string]interface{}{
+		"volumeSnapshotClassName": s.ClassName,
+		"source": map[string]interface{}{
+			"persistentVolumeClaimName": claim,
+		},
+	}
+
+	created, e := s.snapshots().Create(ctx, obj, metav1.CreateOptions{})
+	if e != nil {
+		return Snapshot{}, e
+	}
+	log.Printf("taking snapshot %s of %s", created.GetName(), claim)
+	return snapshotFromObject(created), nil
+}
+
+func snapshotFromObject(obj *unstructured.Unstructured) Snapshot {
+	ready, _, _ := unstructured.NestedBool(obj.Object, "status", "readyToUse")
+	return Snapshot{
+		Name:       obj.GetName(),
+		Claim:      obj.GetLabels()[VolumeLabel],
+		Created:    obj.GetCreationTimestamp().Time,
+		ReadyToUse: ready,
+	}
+}
+
+// List returns snapshots of the volume, newest first.
+func (s *Snapshotter) List(ctx context.Context, volume Volume) ([]Snapshot, error) {
+	list, e := s.snapshots().List(ctx, metav1.ListOptions{LabelSelector: fmt.Sprintf("%s=%s", VolumeLabel, s.ClaimName(volume))})
+	if e != nil {
+		return nil, e
+	}
+
+	snapshots := make([]Snapshot, 0, len(list.Items))
+	for i := range list.Items {
+		snapshots = append(snapshots, snapshotFromObject(&list.Items[i]))
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Created.After(snapshots[j].Created) })
+	return snapshots, nil
+}
+
+// Prune deletes snapshots of the volume taken before since,
+// keeping the newest one ready to use anyway.
+func (s *Snapshotter) Prune(ctx context.Context, volume Volume, since time.Time) error {
+	snapshots, e := s.List(ctx, volume)
+	if e != nil {
+		return e
+	}
+
+	kept := false
+	for _, snapshot := range snapshots {
+		if !kept && snapshot.ReadyToUse {
+			kept = true
+			continue
+		}
+		if snapshot.Created.IsZero() || !snapshot.Created.Before(since) {
+			continue
+		}
+		log.Printf("deleting snapshot %s", snapshot.Name)
+		if e := s.snapshots().Delete(ctx, snapshot.Name, metav1.DeleteOptions{}); e != nil && !k8serrors.IsNotFound(e) {
+			return e
+		}
+	}
+	return nil
+}
+
+// Restore replaces PersistentVolumeClaim of the volume with one made from the snapshot,
+// so that the StatefulSet binds it when it is scaled up again.
+// The PersistentVolume bound to the claim is retained rather than deleted with it,
+// and given back to the claim if the replacement cannot be created.
+// Workloads using the volume should be stopped beforehand,
+// and data written after the snapshot is lost.
+func (s *Snapshotter) Restore(ctx context.Context, volume Volume, snapshotName string) error {
+	snapshotObj, e := s.snapshots().Get(ctx, snapshotName, metav1.GetOptions{})
+	if e != nil {
+		return e
+	}
+	snapshot := snapshotFromObject(snapshotObj)
+	claimName := s.ClaimName(volume)
+	if snapshot.Claim != claimName {
+		return fmt.Errorf("snapshot %s is not taken from %s", snapshotName, claimName)
+	}
+	if !snapshot.ReadyToUse {
+		return fmt.Errorf("snapshot %s is not ready to use yet", snapshotName)
+	}
+
+	claims := s.Client.CoreV1().PersistentVolumeClaims(s.Namespace)
+	current, e := claims.Get(ctx, claimName, metav1.GetOptions{})
+	if e != nil {
+		return e
+	}
+
+	apiGroup := VolumeSnapshotGVR.Group
+	restored := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      claimName,
+			Namespace: s.Namespace,
+			Labels:    current.Labels,
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes:      current.Spec.AccessModes,
+			StorageClassName: current.Spec.StorageClassName,
+			Resources:        current.Spec.Resources,
+			DataSource: &corev1.TypedLocalObjectReference{
+				APIGroup: &apiGroup,
+				Kind:     "VolumeSnapshot",
+				Name:     snapshotName,
+			},
+		},
+	}
+
+	volumeName := current.Spec.VolumeName
+	if volumeName != "" {
+		if e := s.retainVolume(ctx, volumeName); e != nil {
+			return e
+		}
+	}
+
+	log.Printf("deleting %s to restore it from %s", claimName, snapshotName)
+	if e := claims.Delete(ctx, claimName, metav1.DeleteOptions{}); e != nil {
+		return e
+	}
+	if e := s.waitDeleted(ctx, claimName); e != nil {
+		return e
+	}
+
+	if _, e = claims.Create(ctx, restored, metav1.CreateOptions{}); e != nil {
+		if volumeName == "" {
+			return e
+		}
+		if giveBackErr := s.giveBack(ctx, current); giveBackErr != nil {
+			return fmt.Errorf("failed to restore %s: %v; and failed to give %s back to it: %v", claimName, e, volumeName, giveBackErr)
+		}
+		return fmt.Errorf("failed to restore %s: %v; %s is given back to it", claimName, e, volumeName)
+	}
+	if volumeName != "" {
+		log.Printf("%s is retained; delete it once data restored from %s is confirmed", volumeName, snapshotName)
+	}
+	return nil
+}
+
+// retainVolume keeps the PersistentVolume when its claim is deleted.
+func (s *Snapshotter) retainVolume(ctx context.Context, volumeName string) error {
+	patch := fmt.Sprintf(`{"spec":{"persistentVolumeReclaimPolicy":%q}}`, corev1.PersistentVolumeReclaimRetain)
+	_, e := s.Client.CoreV1().PersistentVolumes().Patch(ctx, volumeName, types.MergePatchType, []byte(patch), metav1.PatchOptions{})
+	return e
+}
+
+// giveBack recreates the claim bound to the retained PersistentVolume it had,
+// releasing the volume from the deleted claim.
+func (s *Snapshotter) giveBack(ctx context.Context, claim *corev1.PersistentVolumeClaim) error {
+	patch := `{"spec":{"claimRef":{"uid":null,"resourceVersion":null}}}`
+	if _, e := s.Client.CoreV1().PersistentVolumes().Patch(ctx, claim.Spec.VolumeName, types.MergePatchType, []byte(patch), metav1.PatchOptions{}); e != nil {
+		return e
+	}
+
+	original := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      claim.Name,
+			Namespace: claim.Namespace,
+			Labels:    claim.Labels,
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes:      claim.Spec.AccessModes,
+			StorageClassName: claim.Spec.StorageClassName,
+			Resources:        claim.Spec.Resources,
+			VolumeName:       claim.Spec.VolumeName,
+		},
+	}
+	_, e := s.Client.CoreV1().PersistentVolumeClaims(claim.Namespace).Create(ctx, original, metav1.CreateOptions{})
+	return e
+}
+
+func (s *Snapshotter) waitDeleted(ctx context.Context, claimName string) error {
+	interval := s.PollInterval
+	if interval == 0 {
+		interval = defaultPollInterval
+	}
+
+	for {
+		_, e := s.Client.CoreV1().PersistentVolumeClaims(s.Namespace).Get(ctx, claimName, metav1.GetOptions{})
+		if k8serrors.IsNotFound(e) {
+			return nil
+		}
+		if e != nil {
+			return e
+		}
+
+		log.Printf("waiting for %s to be deleted", claimName)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s was not deleted: %v", claimName, ctx.Err())
+		case <-time.After(interval):
+		}
+	}
+}
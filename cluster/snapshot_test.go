@@ -0,0 +1,173 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func newFakeSnapshot(name string, claim string, created time.Time, ready bool) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion(VolumeSnapshotGVR.GroupVersion().String())
+	obj.SetKind("VolumeSnapshot")
+	obj.SetNamespace("default")
+	obj.SetName(name)
+	obj.SetLabels(map[string]string{VolumeLabel: claim})
+	obj.SetCreationTimestamp(metav1.NewTime(created))
+	obj.Object["status"] = map[string]interface{}{"readyToUse": ready}
+	return obj
+}
+
+func newFakeSnapshotter(client *fake.Clientset, objects ...runtime.Object) *Snapshotter {
+	dynamic := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{VolumeSnapshotGVR: "VolumeSnapshotList"}, objects...)
+	return &Snapshotter{Client: client, Dynamic: dynamic, Namespace: "default", ClassName: "automutek8s", PollInterval: time.Millisecond}
+}
+
+func TestSnapshotterTakeAndPrune(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	now := time.Date(2021, 2, 3, 4, 5, 6, 0, time.UTC)
+	claim := "postgres-storage-postgres-0"
+	s := newFakeSnapshotter(fake.NewSimpleClientset(),
+		newFakeSnapshot("old", claim, now.Add(-72*time.Hour), true),
+		newFakeSnapshot("older", claim, now.Add(-96*time.Hour), true),
+		newFakeSnapshot("redis", "redis-storage-redis-0", now.Add(-96*time.Hour), true),
+	)
+
+	taken, e := s.Take(ctx, Volumes[0], now)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if taken.Name != "postgres-storage-postgres-0-20210203t040506z" || taken.Claim != claim {
+		t.Errorf("unexpected snapshot: %v", taken)
+	}
+
+	if e = s.Prune(ctx, Volumes[0], now.Add(-48*time.Hour)); e != nil {
+		t.Fatal(e)
+	}
+	snapshots, e := s.List(ctx, Volumes[0])
+	if e != nil {
+		t.Fatal(e)
+	}
+	// the new snapshot is not ready yet, so old one is kept as the last one ready to use
+	names := map[string]bool{}
+	for _, snapshot := range snapshots {
+		names[snapshot.Name] = true
+	}
+	if len(snapshots) != 2 || !names["old"] || !names[taken.Name] {
+		t.Errorf("expected older snapshot to be pruned; got %v", snapshots)
+	}
+	if redis, _ := s.List(ctx, Volumes[1]); len(redis) != 1 {
+		t.Errorf("expected snapshots of other volumes to be left; got %v", redis)
+	}
+}
+
+func newFakeClaimAndVolume(storageClass string) (*corev1.PersistentVolumeClaim, *corev1.PersistentVolume) {
+	claim := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "redis-storage-b-redis-0", Namespace: "default", Labels: map[string]string{"app": "redis"}, UID: "old-claim"},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes:      []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+			StorageClassName: &storageClass,
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("1Gi")},
+			},
+			VolumeName: "pvc-redis",
+		},
+	}
+	volume := &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pvc-redis"},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeReclaimPolicy: corev1.PersistentVolumeReclaimDelete,
+			ClaimRef:                      &corev1.ObjectReference{Namespace: "default", Name: claim.Name, UID: claim.UID, ResourceVersion: "1"},
+		},
+	}
+	return claim, volume
+}
+
+func TestSnapshotterRestore(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	storageClass := "standard-rwo"
+	client := fake.NewSimpleClientset(newFakeClaimAndVolume(storageClass))
+	s := newFakeSnapshotter(client,
+		newFakeSnapshot("ready", "redis-storage-b-redis-0", time.Now(), true),
+		newFakeSnapshot("pending", "redis-storage-b-redis-0", time.Now(), false),
+		newFakeSnapshot("postgres", "postgres-storage-b-postgres-0", time.Now(), true),
+	)
+	s.NamePrefix = "b-"
+
+	if e := s.Restore(ctx, Volumes[1], "pending"); e == nil {
+		t.Errorf("expected snapshot not ready to be refused")
+	}
+	if e := s.Restore(ctx, Volumes[1], "postgres"); e == nil {
+		t.Errorf("expected snapshot of another volume to be refused")
+	}
+	if e := s.Restore(ctx, Volumes[1], "ready"); e != nil {
+		t.Fatal(e)
+	}
+
+	claim, e := client.CoreV1().PersistentVolumeClaims("default").Get(ctx, "redis-storage-b-redis-0", metav1.GetOptions{})
+	if e != nil {
+		t.Fatal(e)
+	}
+	if source := claim.Spec.DataSource; source == nil || source.Kind != "VolumeSnapshot" || source.Name != "ready" {
+		t.Errorf("expected claim to be made from the snapshot; got %v", source)
+	}
+	if *claim.Spec.StorageClassName != storageClass || claim.Labels["app"] != "redis" {
+		t.Errorf("expected claim to keep storage class and labels; got %v", claim)
+	}
+	volume, e := client.CoreV1().PersistentVolumes().Get(ctx, "pvc-redis", metav1.GetOptions{})
+	if e != nil {
+		t.Fatal(e)
+	}
+	if volume.Spec.PersistentVolumeReclaimPolicy != corev1.PersistentVolumeReclaimRetain {
+		t.Errorf("expected previous volume to be retained; got %v", volume.Spec.PersistentVolumeReclaimPolicy)
+	}
+}
+
+func TestSnapshotterRestoreGivesBackVolumeOnFailure(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	client := fake.NewSimpleClientset(newFakeClaimAndVolume("standard-rwo"))
+	client.PrependReactor("create", "persistentvolumeclaims", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		claim := action.(k8stesting.CreateAction).GetObject().(*corev1.PersistentVolumeClaim)
+		if claim.Spec.DataSource != nil {
+			return true, nil, fmt.Errorf("snapshot class is missing")
+		}
+		return false, nil, nil
+	})
+	s := newFakeSnapshotter(client, newFakeSnapshot("ready", "redis-storage-b-redis-0", time.Now(), true))
+	s.NamePrefix = "b-"
+
+	if e := s.Restore(ctx, Volumes[1], "ready"); e == nil {
+		t.Fatalf("expected failure of the replacement to be reported")
+	}
+	claim, e := client.CoreV1().PersistentVolumeClaims("default").Get(ctx, "redis-storage-b-redis-0", metav1.GetOptions{})
+	if e != nil {
+		t.Fatalf("expected claim to be given back; got %v", e)
+	}
+	if claim.Spec.VolumeName != "pvc-redis" || claim.Spec.DataSource != nil {
+		t.Errorf("expected claim to be bound to the previous volume; got %v", claim.Spec)
+	}
+	volume, e := client.CoreV1().PersistentVolumes().Get(ctx, "pvc-redis", metav1.GetOptions{})
+	if e != nil {
+		t.Fatal(e)
+	}
+	if ref := volume.Spec.ClaimRef; ref == nil || ref.Name != claim.Name || ref.UID != "" {
+		t.Errorf("expected previous volume to be released for the claim; got %v", ref)
+	}
+}
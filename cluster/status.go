@@ -0,0 +1,59 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// WorkloadStatus is replica counts of the workload.
+type WorkloadStatus struct {
+	Workload
+	Replicas      int32
+	ReadyReplicas int32
+	UpToDate      bool
+	Annotations   map[string]string
+}
+
+// Ready returns true if every desired replica is ready
+// and the controller has observed the latest spec.
+func (status WorkloadStatus) Ready() bool {
+	return status.UpToDate && status.ReadyReplicas >= status.Replicas
+}
+
+// GetStatus returns replica counts of the workload.
+func (s *Scaler) GetStatus(ctx context.Context, workload Workload) (WorkloadStatus, error) {
+	status := WorkloadStatus{Workload: workload}
+
+	switch workload.Kind {
+	case KindDeployment:
+		deployment, e := s.Client.AppsV1().Deployments(s.Namespace).Get(ctx, s.name(workload), metav1.GetOptions{})
+		if e != nil {
+			return status, e
+		}
+		status.Replicas = 1
+		if deployment.Spec.Replicas != nil {
+			status.Replicas = *deployment.Spec.Replicas
+		}
+		status.ReadyReplicas = deployment.Status.ReadyReplicas
+		status.UpToDate = deployment.Status.ObservedGeneration >= deployment.Generation
+		status.Annotations = deployment.Annotations
+	case KindStatefulSet:
+		statefulSet, e := s.Client.AppsV1().StatefulSets(s.Namespace).Get(ctx, s.name(workload), metav1.GetOptions{})
+		if e != nil {
+			return status, e
+		}
+		status.Replicas = 1
+		if statefulSet.Spec.Replicas != nil {
+			status.Replicas = *statefulSet.Spec.Replicas
+		}
+		status.ReadyReplicas = statefulSet.Status.ReadyReplicas
+		status.UpToDate = statefulSet.Status.ObservedGeneration >= statefulSet.Generation
+		status.Annotations = statefulSet.Annotations
+	default:
+		return status, fmt.Errorf("unknown kind of workload: %s", workload.Kind)
+	}
+
+	return status, nil
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/oakcask/automutek8s/cluster"
+)
+
+// commandName is name of the slash command, like `/automute start`.
+const commandName = "automute"
+
+// maxTimestampSkew is how far X-Signature-Timestamp may be from now,
+// so that captured requests can't be replayed later.
+const maxTimestampSkew = 5 * time.Minute
+
+const (
+	interactionPing               = 1
+	interactionApplicationCommand = 2
+)
+
+const (
+	responsePong                             = 1
+	responseChannelMessageWithSource         = 4
+	responseDeferredChannelMessageWithSource = 5
+)
+
+// messageFlagEphemeral makes the message visible only to the invoker.
+const messageFlagEphemeral = 64
+
+// stack is automuteus stack operated by the commands.
+type stack interface {
+	Start(ctx context.Context) error
+	Stop(ctx context.Context) error
+	Running(ctx context.Context) (bool, error)
+}
+
+type interaction struct {
+	Type          int    `json:"type"`
+	Token         string `json:"token"`
+	ApplicationID string `json:"application_id"`
+	Member        *struct {
+		Roles []string `json:"roles"`
+	} `json:"member"`
+	Data struct {
+		Name    string `json:"name"`
+		Options []struct {
+			Name string `json:"name"`
+		} `json:"options"`
+	} `json:"data"`
+}
+
+type interactionResponse struct {
+	Type int                 `json:"type"`
+	Data *interactionMessage `json:"data,omitempty"`
+}
+
+type interactionMessage struct {
+	Content string `json:"content"`
+	Flags   int    `json:"flags,omitempty"`
+}
+
+// commandHandler serves Discord interactions endpoint.
+type commandHandler struct {
+	publicKey    ed25519.PublicKey
+	allowedRoles map[string]bool
+	stack        stack
+	apiBase      string
+	client       *http.Client
+	timeout      time.Duration
+	logger       *log.Logger
+	now          func() time.Time
+
+	mu   sync.Mutex
+	busy bool
+}
+
+func newCommandHandler(publicKey ed25519.PublicKey, allowedRoles []string, s stack, logger *log.Logger) *commandHandler {
+	roles := make(map[string]bool)
+	for _, role := range allowedRoles {
+		roles[role] = true
+	}
+	return &commandHandler{
+		publicKey:    publicKey,
+		allowedRoles: roles,
+		stack:        s,
+		apiBase:      cluster.DiscordAPIBase,
+		client:       http.DefaultClient,
+		timeout:      15 * time.Minute,
+		logger:       logger,
+		now:          time.Now,
+	}
+}
+
+// verify checks Ed25519 signature of the request, which Discord signs
+// over timestamp followed by body, and that the timestamp is within maxTimestampSkew of now.
+func verify(publicKey ed25519.PublicKey, r *http.Request, body []byte, now time.Time) bool {
+	signature, e := hex.DecodeString(r.Header.Get("X-Signature-Ed25519"))
+	if e != nil || len(signature) != ed25519.SignatureSize {
+		return false
+	}
+	timestamp := r.Header.Get("X-Signature-Timestamp")
+	seconds, e := strconv.ParseInt(timestamp, 10, 64)
+	if e != nil {
+		return false
+	}
+	if skew := now.Sub(time.Unix(seconds, 0)); skew > maxTimestampSkew || skew < -maxTimestampSkew {
+		return false
+	}
+	message := append([]byte(timestamp), body...)
+	return ed25519.Verify(publicKey, message, signature)
+}
+
+func (h *commandHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, e := ioutil.ReadAll(http.MaxBytesReader(rw, r.Body, 1<<16))
+	if e != nil {
+		http.Error(rw, "bad request", http.StatusBadRequest)
+		return
+	}
+	if !verify(h.publicKey, r, body, h.now()) {
+		http.Error(rw, "invalid request signature", http.StatusUnauthorized)
+		return
+	}
+
+	var req interaction
+	if e = json.Unmarshal(body, &req); e != nil {
+		http.Error(rw, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	var res interactionResponse
+	switch req.Type {
+	case interactionPing:
+		res = interactionResponse{Type: responsePong}
+	case interactionApplicationCommand:
+		res = h.handleCommand(req)
+	default:
+		http.Error(rw, "unknown interaction type", http.StatusBadRequest)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	if e = json.NewEncoder(rw).Encode(res); e != nil {
+		h.logger.Printf("failed to write response: %v", e)
+	}
+}
+
+func reply(content string) interactionResponse {
+	return interactionResponse{
+		Type: responseChannelMessageWithSource,
+		Data: &interactionMessage{Content: content, Flags: messageFlagEphemeral},
+	}
+}
+
+// handleCommand responds deferred message and runs the subcommand in background,
+// since starting the stack takes longer than Discord waits for the response.
+func (h *commandHandler) handleCommand(req interaction) interactionResponse {
+	if req.Data.Name != commandName || len(req.Data.Options) != 1 {
+		return reply("unknown command")
+	}
+
+	subcommand := req.Data.Options[0].Name
+	var run func(ctx context.Context) (string, error)
+	switch subcommand {
+	case "status":
+		run = h.status
+	case "start":
+		run = h.start
+	case "stop":
+		run = h.stop
+	default:
+		return reply(fmt.Sprintf("unknown subcommand: %s", subcommand))
+	}
+
+	if subcommand != "status" {
+		if !h.permitted(req) {
+			return reply(fmt.Sprintf("you don't have a role allowed to %s the bot", subcommand))
+		}
+		if !h.acquire() {
+			return reply("the bot is already starting or stopping; try again later")
+		}
+	}
+
+	go func() {
+		if subcommand != "status" {
+			defer h.release()
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+		defer cancel()
+
+		content, e := run(ctx)
+		if e != nil {
+			h.logger.Printf("failed to %s the stack: %v", subcommand, e)
+			content = fmt.Sprintf("failed to %s the bot: %v", subcommand, e)
+		}
+		if e = h.editOriginal(req, content); e != nil {
+			h.logger.Printf("failed to send response of %s: %v", subcommand, e)
+		}
+	}()
+
+	return interactionResponse{Type: responseDeferredChannelMessageWithSource}
+}
+
+// permitted returns true if the member invoking the command has one of allowed roles.
+func (h *commandHandler) permitted(req interaction) bool {
+	if req.Member == nil {
+		return false
+	}
+	for _, role := range req.Member.Roles {
+		if h.allowedRoles[role] {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *commandHandler) acquire() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.busy {
+		return false
+	}
+	h.busy = true
+	return true
+}
+
+func (h *commandHandler) release() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.busy = false
+}
+
+func (h *commandHandler) status(ctx context.Context) (string, error) {
+	running, e := h.stack.Running(ctx)
+	if e != nil {
+		return "", e
+	}
+	if running {
+		return "the bot is up", nil
+	}
+	return "the bot is down; `/automute start` to start it", nil
+}
+
+func (h *commandHandler) start(ctx context.Context) (string, error) {
+	h.logger.Printf("starting the stack")
+	if e := h.stack.Start(ctx); e != nil {
+		return "", e
+	}
+	return "the bot is up", nil
+}
+
+func (h *commandHandler) stop(ctx context.Context) (string, error) {
+	h.logger.Printf("stopping the stack")
+	if e := h.stack.Stop(ctx); e != nil {
+		return "", e
+	}
+	return "the bot is down", nil
+}
+
+// editOriginal replaces the deferred response with content.
+func (h *commandHandler) editOriginal(req interaction, content string) error {
+	body, e := json.Marshal(interactionMessage{Content: content})
+	if e != nil {
+		return e
+	}
+
+	url := fmt.Sprintf("%s/webhooks/%s/%s/messages/@original", h.apiBase, req.ApplicationID, req.Token)
+	httpReq, e := http.NewRequest(http.MethodPatch, url, bytes.NewReader(body))
+	if e != nil {
+		return e
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	res, e := h.client.Do(httpReq)
+	if e != nil {
+		return e
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("discord responded %s", res.Status)
+	}
+	return nil
+}
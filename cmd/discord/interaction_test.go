@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type fakeStack struct {
+	starts int32
+	stops  int32
+}
+
+func (s *fakeStack) Start(ctx context.Context) error {
+	atomic.AddInt32(&s.starts, 1)
+	return nil
+}
+
+func (s *fakeStack) Stop(ctx context.Context) error {
+	atomic.AddInt32(&s.stops, 1)
+	return nil
+}
+
+func (s *fakeStack) Running(ctx context.Context) (bool, error) {
+	return atomic.LoadInt32(&s.starts) > atomic.LoadInt32(&s.stops), nil
+}
+
+type discordFixture struct {
+	t          *testing.T
+	privateKey ed25519.PrivateKey
+	stack      *fakeStack
+	server     *httptest.Server
+	edits      chan string
+	timestamp  string
+}
+
+func newDiscordFixture(t *testing.T) *discordFixture {
+	publicKey, privateKey, e := ed25519.GenerateKey(nil)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	edits := make(chan string, 4)
+	api := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPatch || r.URL.Path != "/webhooks/app/token/messages/@original" {
+			t.Errorf("unexpected follow-up request: %s %s", r.Method, r.URL.Path)
+		}
+		var message interactionMessage
+		json.NewDecoder(r.Body).Decode(&message)
+		edits <- message.Content
+	}))
+	t.Cleanup(api.Close)
+
+	s := &fakeStack{}
+	h := newCommandHandler(publicKey, []string{"admin-role"}, s, log.New(ioutil.Discard, "", 0))
+	h.apiBase = api.URL
+	h.now = func() time.Time { return time.Unix(1600000060, 0) }
+	server := httptest.NewServer(h)
+	t.Cleanup(server.Close)
+
+	return &discordFixture{t: t, privateKey: privateKey, stack: s, server: server, edits: edits, timestamp: "1600000000"}
+}
+
+func (f *discordFixture) post(body string, sign bool) (int, interactionResponse) {
+	req, _ := http.NewRequest(http.MethodPost, f.server.URL, bytes.NewBufferString(body))
+	req.Header.Set("X-Signature-Timestamp", f.timestamp)
+	if sign {
+		signature := ed25519.Sign(f.privateKey, []byte(f.timestamp+body))
+		req.Header.Set("X-Signature-Ed25519", hex.EncodeToString(signature))
+	} else {
+		req.Header.Set("X-Signature-Ed25519", hex.EncodeToString(make([]byte, ed25519.SignatureSize)))
+	}
+
+	res, e := http.DefaultClient.Do(req)
+	if e != nil {
+		f.t.Fatal(e)
+	}
+	defer res.Body.Close()
+
+	var out interactionResponse
+	if res.StatusCode == http.StatusOK {
+		if e = json.NewDecoder(res.Body).Decode(&out); e != nil {
+			f.t.Fatal(e)
+		}
+	}
+	return res.StatusCode, out
+}
+
+func command(subcommand string, role string) string {
+	return `{"type":2,"application_id":"app","token":"token","member":{"roles":["` + role + `"]},` +
+		`"data":{"name":"automute","options":[{"name":"` + subcommand + `","type":1}]}}`
+}
+
+func TestInteractionSignature(t *testing.T) {
+	t.Parallel()
+
+	f := newDiscordFixture(t)
+
+	if status, _ := f.post(`{"type":1}`, false); status != http.StatusUnauthorized {
+		t.Errorf("expected unsigned request to be rejected; got %d", status)
+	}
+	status, res := f.post(`{"type":1}`, true)
+	if status != http.StatusOK || res.Type != responsePong {
+		t.Errorf("expected ping to be answered with pong; got %d %+v", status, res)
+	}
+
+	for _, timestamp := range []string{"1599999000", "1600001000", "yesterday"} {
+		f.timestamp = timestamp
+		if status, _ := f.post(`{"type":1}`, true); status != http.StatusUnauthorized {
+			t.Errorf("expected request signed at %s to be rejected; got %d", timestamp, status)
+		}
+	}
+}
+
+func TestInteractionCommands(t *testing.T) {
+	t.Parallel()
+
+	f := newDiscordFixture(t)
+
+	_, res := f.post(command("start", "someone"), true)
+	if res.Type != responseChannelMessageWithSource || res.Data == nil || res.Data.Flags != messageFlagEphemeral {
+		t.Errorf("expected member without allowed role to be refused; got %+v", res)
+	}
+	if atomic.LoadInt32(&f.stack.starts) != 0 {
+		t.Errorf("expected stack not to be started")
+	}
+
+	_, res = f.post(command("start", "admin-role"), true)
+	if res.Type != responseDeferredChannelMessageWithSource {
+		t.Fatalf("expected deferred response; got %+v", res)
+	}
+	if content := <-f.edits; content != "the bot is up" {
+		t.Errorf("expected response to be edited after start; got %q", content)
+	}
+	if atomic.LoadInt32(&f.stack.starts) != 1 {
+		t.Errorf("expected stack to be started once")
+	}
+
+	_, res = f.post(command("status", "someone"), true)
+	if res.Type != responseDeferredChannelMessageWithSource {
+		t.Fatalf("expected anyone to query status; got %+v", res)
+	}
+	if content := <-f.edits; content != "the bot is up" {
+		t.Errorf("expected status to be up; got %q", content)
+	}
+
+	f.post(command("stop", "admin-role"), true)
+	if content := <-f.edits; content != "the bot is down" {
+		t.Errorf("expected response to be edited after stop; got %q", content)
+	}
+}
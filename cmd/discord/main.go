@@ -0,0 +1,106 @@
+// Command discord serves Discord interactions endpoint for
+// `/automute start|stop|status` slash command, so that players can
+// operate the stack without gcloud.
+//
+// Requests are verified with DISCORD_PUBLIC_KEY (hex) of the application.
+// start and stop are allowed only to members having one of
+// DISCORD_ALLOWED_ROLES (role IDs separated by comma).
+// The cluster is given by DISCORD_CLUSTER_NAME, DISCORD_CLUSTER_LOCATION,
+// DISCORD_PROJECT_ID (or GOOGLE_CLOUD_PROJECT), DISCORD_NODE_POOL,
+// DISCORD_NODE_COUNT and DISCORD_NAMESPACE. Listening port is given by PORT.
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/oakcask/automutek8s/cluster"
+	"google.golang.org/api/container/v1"
+)
+
+func publicKeyFromEnv(getenv func(string) string) (ed25519.PublicKey, error) {
+	key, e := hex.DecodeString(getenv("DISCORD_PUBLIC_KEY"))
+	if e != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("DISCORD_PUBLIC_KEY should be hex encoded Ed25519 public key")
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+func rolesFromEnv(getenv func(string) string) []string {
+	roles := make([]string, 0)
+	for _, role := range strings.Split(getenv("DISCORD_ALLOWED_ROLES"), ",") {
+		if role = strings.TrimSpace(role); role != "" {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
+
+// scalerFromEnv builds Scaler of the cluster given by environment variables.
+func scalerFromEnv(ctx context.Context, getenv func(string) string) (*cluster.Scaler, error) {
+	c := cluster.Cluster{
+		ProjectID: cluster.GetenvOr(getenv, "DISCORD_PROJECT_ID", getenv("GOOGLE_CLOUD_PROJECT")),
+		Location:  getenv("DISCORD_CLUSTER_LOCATION"),
+		Name:      getenv("DISCORD_CLUSTER_NAME"),
+	}
+	if c.ProjectID == "" || c.Location == "" || c.Name == "" {
+		return nil, fmt.Errorf("DISCORD_PROJECT_ID, DISCORD_CLUSTER_LOCATION and DISCORD_CLUSTER_NAME are required")
+	}
+
+	nodeCount, e := strconv.ParseInt(cluster.GetenvOr(getenv, "DISCORD_NODE_COUNT", "1"), 10, 64)
+	if e != nil {
+		return nil, fmt.Errorf("DISCORD_NODE_COUNT should be integer: %v", e)
+	}
+
+	service, e := container.NewService(ctx)
+	if e != nil {
+		return nil, e
+	}
+	client, e := cluster.NewKubernetesClient(ctx, service, c)
+	if e != nil {
+		return nil, e
+	}
+
+	return &cluster.Scaler{
+		NodePool: cluster.GKENodePool{
+			Service: service,
+			Cluster: c,
+			Name:    cluster.GetenvOr(getenv, "DISCORD_NODE_POOL", "primary-pool"),
+		},
+		NodeCount:    nodeCount,
+		Namespace:    cluster.GetenvOr(getenv, "DISCORD_NAMESPACE", "default"),
+		KeepPostgres: getenv("DISCORD_KEEP_POSTGRES") == "true",
+		Client:       client,
+	}, nil
+}
+
+func main() {
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+
+	publicKey, e := publicKeyFromEnv(os.Getenv)
+	if e != nil {
+		logger.Fatal(e)
+	}
+	roles := rolesFromEnv(os.Getenv)
+	if len(roles) == 0 {
+		logger.Printf("DISCORD_ALLOWED_ROLES is empty; nobody can start or stop the stack")
+	}
+
+	s, e := scalerFromEnv(context.Background(), os.Getenv)
+	if e != nil {
+		logger.Fatal(e)
+	}
+
+	port := cluster.GetenvOr(os.Getenv, "PORT", "8080")
+	handler := newCommandHandler(publicKey, roles, s, logger)
+
+	logger.Printf("serving interactions on :%s", port)
+	logger.Fatal(http.ListenAndServe(":"+port, handler))
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const healthzPath = "/_gate/healthz"
+const readyzPath = "/_gate/readyz"
+
+// startPath is requested by App Engine when manually scaled instance starts.
+const startPath = "/_ah/start"
+
+const readinessTimeout = 2 * time.Second
+
+// upstreamFromEnv builds URL of galactus from environment variables.
+// GATE_UPSTREAM takes precedence over GALACTUS_ADDR, which comes from
+// discovery ConfigMap when the gate runs in the cluster.
+// Scheme can be omitted, like "galactus:5858".
+func upstreamFromEnv(getenv func(string) string) (*url.URL, error) {
+	addr := getenv("GATE_UPSTREAM")
+	if addr == "" {
+		addr = getenv("GALACTUS_ADDR")
+	}
+	if addr == "" {
+		return nil, fmt.Errorf("GALACTUS_ADDR or GATE_UPSTREAM is required")
+	}
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+
+	upstream, e := url.Parse(addr)
+	if e != nil {
+		return nil, e
+	}
+	if upstream.Host == "" {
+		return nil, fmt.Errorf("upstream should have host: %s", addr)
+	}
+	return upstream, nil
+}
+
+// upstreamHostPort returns address of upstream to dial.
+func upstreamHostPort(upstream *url.URL) string {
+	if upstream.Port() != "" {
+		return upstream.Host
+	}
+	if upstream.Scheme == "https" {
+		return net.JoinHostPort(upstream.Hostname(), "443")
+	}
+	return net.JoinHostPort(upstream.Hostname(), "80")
+}
+
+// upstreamReachable tests TCP connection to upstream can be established.
+func upstreamReachable(upstream *url.URL) error {
+	conn, e := net.DialTimeout("tcp", upstreamHostPort(upstream), readinessTimeout)
+	if e != nil {
+		return e
+	}
+	return conn.Close()
+}
+
+// newGate builds handler which proxies plain HTTP requests and
+// WebSocket upgrades to upstream, and serves health endpoints.
+// If wake is given, requests are held by it until the stack wakes up.
+func newGate(upstream *url.URL, logger *log.Logger, wake *waker) http.Handler {
+	proxy := httputil.NewSingleHostReverseProxy(upstream)
+	proxy.ErrorLog = logger
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(healthzPath, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc(readyzPath, func(w http.ResponseWriter, r *http.Request) {
+		if e := upstreamReachable(upstream); e != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "upstream unreachable: %v\n", e)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, "ok")
+	})
+	// starting instance must not wake the stack up
+	mux.HandleFunc(startPath, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	if wake != nil {
+		proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, e error) {
+			logger.Printf("http: proxy error: %v", e)
+			wake.forgetReady()
+			w.WriteHeader(http.StatusBadGateway)
+		}
+		mux.Handle("/", wake.handler(proxy))
+	} else {
+		mux.Handle("/", proxy)
+	}
+
+	return logRequests(logger, mux)
+}
+
+// statusRecorder remembers status code written by handler.
+// It also lets the proxy hijack the connection for WebSocket.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Flush() {
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (rec *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := rec.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("connection cannot be hijacked")
+	}
+	return hijacker.Hijack()
+}
+
+// logRequests logs every request except health checks.
+func logRequests(logger *log.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == healthzPath || r.URL.Path == readyzPath {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		logger.Printf("%s %s %s %d %v", r.RemoteAddr, r.Method, r.URL.RequestURI(), rec.status, time.Since(start))
+	})
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestGate(t *testing.T, upstream *httptest.Server) *httptest.Server {
+	u, e := url.Parse(upstream.URL)
+	if e != nil {
+		t.Fatal(e)
+	}
+	return httptest.NewServer(newGate(u, log.New(ioutil.Discard, "", 0), nil))
+}
+
+func TestUpstreamFromEnv(t *testing.T) {
+	t.Parallel()
+
+	examples := []struct {
+		env      map[string]string
+		upstream string
+		valid    bool
+	}{
+		{map[string]string{"GALACTUS_ADDR": "http://galactus:5858"}, "http://galactus:5858", true},
+		{map[string]string{"GALACTUS_ADDR": "galactus:5858"}, "http://galactus:5858", true},
+		{map[string]string{"GALACTUS_ADDR": "galactus:5858", "GATE_UPSTREAM": "http://10.0.0.1:5858"}, "http://10.0.0.1:5858", true},
+		{map[string]string{}, "", false},
+		{map[string]string{"GALACTUS_ADDR": "http://"}, "", false},
+	}
+
+	for _, example := range examples {
+		env := example.env
+		upstream, e := upstreamFromEnv(func(key string) string { return env[key] })
+		if (e == nil) != example.valid {
+			t.Errorf("expected valid to be %v for %v; got %v", example.valid, env, e)
+			continue
+		}
+		if e == nil && upstream.String() != example.upstream {
+			t.Errorf("expected upstream to be %v for %v; got %v", example.upstream, env, upstream)
+		}
+	}
+}
+
+func TestGateProxiesHTTP(t *testing.T) {
+	t.Parallel()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s %s", r.Method, r.URL.RequestURI(), body)
+	}))
+	defer upstream.Close()
+	gate := newTestGate(t, upstream)
+	defer gate.Close()
+
+	res, e := http.Post(gate.URL+"/request/job?guild=1", "text/plain", strings.NewReader("payload"))
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer res.Body.Close()
+	body, e := ioutil.ReadAll(res.Body)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("expected status 200; got %v", res.StatusCode)
+	}
+	if expected := "POST /request/job?guild=1 payload"; string(body) != expected {
+		t.Errorf("expected body %q; got %q", expected, body)
+	}
+}
+
+func TestGateProxiesWebSocket(t *testing.T) {
+	t.Parallel()
+
+	// upstream accepts upgrade and echoes everything back, like WebSocket server
+	// does with frames; the gate should not care about the framing.
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+			http.Error(w, "upgrade required", http.StatusUpgradeRequired)
+			return
+		}
+		conn, buf, e := w.(http.Hijacker).Hijack()
+		if e != nil {
+			t.Error(e)
+			return
+		}
+		defer conn.Close()
+		fmt.Fprint(buf, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		buf.Flush()
+		io.Copy(conn, buf)
+	}))
+	defer upstream.Close()
+	gate := newTestGate(t, upstream)
+	defer gate.Close()
+
+	conn, e := net.Dial("tcp", strings.TrimPrefix(gate.URL, "http://"))
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	fmt.Fprint(conn, "GET /socket.io/?EIO=3&transport=websocket HTTP/1.1\r\n"+
+		"Host: gate.example.com\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"+
+		"Sec-WebSocket-Version: 13\r\n\r\n")
+
+	reader := bufio.NewReader(conn)
+	res, e := http.ReadResponse(reader, nil)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected status 101; got %v", res.StatusCode)
+	}
+
+	for _, message := range []string{"hello\n", "galactus\n"} {
+		if _, e = fmt.Fprint(conn, message); e != nil {
+			t.Fatal(e)
+		}
+		echo, e := reader.ReadString('\n')
+		if e != nil {
+			t.Fatal(e)
+		}
+		if echo != message {
+			t.Errorf("expected echo %q; got %q", message, echo)
+		}
+	}
+}
+
+func TestGateHealth(t *testing.T) {
+	t.Parallel()
+
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	gate := newTestGate(t, upstream)
+	defer gate.Close()
+
+	get := func(path string) int {
+		res, e := http.Get(gate.URL + path)
+		if e != nil {
+			t.Fatal(e)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	if status := get(healthzPath); status != http.StatusOK {
+		t.Errorf("expected healthz to be 200; got %v", status)
+	}
+	if status := get(readyzPath); status != http.StatusOK {
+		t.Errorf("expected readyz to be 200 while upstream is up; got %v", status)
+	}
+
+	upstream.Close()
+
+	if status := get(healthzPath); status != http.StatusOK {
+		t.Errorf("expected healthz to be 200 regardless of upstream; got %v", status)
+	}
+	if status := get(readyzPath); status != http.StatusServiceUnavailable {
+		t.Errorf("expected readyz to be 503 while upstream is down; got %v", status)
+	}
+}
+
+func TestGateStartDoesNotWake(t *testing.T) {
+	t.Parallel()
+
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	defer upstream.Close()
+	u, e := url.Parse(upstream.URL)
+	if e != nil {
+		t.Fatal(e)
+	}
+	logger := log.New(ioutil.Discard, "", 0)
+	s := &fakeScaler{woken: make(chan struct{})}
+	w := newWaker(s, func() bool { return false }, 0, logger)
+	gate := httptest.NewServer(newGate(u, logger, w))
+	defer gate.Close()
+
+	res, e := http.Get(gate.URL + startPath)
+	if e != nil {
+		t.Fatal(e)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("expected start request to be 200; got %v", res.StatusCode)
+	}
+	if ups := atomic.LoadInt32(&s.ups); ups != 0 {
+		t.Errorf("expected start request not to wake the stack; got %d scale ups", ups)
+	}
+}
@@ -0,0 +1,54 @@
+// Command gate is reverse proxy which fronts galactus.
+//
+// It proxies plain HTTP requests as well as WebSocket upgrades,
+// so that it can be deployed to App Engine (standard or flexible),
+// which terminates TLS, or run as a pod in the cluster.
+// Upstream is given by GALACTUS_ADDR environment variable
+// (like http://172.16.0.10:5858) and listening port by PORT.
+// Health endpoints are served at /_gate/healthz and /_gate/readyz.
+//
+// When GATE_CLUSTER_NAME is given, the gate wakes the cluster up
+// on request while galactus is down, and puts it to sleep after
+// GATE_IDLE_MINUTES without traffic. See wakerFromEnv for other variables.
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+const idleCheckInterval = time.Minute
+
+func main() {
+	upstream, e := upstreamFromEnv(os.Getenv)
+	if e != nil {
+		log.Fatal(e)
+	}
+
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+
+	ctx := context.Background()
+	isReady := func() bool {
+		return upstreamReachable(upstream) == nil
+	}
+	wake, e := wakerFromEnv(ctx, os.Getenv, isReady, logger)
+	if e != nil {
+		logger.Fatal(e)
+	}
+	if wake != nil {
+		go wake.run(ctx, idleCheckInterval)
+	}
+
+	gate := newGate(upstream, logger, wake)
+
+	logger.Printf("proxying :%s to %v", port, upstream)
+	logger.Fatal(http.ListenAndServe(":"+port, gate))
+}
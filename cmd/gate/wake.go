@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oakcask/automutek8s/cluster"
+	"google.golang.org/api/container/v1"
+)
+
+const wakeTimeout = 15 * time.Minute
+const wakeRetryAfterSeconds = 15
+
+const wakingPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="%d">
+<title>Waking up</title>
+</head>
+<body>
+<h1>Waking up&hellip;</h1>
+<p>AutoMuteUs is starting. This page reloads automatically in a few minutes.</p>
+</body>
+</html>
+`
+
+// scaler scales the stack behind the gate.
+type scaler interface {
+	Start(ctx context.Context) error
+	Stop(ctx context.Context) error
+}
+
+// waker wakes the stack up on request while galactus is down,
+// and puts it to sleep after idle period without traffic.
+// Once galactus is found ready, it is not dialed again until the stack
+// is put to sleep or the proxy fails to reach galactus.
+type waker struct {
+	scaler  scaler
+	isReady func() bool
+	idle    time.Duration
+	logger  *log.Logger
+	now     func() time.Time
+
+	mu           sync.Mutex
+	lastActivity time.Time
+	waking       bool
+	asleep       bool
+	ready        bool
+}
+
+func newWaker(s scaler, isReady func() bool, idle time.Duration, logger *log.Logger) *waker {
+	return &waker{
+		scaler:       s,
+		isReady:      isReady,
+		idle:         idle,
+		logger:       logger,
+		now:          time.Now,
+		lastActivity: time.Now(),
+	}
+}
+
+// wakerFromEnv builds waker scaling the cluster given by environment variables.
+// It returns nil if GATE_CLUSTER_NAME is not set.
+func wakerFromEnv(ctx context.Context, getenv func(string) string, isReady func() bool, logger *log.Logger) (*waker, error) {
+	clusterName := getenv("GATE_CLUSTER_NAME")
+	if clusterName == "" {
+		return nil, nil
+	}
+
+	projectID := getenv("GATE_PROJECT_ID")
+	if projectID == "" {
+		projectID = getenv("GOOGLE_CLOUD_PROJECT")
+	}
+	c := cluster.Cluster{
+		ProjectID: projectID,
+		Location:  getenv("GATE_CLUSTER_LOCATION"),
+		Name:      clusterName,
+	}
+	if c.ProjectID == "" || c.Location == "" {
+		return nil, fmt.Errorf("GATE_PROJECT_ID and GATE_CLUSTER_LOCATION are required to wake cluster up")
+	}
+
+	nodeCount, e := strconv.ParseInt(cluster.GetenvOr(getenv, "GATE_NODE_COUNT", "1"), 10, 64)
+	if e != nil {
+		return nil, fmt.Errorf("GATE_NODE_COUNT should be integer: %v", e)
+	}
+	idleMinutes, e := strconv.Atoi(cluster.GetenvOr(getenv, "GATE_IDLE_MINUTES", "0"))
+	if e != nil {
+		return nil, fmt.Errorf("GATE_IDLE_MINUTES should be integer: %v", e)
+	}
+
+	service, e := container.NewService(ctx)
+	if e != nil {
+		return nil, e
+	}
+	client, e := cluster.NewKubernetesClient(ctx, service, c)
+	if e != nil {
+		return nil, e
+	}
+
+	s := &cluster.Scaler{
+		NodePool: cluster.GKENodePool{
+			Service: service,
+			Cluster: c,
+			Name:    cluster.GetenvOr(getenv, "GATE_NODE_POOL", "primary-pool"),
+		},
+		NodeCount:    nodeCount,
+		Namespace:    cluster.GetenvOr(getenv, "GATE_NAMESPACE", "default"),
+		KeepPostgres: getenv("GATE_KEEP_POSTGRES") == "true",
+		Client:       client,
+	}
+
+	return newWaker(s, isReady, time.Duration(idleMinutes)*time.Minute, logger), nil
+}
+
+// handler proxies requests to next while galactus is ready.
+// Otherwise it starts waking the stack up and responds waking page.
+func (w *waker) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		w.touch()
+
+		if w.checkReady() {
+			next.ServeHTTP(rw, r)
+			return
+		}
+
+		w.wake()
+
+		rw.Header().Set("Retry-After", strconv.Itoa(wakeRetryAfterSeconds))
+		if r.Method != http.MethodGet || r.Header.Get("Upgrade") != "" || !strings.Contains(r.Header.Get("Accept"), "text/html") {
+			http.Error(rw, "waking up", http.StatusServiceUnavailable)
+			return
+		}
+		rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(rw, wakingPage, wakeRetryAfterSeconds)
+	})
+}
+
+func (w *waker) touch() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.lastActivity = w.now()
+}
+
+// checkReady returns true if galactus is ready.
+// It dials galactus only while readiness is not known.
+func (w *waker) checkReady() bool {
+	w.mu.Lock()
+	ready := w.ready
+	w.mu.Unlock()
+	if ready {
+		return true
+	}
+
+	if !w.isReady() {
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	// galactus stays reachable for a while after the stack is put to sleep
+	w.ready = !w.asleep || w.waking
+	return true
+}
+
+// forgetReady makes next request dial galactus again,
+// like when the stack is stopped by someone else.
+func (w *waker) forgetReady() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.ready = false
+}
+
+// wake scales the stack up in background unless it is already waking.
+func (w *waker) wake() {
+	w.mu.Lock()
+	if w.waking {
+		w.mu.Unlock()
+		return
+	}
+	w.waking = true
+	w.mu.Unlock()
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), wakeTimeout)
+		defer cancel()
+
+		w.logger.Printf("waking up the stack")
+		e := w.scaler.Start(ctx)
+		if e != nil {
+			w.logger.Printf("failed to wake up the stack: %v", e)
+		}
+
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		w.waking = false
+		if e == nil {
+			w.asleep = false
+		}
+	}()
+}
+
+// sleepIfIdle scales the stack down if no request came in idle period.
+func (w *waker) sleepIfIdle(ctx context.Context) {
+	if w.idle <= 0 {
+		return
+	}
+
+	w.mu.Lock()
+	if w.asleep || w.waking || w.now().Sub(w.lastActivity) < w.idle {
+		w.mu.Unlock()
+		return
+	}
+	w.asleep = true
+	w.ready = false
+	w.mu.Unlock()
+
+	w.logger.Printf("putting the stack to sleep after %v without traffic", w.idle)
+	if e := w.scaler.Stop(ctx); e != nil {
+		w.logger.Printf("failed to put the stack to sleep: %v", e)
+		w.mu.Lock()
+		w.asleep = false
+		w.mu.Unlock()
+	}
+}
+
+// run checks idleness every interval until ctx is done.
+func (w *waker) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.sleepIfIdle(ctx)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type fakeScaler struct {
+	ups     int32
+	downs   int32
+	started chan struct{}
+	woken   chan struct{}
+}
+
+func (s *fakeScaler) Start(ctx context.Context) error {
+	atomic.AddInt32(&s.ups, 1)
+	if s.started != nil {
+		s.started <- struct{}{}
+	}
+	<-s.woken
+	return nil
+}
+
+func (s *fakeScaler) Stop(ctx context.Context) error {
+	atomic.AddInt32(&s.downs, 1)
+	return nil
+}
+
+func TestWakerWakesStackUp(t *testing.T) {
+	t.Parallel()
+
+	var ready int32
+	s := &fakeScaler{started: make(chan struct{}, 1), woken: make(chan struct{})}
+	w := newWaker(s, func() bool { return atomic.LoadInt32(&ready) != 0 }, 0, log.New(ioutil.Discard, "", 0))
+	backend := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte("proxied"))
+	})
+	server := httptest.NewServer(w.handler(backend))
+	defer server.Close()
+
+	get := func() (*http.Response, string) {
+		req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+		req.Header.Set("Accept", "text/html")
+		res, e := http.DefaultClient.Do(req)
+		if e != nil {
+			t.Fatal(e)
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		return res, string(body)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, body := get()
+			if res.StatusCode != http.StatusServiceUnavailable {
+				t.Errorf("expected 503 while waking up; got %v", res.StatusCode)
+			}
+			if res.Header.Get("Retry-After") == "" {
+				t.Errorf("expected Retry-After header")
+			}
+			if !strings.Contains(body, "Waking up") {
+				t.Errorf("expected waking page; got %q", body)
+			}
+		}()
+	}
+	wg.Wait()
+
+	select {
+	case <-s.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the stack to be scaled up")
+	}
+	if ups := atomic.LoadInt32(&s.ups); ups != 1 {
+		t.Errorf("expected single scale up for concurrent requests; got %d", ups)
+	}
+
+	close(s.woken)
+	atomic.StoreInt32(&ready, 1)
+
+	res, body := get()
+	if res.StatusCode != http.StatusOK || body != "proxied" {
+		t.Errorf("expected request to be proxied once ready; got %v %q", res.StatusCode, body)
+	}
+}
+
+func TestWakerSleepsIfIdle(t *testing.T) {
+	t.Parallel()
+
+	s := &fakeScaler{woken: make(chan struct{})}
+	close(s.woken)
+	w := newWaker(s, func() bool { return true }, 30*time.Minute, log.New(ioutil.Discard, "", 0))
+
+	now := time.Date(2021, 1, 1, 21, 0, 0, 0, time.UTC)
+	w.now = func() time.Time { return now }
+	w.touch()
+
+	now = now.Add(29 * time.Minute)
+	w.sleepIfIdle(context.Background())
+	if downs := atomic.LoadInt32(&s.downs); downs != 0 {
+		t.Errorf("expected no scale down before idle period; got %d", downs)
+	}
+
+	now = now.Add(time.Minute)
+	w.sleepIfIdle(context.Background())
+	w.sleepIfIdle(context.Background())
+	if downs := atomic.LoadInt32(&s.downs); downs != 1 {
+		t.Errorf("expected single scale down after idle period; got %d", downs)
+	}
+}
+
+func TestWakerCachesReadiness(t *testing.T) {
+	t.Parallel()
+
+	var dials int32
+	s := &fakeScaler{woken: make(chan struct{})}
+	close(s.woken)
+	w := newWaker(s, func() bool {
+		atomic.AddInt32(&dials, 1)
+		return true
+	}, 30*time.Minute, log.New(ioutil.Discard, "", 0))
+	handler := w.handler(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}))
+
+	serve := func() {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+	serve()
+	serve()
+	if n := atomic.LoadInt32(&dials); n != 1 {
+		t.Errorf("expected galactus to be dialed once while ready; got %d", n)
+	}
+
+	w.forgetReady()
+	serve()
+	if n := atomic.LoadInt32(&dials); n != 2 {
+		t.Errorf("expected galactus to be dialed again after proxy error; got %d", n)
+	}
+
+	now := time.Now().Add(time.Hour)
+	w.now = func() time.Time { return now }
+	w.sleepIfIdle(context.Background())
+	serve()
+	serve()
+	if n := atomic.LoadInt32(&dials); n != 4 {
+		t.Errorf("expected galactus to be dialed on every request while asleep; got %d", n)
+	}
+}
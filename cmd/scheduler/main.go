@@ -0,0 +1,64 @@
+// Command scheduler is in-cluster controller which stops automuteus stack
+// on schedule (like "weekdays 23:00" in Asia/Tokyo), or after period
+// without voice activity of players.
+//
+// It is configured by environment variables from scheduler-config ConfigMap:
+// SCHEDULE_TIMEZONE, SCHEDULE_SHUTDOWN (rules separated by semicolon),
+// SCHEDULE_IDLE_MINUTES and SCHEDULE_ACTIVITY_PATTERN.
+// SCHEDULE_KEEP_POSTGRES=true leaves postgres running for tenants sharing it.
+// The stack is started again by `mage cluster:start` or the gate.
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+	_ "time/tzdata"
+
+	"github.com/oakcask/automutek8s/cluster"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const checkInterval = time.Minute
+
+func main() {
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+
+	settings, e := settingsFromEnv(os.Getenv)
+	if e != nil {
+		logger.Fatal(e)
+	}
+
+	restConfig, e := rest.InClusterConfig()
+	if e != nil {
+		logger.Fatal(e)
+	}
+	client, e := kubernetes.NewForConfig(restConfig)
+	if e != nil {
+		logger.Fatal(e)
+	}
+
+	s := &scheduler{
+		schedule: settings.Schedule,
+		idle:     settings.Idle,
+		stack: &cluster.Scaler{
+			Namespace:    settings.Namespace,
+			NamePrefix:   settings.NamePrefix,
+			KeepPostgres: settings.KeepPostgres,
+			Client:       client,
+		},
+		probe: cluster.LogActivityProbe{
+			Client:    client,
+			Namespace: settings.Namespace,
+			Selectors: cluster.ActivitySelectors,
+			Pattern:   settings.ActivityPattern,
+		},
+		logger: logger,
+		now:    time.Now,
+	}
+
+	logger.Printf("watching the stack in namespace %s", settings.Namespace)
+	s.run(context.Background(), checkInterval)
+}
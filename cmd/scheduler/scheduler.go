@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/oakcask/automutek8s/cluster"
+)
+
+// stack is automuteus stack which the scheduler stops.
+type stack interface {
+	Running(ctx context.Context) (bool, error)
+	Stop(ctx context.Context) error
+}
+
+// activityProbe tells whether players have been active.
+type activityProbe interface {
+	ActiveSince(ctx context.Context, since time.Time) (bool, error)
+}
+
+// scheduler stops the stack on schedule, or after idle period
+// without activity of players.
+type scheduler struct {
+	schedule cluster.Schedule
+	idle     time.Duration
+	stack    stack
+	probe    activityProbe
+	logger   *log.Logger
+	now      func() time.Time
+
+	lastCheck time.Time
+}
+
+// settings is configuration of scheduler given by scheduler-config ConfigMap.
+type settings struct {
+	Schedule        cluster.Schedule
+	Idle            time.Duration
+	ActivityPattern *regexp.Regexp
+	Namespace       string
+	NamePrefix      string
+	KeepPostgres    bool
+}
+
+// settingsFromEnv reads settings from environment variables,
+// which come from scheduler-config ConfigMap.
+func settingsFromEnv(getenv func(string) string) (settings, error) {
+	var s settings
+
+	tz := getenv("SCHEDULE_TIMEZONE")
+	if tz == "" {
+		tz = "UTC"
+	}
+	schedule, e := cluster.ParseSchedule(getenv("SCHEDULE_SHUTDOWN"), tz)
+	if e != nil {
+		return s, e
+	}
+	s.Schedule = schedule
+
+	if idle := getenv("SCHEDULE_IDLE_MINUTES"); idle != "" {
+		minutes, e := strconv.Atoi(idle)
+		if e != nil {
+			return s, fmt.Errorf("SCHEDULE_IDLE_MINUTES should be integer: %v", e)
+		}
+		s.Idle = time.Duration(minutes) * time.Minute
+	}
+
+	pattern := getenv("SCHEDULE_ACTIVITY_PATTERN")
+	if pattern == "" {
+		pattern = cluster.DefaultActivityPattern
+	}
+	if s.ActivityPattern, e = regexp.Compile(pattern); e != nil {
+		return s, fmt.Errorf("SCHEDULE_ACTIVITY_PATTERN is malformed: %v", e)
+	}
+
+	s.Namespace = getenv("POD_NAMESPACE")
+	if s.Namespace == "" {
+		s.Namespace = "default"
+	}
+	s.NamePrefix = getenv("SCHEDULE_NAME_PREFIX")
+	s.KeepPostgres = getenv("SCHEDULE_KEEP_POSTGRES") == "true"
+
+	if len(s.Schedule.Rules) == 0 && s.Idle == 0 {
+		return s, fmt.Errorf("either SCHEDULE_SHUTDOWN or SCHEDULE_IDLE_MINUTES is required")
+	}
+
+	return s, nil
+}
+
+// tick stops the stack if scheduled time has come since last tick,
+// or no activity is found in idle period.
+func (s *scheduler) tick(ctx context.Context) error {
+	now := s.now()
+	lastCheck := s.lastCheck
+	s.lastCheck = now
+	if lastCheck.IsZero() {
+		lastCheck = now
+	}
+
+	running, e := s.stack.Running(ctx)
+	if e != nil {
+		return e
+	}
+	if !running {
+		return nil
+	}
+
+	if s.schedule.Between(lastCheck, now) {
+		s.logger.Printf("stopping the stack on schedule")
+		return s.stack.Stop(ctx)
+	}
+
+	if s.idle > 0 {
+		active, e := s.probe.ActiveSince(ctx, now.Add(-s.idle))
+		if e != nil {
+			return e
+		}
+		if !active {
+			s.logger.Printf("stopping the stack after %v without activity", s.idle)
+			return s.stack.Stop(ctx)
+		}
+	}
+
+	return nil
+}
+
+// run ticks every interval until ctx is done.
+func (s *scheduler) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if e := s.tick(ctx); e != nil {
+			s.logger.Printf("failed to check schedule: %v", e)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/oakcask/automutek8s/cluster"
+)
+
+type fakeStack struct {
+	running bool
+	stops   int
+}
+
+func (s *fakeStack) Running(ctx context.Context) (bool, error) {
+	return s.running, nil
+}
+
+func (s *fakeStack) Stop(ctx context.Context) error {
+	s.stops++
+	s.running = false
+	return nil
+}
+
+type fakeProbe struct {
+	lastActivity time.Time
+}
+
+func (p fakeProbe) ActiveSince(ctx context.Context, since time.Time) (bool, error) {
+	return p.lastActivity.After(since), nil
+}
+
+func TestSettingsFromEnv(t *testing.T) {
+	t.Parallel()
+
+	env := map[string]string{
+		"SCHEDULE_TIMEZONE":     "Asia/Tokyo",
+		"SCHEDULE_SHUTDOWN":     "weekdays 23:00",
+		"SCHEDULE_IDLE_MINUTES": "120",
+		"SCHEDULE_NAME_PREFIX":  "b-",
+	}
+	s, e := settingsFromEnv(func(key string) string { return env[key] })
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(s.Schedule.Rules) != 1 || s.Idle != 2*time.Hour || s.Namespace != "default" || s.NamePrefix != "b-" {
+		t.Errorf("unexpected settings: %+v", s)
+	}
+
+	if _, e = settingsFromEnv(func(key string) string { return "" }); e == nil {
+		t.Errorf("expected error without any rule")
+	}
+}
+
+func TestSchedulerTick(t *testing.T) {
+	t.Parallel()
+
+	schedule, e := cluster.ParseSchedule("weekdays 23:00", "Asia/Tokyo")
+	if e != nil {
+		t.Fatal(e)
+	}
+	jst := schedule.Location
+	now := time.Date(2021, 1, 8, 22, 58, 0, 0, jst)
+
+	st := &fakeStack{running: true}
+	probe := &fakeProbe{lastActivity: now}
+	s := &scheduler{
+		schedule: schedule,
+		idle:     2 * time.Hour,
+		stack:    st,
+		probe:    probe,
+		logger:   log.New(ioutil.Discard, "", 0),
+		now:      func() time.Time { return now },
+	}
+	ctx := context.Background()
+
+	for _, minute := range []int{58, 59} {
+		now = time.Date(2021, 1, 8, 22, minute, 0, 0, jst)
+		if e = s.tick(ctx); e != nil {
+			t.Fatal(e)
+		}
+	}
+	if st.stops != 0 {
+		t.Errorf("expected the stack not to be stopped before schedule; got %d", st.stops)
+	}
+
+	now = time.Date(2021, 1, 8, 23, 0, 10, 0, jst)
+	if e = s.tick(ctx); e != nil {
+		t.Fatal(e)
+	}
+	if st.stops != 1 {
+		t.Errorf("expected the stack to be stopped on schedule; got %d", st.stops)
+	}
+
+	// started again after schedule; idle rule stops it after 2 hours without activity
+	st.running = true
+	probe.lastActivity = time.Date(2021, 1, 8, 23, 30, 0, 0, jst)
+	now = time.Date(2021, 1, 9, 1, 29, 0, 0, jst)
+	if e = s.tick(ctx); e != nil {
+		t.Fatal(e)
+	}
+	if st.stops != 1 {
+		t.Errorf("expected the stack not to be stopped while active; got %d", st.stops)
+	}
+
+	now = time.Date(2021, 1, 9, 1, 31, 0, 0, jst)
+	if e = s.tick(ctx); e != nil {
+		t.Fatal(e)
+	}
+	if st.stops != 2 {
+		t.Errorf("expected the stack to be stopped without activity; got %d", st.stops)
+	}
+}
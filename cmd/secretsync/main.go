@@ -0,0 +1,55 @@
+// Command secretsync is in-cluster controller which materializes Secrets
+// named in kubernetes/base/secrets from Secret Manager, so that secrets
+// never go through the workstation of the operator.
+//
+// It runs as Google service account through workload identity and reads
+// the secrets stored by `mage secrets:set`. Secret templates are mounted from
+// secretsync-manifests ConfigMap at SECRETSYNC_MANIFESTS, and synced every
+// SECRETSYNC_INTERVAL_MINUTES.
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+
+	"github.com/oakcask/automutek8s/tools"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+func main() {
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+
+	settings, e := settingsFromEnv(os.Getenv)
+	if e != nil {
+		logger.Fatal(e)
+	}
+
+	manifests, e := tools.LoadSecretManifests(settings.Manifests)
+	if e != nil {
+		logger.Fatal(e)
+	}
+	if len(manifests) == 0 {
+		logger.Fatalf("no secret templates in %s", settings.Manifests)
+	}
+
+	restConfig, e := rest.InClusterConfig()
+	if e != nil {
+		logger.Fatal(e)
+	}
+	client, e := kubernetes.NewForConfig(restConfig)
+	if e != nil {
+		logger.Fatal(e)
+	}
+
+	s := &syncer{
+		unvail:    unvail,
+		client:    client,
+		namespace: settings.Namespace,
+		logger:    logger,
+	}
+
+	logger.Printf("syncing %d secrets into namespace %s every %v", len(manifests), settings.Namespace, settings.Interval)
+	s.run(context.Background(), manifests, settings.Interval)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/oakcask/automutek8s/tools"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// managedByLabel marks Secrets materialized by the controller.
+const managedByLabel = "app.kubernetes.io/managed-by"
+
+const managedBy = "automutek8s-secretsync"
+
+// settings is configuration of the controller given by secretsync-config ConfigMap.
+type settings struct {
+	Manifests string
+	Interval  time.Duration
+	Namespace string
+}
+
+func settingsFromEnv(getenv func(string) string) (settings, error) {
+	s := settings{
+		Manifests: getenv("SECRETSYNC_MANIFESTS"),
+		Interval:  10 * time.Minute,
+		Namespace: getenv("POD_NAMESPACE"),
+	}
+	if s.Manifests == "" {
+		s.Manifests = "/etc/secretsync"
+	}
+	if s.Namespace == "" {
+		s.Namespace = "default"
+	}
+	if interval := getenv("SECRETSYNC_INTERVAL_MINUTES"); interval != "" {
+		minutes, e := strconv.Atoi(interval)
+		if e != nil || minutes <= 0 {
+			return s, fmt.Errorf("SECRETSYNC_INTERVAL_MINUTES should be positive integer: %s", interval)
+		}
+		s.Interval = time.Duration(minutes) * time.Minute
+	}
+	return s, nil
+}
+
+// syncer materializes Secrets from Secret Manager.
+type syncer struct {
+	unvail    func(ctx context.Context, handle tools.SecretHandle) ([]byte, error)
+	client    kubernetes.Interface
+	namespace string
+	logger    *log.Logger
+}
+
+func unvail(ctx context.Context, handle tools.SecretHandle) ([]byte, error) {
+	return handle.Unvail(ctx)
+}
+
+// sync creates or updates Secrets named in manifests with payloads in Secret Manager.
+// Manifests in other namespaces are skipped.
+func (s *syncer) sync(ctx context.Context, manifests []corev1.Secret) error {
+	for _, manifest := range manifests {
+		if manifest.Namespace != "" && manifest.Namespace != s.namespace {
+			continue
+		}
+
+		// secrets of environments are stored under their namespaces
+		manifest.Namespace = s.namespace
+		data := map[string][]byte{}
+		for _, handle := range tools.NewSecretHandles(manifest) {
+			payload, e := s.unvail(ctx, handle)
+			if e != nil {
+				return fmt.Errorf("failed to unvail %v: %v", handle.String(), e)
+			}
+			data[handle.Key] = payload
+		}
+
+		if e := s.put(ctx, manifest, data); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+func (s *syncer) put(ctx context.Context, manifest corev1.Secret, data map[string][]byte) error {
+	secrets := s.client.CoreV1().Secrets(s.namespace)
+
+	live, e := secrets.Get(ctx, manifest.Name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(e) {
+		secret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      manifest.Name,
+				Namespace: s.namespace,
+				Labels:    map[string]string{managedByLabel: managedBy},
+			},
+			Type: manifest.Type,
+			Data: data,
+		}
+		s.logger.Printf("creating secret %s", manifest.Name)
+		_, e = secrets.Create(ctx, secret, metav1.CreateOptions{})
+		return e
+	} else if e != nil {
+		return e
+	}
+
+	if live.Labels[managedByLabel] != managedBy {
+		return fmt.Errorf("secret %s exists but is not managed by %s", manifest.Name, managedBy)
+	}
+	if equalData(live.Data, data) {
+		return nil
+	}
+
+	live.Data = data
+	s.logger.Printf("updating secret %s", manifest.Name)
+	_, e = secrets.Update(ctx, live, metav1.UpdateOptions{})
+	return e
+}
+
+func equalData(a map[string][]byte, b map[string][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, value := range a {
+		if other, ok := b[key]; !ok || !bytes.Equal(value, other) {
+			return false
+		}
+	}
+	return true
+}
+
+// run syncs every interval until ctx is done.
+func (s *syncer) run(ctx context.Context, manifests []corev1.Secret, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if e := s.sync(ctx, manifests); e != nil {
+			s.logger.Printf("failed to sync secrets: %v", e)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
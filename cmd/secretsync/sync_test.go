@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"testing"
+
+	"github.com/oakcask/automutek8s/tools"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestSyncMaterializesSecrets(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	client := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "redis", Namespace: "default"},
+		Data:       map[string][]byte{"REDIS_PASSWORD": []byte("by hand")},
+	})
+	stored := map[string]string{
+		"postgres POSTGRES_USER":     "automuteus",
+		"postgres POSTGRES_PASSWORD": "secret",
+	}
+	s := &syncer{
+		unvail: func(ctx context.Context, handle tools.SecretHandle) ([]byte, error) {
+			return []byte(stored[handle.String()]), nil
+		},
+		client:    client,
+		namespace: "default",
+		logger:    log.New(ioutil.Discard, "", 0),
+	}
+	postgres := corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "postgres"},
+		Type:       corev1.SecretTypeOpaque,
+		Data:       map[string][]byte{"POSTGRES_USER": nil, "POSTGRES_PASSWORD": nil},
+	}
+
+	if e := s.sync(ctx, []corev1.Secret{postgres}); e != nil {
+		t.Fatal(e)
+	}
+	secret, e := client.CoreV1().Secrets("default").Get(ctx, "postgres", metav1.GetOptions{})
+	if e != nil {
+		t.Fatal(e)
+	}
+	if string(secret.Data["POSTGRES_PASSWORD"]) != "secret" || secret.Labels[managedByLabel] != managedBy {
+		t.Errorf("expected postgres secret to be created from Secret Manager; got %v %v", secret.Labels, secret.Data)
+	}
+
+	stored["postgres POSTGRES_PASSWORD"] = "rotated"
+	if e = s.sync(ctx, []corev1.Secret{postgres}); e != nil {
+		t.Fatal(e)
+	}
+	secret, _ = client.CoreV1().Secrets("default").Get(ctx, "postgres", metav1.GetOptions{})
+	if string(secret.Data["POSTGRES_PASSWORD"]) != "rotated" {
+		t.Errorf("expected postgres secret to be updated; got %v", secret.Data)
+	}
+
+	redis := corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "redis"},
+		Data:       map[string][]byte{"REDIS_PASSWORD": nil},
+	}
+	if e = s.sync(ctx, []corev1.Secret{redis}); e == nil {
+		t.Errorf("expected secret created by hand not to be overwritten")
+	}
+
+	redis.Namespace = "tenant-alpha"
+	if e = s.sync(ctx, []corev1.Secret{redis}); e != nil {
+		t.Errorf("expected secret in another namespace to be skipped; got %v", e)
+	}
+}
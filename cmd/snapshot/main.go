@@ -0,0 +1,54 @@
+// Command snapshot is one-shot job which takes VolumeSnapshots of
+// persistent disks of postgres and redis, and deletes ones older than
+// retention, keeping the newest one ready to use anyway.
+//
+// It is configured by environment variables from snapshot-config ConfigMap:
+// SNAPSHOT_CLASS, SNAPSHOT_RETENTION_DAYS, SNAPSHOT_NAME_PREFIX and
+// SNAPSHOT_VOLUMES (StatefulSets separated by comma).
+// Volumes are restored from the snapshots by `mage volumes:restore`.
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+
+	"github.com/oakcask/automutek8s/cluster"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+func main() {
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+
+	settings, e := settingsFromEnv(os.Getenv)
+	if e != nil {
+		logger.Fatal(e)
+	}
+
+	restConfig, e := rest.InClusterConfig()
+	if e != nil {
+		logger.Fatal(e)
+	}
+	client, e := kubernetes.NewForConfig(restConfig)
+	if e != nil {
+		logger.Fatal(e)
+	}
+	dynamicClient, e := dynamic.NewForConfig(restConfig)
+	if e != nil {
+		logger.Fatal(e)
+	}
+
+	s := &cluster.Snapshotter{
+		Client:     client,
+		Dynamic:    dynamicClient,
+		Namespace:  settings.Namespace,
+		NamePrefix: settings.NamePrefix,
+		ClassName:  settings.ClassName,
+	}
+	if e := snapshotAll(context.Background(), s, settings.Volumes, settings.Retention, time.Now()); e != nil {
+		logger.Fatal(e)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/oakcask/automutek8s/cluster"
+)
+
+// settings is configuration of the job given by snapshot-config ConfigMap.
+type settings struct {
+	ClassName  string
+	Retention  time.Duration
+	NamePrefix string
+	Namespace  string
+	Volumes    []cluster.Volume
+}
+
+func settingsFromEnv(getenv func(string) string) (settings, error) {
+	s := settings{
+		ClassName:  getenv("SNAPSHOT_CLASS"),
+		Retention:  7 * 24 * time.Hour,
+		NamePrefix: getenv("SNAPSHOT_NAME_PREFIX"),
+		Namespace:  getenv("POD_NAMESPACE"),
+	}
+	if s.ClassName == "" {
+		return s, fmt.Errorf("SNAPSHOT_CLASS is required")
+	}
+	if s.Namespace == "" {
+		s.Namespace = "default"
+	}
+	s.Volumes = cluster.Volumes
+	if names := getenv("SNAPSHOT_VOLUMES"); names != "" {
+		s.Volumes = nil
+		for _, name := range strings.Split(names, ",") {
+			volume, e := cluster.FindVolume(strings.TrimSpace(name))
+			if e != nil {
+				return s, fmt.Errorf("SNAPSHOT_VOLUMES: %v", e)
+			}
+			s.Volumes = append(s.Volumes, volume)
+		}
+	}
+	if retention := getenv("SNAPSHOT_RETENTION_DAYS"); retention != "" {
+		days, e := strconv.Atoi(retention)
+		if e != nil || days <= 0 {
+			return s, fmt.Errorf("SNAPSHOT_RETENTION_DAYS should be positive integer: %s", retention)
+		}
+		s.Retention = time.Duration(days) * 24 * time.Hour
+	}
+	return s, nil
+}
+
+// snapshotAll takes snapshots of volumes and prunes ones older than retention.
+// It goes on with other volumes when one of them fails, and returns the first error.
+func snapshotAll(ctx context.Context, s *cluster.Snapshotter, volumes []cluster.Volume, retention time.Duration, now time.Time) error {
+	var first error
+	for _, volume := range volumes {
+		if _, e := s.Take(ctx, volume, now); e != nil {
+			if first == nil {
+				first = fmt.Errorf("failed to snapshot %s: %v", s.ClaimName(volume), e)
+			}
+			continue
+		}
+		if e := s.Prune(ctx, volume, now.Add(-retention)); e != nil && first == nil {
+			first = fmt.Errorf("failed to prune snapshots of %s: %v", s.ClaimName(volume), e)
+		}
+	}
+	return first
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/oakcask/automutek8s/cluster"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestSettingsFromEnv(t *testing.T) {
+	t.Parallel()
+
+	env := map[string]string{
+		"SNAPSHOT_CLASS":          "automutek8s-snapshot",
+		"SNAPSHOT_RETENTION_DAYS": "3",
+		"SNAPSHOT_NAME_PREFIX":    "b-",
+	}
+	s, e := settingsFromEnv(func(key string) string { return env[key] })
+	if e != nil {
+		t.Fatal(e)
+	}
+	if s.Retention != 72*time.Hour || s.Namespace != "default" || s.NamePrefix != "b-" || len(s.Volumes) != 2 {
+		t.Errorf("unexpected settings: %+v", s)
+	}
+
+	env["SNAPSHOT_VOLUMES"] = "redis"
+	if s, e := settingsFromEnv(func(key string) string { return env[key] }); e != nil || len(s.Volumes) != 1 || s.Volumes[0].StatefulSet != "redis" {
+		t.Errorf("expected only redis to be snapshotted; got %+v %v", s.Volumes, e)
+	}
+	env["SNAPSHOT_VOLUMES"] = "mysql"
+	if _, e := settingsFromEnv(func(key string) string { return env[key] }); e == nil {
+		t.Errorf("expected error with unknown volume")
+	}
+	delete(env, "SNAPSHOT_VOLUMES")
+
+	env["SNAPSHOT_RETENTION_DAYS"] = "0"
+	if _, e := settingsFromEnv(func(key string) string { return env[key] }); e == nil {
+		t.Errorf("expected error with zero retention")
+	}
+	delete(env, "SNAPSHOT_RETENTION_DAYS")
+	delete(env, "SNAPSHOT_CLASS")
+	if _, e := settingsFromEnv(func(key string) string { return env[key] }); e == nil {
+		t.Errorf("expected error without class")
+	}
+}
+
+func TestSnapshotAll(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	now := time.Date(2021, 2, 3, 4, 5, 6, 0, time.UTC)
+	old := &unstructured.Unstructured{}
+	old.SetAPIVersion(cluster.VolumeSnapshotGVR.GroupVersion().String())
+	old.SetKind("VolumeSnapshot")
+	old.SetNamespace("default")
+	old.SetName("old")
+	old.SetLabels(map[string]string{cluster.VolumeLabel: "redis-storage-redis-0"})
+	old.SetCreationTimestamp(metav1.NewTime(now.Add(-30 * 24 * time.Hour)))
+
+	dynamic := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{cluster.VolumeSnapshotGVR: "VolumeSnapshotList"}, old)
+	s := &cluster.Snapshotter{
+		Client:    fake.NewSimpleClientset(),
+		Dynamic:   dynamic,
+		Namespace: "default",
+		ClassName: "automutek8s-snapshot",
+	}
+
+	if e := snapshotAll(ctx, s, cluster.Volumes, 7*24*time.Hour, now); e != nil {
+		t.Fatal(e)
+	}
+	for _, volume := range cluster.Volumes {
+		snapshots, e := s.List(ctx, volume)
+		if e != nil {
+			t.Fatal(e)
+		}
+		if len(snapshots) != 1 || snapshots[0].Name == "old" {
+			t.Errorf("expected only new snapshot of %s; got %v", volume.StatefulSet, snapshots)
+		}
+	}
+}
@@ -5,6 +5,7 @@ go 1.15
 require (
 	cloud.google.com/go v0.72.0
 	cloud.google.com/go/storage v1.10.0
+	github.com/google/go-cmp v0.5.2
 	github.com/google/uuid v1.1.2
 	github.com/magefile/mage v1.11.0
 	github.com/mattn/go-pipeline v0.0.0-20190323144519-32d779b32768
@@ -14,7 +15,9 @@ require (
 	google.golang.org/grpc v1.33.2
 	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c // indirect
 	gopkg.in/yaml.v2 v2.4.0
+	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c
 	k8s.io/api v0.20.2
 	k8s.io/apimachinery v0.20.2
+	k8s.io/client-go v0.20.2
 	sigs.k8s.io/kustomize/api v0.7.2
 )
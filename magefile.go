@@ -7,17 +7,24 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
-	"path"
-	"path/filepath"
+	"strings"
+	"time"
 
 	"cloud.google.com/go/storage"
 	"github.com/magefile/mage/mg"
+	"github.com/oakcask/automutek8s/cluster"
 	"github.com/oakcask/automutek8s/tools"
-	goyaml "gopkg.in/yaml.v2"
+	"google.golang.org/api/container/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
 	kustomize "sigs.k8s.io/kustomize/api/types"
 )
 
@@ -36,30 +43,42 @@ func init() {
 type Secrets mg.Namespace
 type GKE mg.Namespace
 type GAE mg.Namespace
+type Terraform mg.Namespace
+type Cluster mg.Namespace
+type Discord mg.Namespace
+type Status mg.Namespace
+type Images mg.Namespace
+type DB mg.Namespace
+type Backup mg.Namespace
+type Volumes mg.Namespace
 
-func loadSecretManifests() ([]corev1.Secret, error) {
-	glob := path.Join("kubernetes", "base", "secrets", "*.yaml")
-	paths, e := filepath.Glob(glob)
-	if e != nil {
-		return nil, e
-	}
+var Aliases = map[string]interface{}{
+	"terraform": Terraform.Generate,
+	"status":    Status.Table,
+}
 
-	secrets := make([]corev1.Secret, 0)
+func loadSecretManifests() ([]corev1.Secret, error) {
+	return tools.LoadSecretManifests(tools.SecretManifestsDir)
+}
 
-	for _, path := range paths {
-		f, e := os.Open(path)
+// secretHandle builds handle of secret named like `tenant-alpha/discordbot`.
+// Secret without namespace belongs to the current environment.
+func secretHandle(k8sSecretName string, key string) (tools.SecretHandle, error) {
+	namespace, name := tools.ParseSecretName(k8sSecretName)
+	if namespace == "" {
+		env, e := currentEnvironment()
 		if e != nil {
-			return nil, e
+			return tools.SecretHandle{}, e
 		}
-
-		var manifest corev1.Secret
-		if e = yaml.NewYAMLOrJSONDecoder(f, 4096).Decode(&manifest); e != nil {
-			return nil, e
+		if !env.IsDefault() {
+			namespace = env.Namespace
 		}
-
-		secrets = append(secrets, manifest)
 	}
-	return secrets, nil
+	return tools.SecretHandle{
+		Namespace:    namespace,
+		MetadataName: name,
+		Key:          key,
+	}, nil
 }
 
 // Show list of secrets in manifests
@@ -69,22 +88,27 @@ func (Secrets) List(ctx context.Context) error {
 		return e
 	}
 
-	for _, secret := range secrets {
-		for _, handle := range tools.NewSecretHandles(secret) {
-			hasSecret, e := handle.Exists(ctx)
-			var value string
-			if hasSecret {
-				value = "<filtered>"
-			} else if e != nil {
-				log.Printf(e.Error())
-				value = "ERROR"
-			} else {
-				value = "(none)"
-			}
-			fmt.Printf("%v = %v\n", handle.String(), value)
+	handles := config.SecretHandles(secrets)
+	for _, env := range config.Environments {
+		for _, secret := range secrets {
+			handles = append(handles, env.NewSecretHandles(secret)...)
 		}
 	}
 
+	for _, handle := range handles {
+		hasSecret, e := handle.Exists(ctx)
+		var value string
+		if hasSecret {
+			value = "<filtered>"
+		} else if e != nil {
+			log.Printf(e.Error())
+			value = "ERROR"
+		} else {
+			value = "(none)"
+		}
+		fmt.Printf("%v = %v\n", handle.String(), value)
+	}
+
 	return nil
 }
 
@@ -96,10 +120,12 @@ func (Secrets) List(ctx context.Context) error {
 // Please note that the secret typed on tty WILL NOT be masked in this time
 // so if you want to keep it hidden, please use pipe (like `cat secret.txt |`) or
 // absolute path.
+// Prefix k8sSecretName with namespace like `tenant-alpha/discordbot` for secrets in other namespaces.
+// Without namespace, the secret of the environment named by AUTOMUTEK8S_ENV is stored.
 func (Secrets) Set(ctx context.Context, k8sSecretName string, key string, valueOrFile string) error {
-	handle := tools.SecretHandle{
-		MetadataName: k8sSecretName,
-		Key:          key,
+	handle, e := secretHandle(k8sSecretName, key)
+	if e != nil {
+		return e
 	}
 
 	payload, e := tools.ReadFromStringOrPath(valueOrFile)
@@ -112,9 +138,9 @@ func (Secrets) Set(ctx context.Context, k8sSecretName string, key string, valueO
 
 // Get the secret from cloud.
 func (Secrets) Unvail(ctx context.Context, k8sSecretName string, key string) error {
-	handle := tools.SecretHandle{
-		MetadataName: k8sSecretName,
-		Key:          key,
+	handle, e := secretHandle(k8sSecretName, key)
+	if e != nil {
+		return e
 	}
 
 	stat, e := os.Stdout.Stat()
@@ -142,7 +168,7 @@ func (Secrets) Unvail(ctx context.Context, k8sSecretName string, key string) err
 }
 
 // Generates terraform configuration
-func Terraform(ctx context.Context) error {
+func (Terraform) Generate(ctx context.Context) error {
 	projectID, e := tools.GetProjectID(ctx)
 	if e != nil {
 		return e
@@ -210,6 +236,43 @@ func Terraform(ctx context.Context) error {
 			},
 		},
 	}
+	if e = tools.AddTFVPCConnector(&tfvars, config); e != nil {
+		return e
+	}
+
+	machineTypeSpec := func(machineType string) (tools.MachineTypeSpec, error) {
+		return tools.GetMachineTypeSpec(ctx, config.Zone, machineType)
+	}
+	if e = tools.ValidateNodePools(config.NodePools(), config.Autoscaling(), machineTypeSpec); e != nil {
+		return e
+	}
+	tools.AddTFNodePools(&tfvars, config)
+	tools.AddTFOutputs(&tfvars)
+	tools.AddTFGateIAM(&tfvars, config)
+	tools.AddTFSecretSync(&tfvars, config)
+	if e = tools.AddTFEnvironments(&tfvars, config); e != nil {
+		return e
+	}
+	if e = tools.AddTFTenants(&tfvars, config); e != nil {
+		return e
+	}
+	if e = tools.AddTFBackup(&tfvars, config); e != nil {
+		return e
+	}
+	if e = tools.AddTFBackends(ctx, &tfvars, config); e != nil {
+		return e
+	}
+
+	if config.Budget != nil {
+		billingAccount, e := tools.GetProjectBillingAccount(ctx)
+		if e != nil {
+			return e
+		}
+		if e = tools.AddTFBudget(&tfvars, config, billingAccount); e != nil {
+			return e
+		}
+	}
+
 	b, e := json.MarshalIndent(tfvars, "", "  ")
 	if e != nil {
 		return e
@@ -225,51 +288,114 @@ func Terraform(ctx context.Context) error {
 	return nil
 }
 
-// Generate kustomization.yaml from template
-func Kustomization(ctx context.Context) error {
-	yamlfile, e := os.Open("kustomization.yaml.template")
+// Import existing resources into terraform state.
+//
+// Parameter mode accepts "print" or "run".
+// The task discovers resources named as terraform configuration does,
+// and prints `terraform import` commands for ones not in the state yet
+// or, in "run" mode, invokes them.
+func (Terraform) Adopt(ctx context.Context, mode string) error {
+	if mode != "print" && mode != "run" {
+		return fmt.Errorf("mode should be print or run: %s", mode)
+	}
+
+	projectID, e := tools.GetProjectID(ctx)
 	if e != nil {
 		return e
 	}
-	templatedYamlFile, e := tools.ApplyTextTemplate(yamlfile, config)
+	imports, e := tools.DiscoverTFImports(ctx, config, projectID)
 	if e != nil {
 		return e
 	}
 
-	var kustomization kustomize.Kustomization
-	if e = yaml.NewYAMLOrJSONDecoder(templatedYamlFile, 4096).Decode(&kustomization); e != nil {
+	state, e := tools.ListTFState(tools.RunCommand)
+	if e != nil {
 		return e
 	}
 
-	secrets, e := loadSecretManifests()
+	for _, imp := range imports {
+		if state[imp.Address] {
+			log.Printf("already managed: %s", imp.Address)
+			continue
+		}
+
+		if mode == "print" {
+			fmt.Println(imp.String())
+			continue
+		}
+
+		log.Printf("importing %s", imp.Address)
+		if e = imp.Run(tools.RunCommand, os.Stdout); e != nil {
+			return e
+		}
+	}
+
+	return nil
+}
+
+// currentEnvironment returns environment in config.yaml named by AUTOMUTEK8S_ENV.
+// The stack in default namespace is operated without AUTOMUTEK8S_ENV.
+func currentEnvironment() (tools.EnvironmentConfig, error) {
+	return config.Environment(os.Getenv("AUTOMUTEK8S_ENV"))
+}
+
+// writeOverlay writes overlay of env under kubernetes/overlays.
+func writeOverlay(ctx context.Context, env tools.EnvironmentConfig) error {
+	overlay, e := tools.NewKustomizationRenderer(config, env).Overlay(ctx)
 	if e != nil {
 		return e
 	}
+	return tools.WriteOverlay(env.OverlayPath(), overlay)
+}
 
-	for _, secret := range secrets {
-		var literalSources []string
+// renderKustomization renders kustomization.yaml of the current environment
+// with secrets unvailed from Secret Manager, and overlays it refers to.
+// Nothing is written to disk.
+func renderKustomization(ctx context.Context) (kustomize.Kustomization, map[string]kustomize.Kustomization, error) {
+	env, e := currentEnvironment()
+	if e != nil {
+		return kustomize.Kustomization{}, nil, e
+	}
+	renderer := tools.NewKustomizationRenderer(config, env)
+	overlays, e := renderer.Overlays(ctx)
+	if e != nil {
+		return kustomize.Kustomization{}, nil, e
+	}
+	kustomization, e := renderer.Render(ctx)
+	return kustomization, overlays, e
+}
 
-		for _, handle := range tools.NewSecretHandles(secret) {
-			payload, e := handle.Unvail(ctx)
-			if e != nil {
-				return e
-			}
+// Generate kustomization.yaml from template for `kustomize build`,
+// and overlays of environments and tenants under kubernetes/overlays and kubernetes/tenants.
+//
+// Secrets are written into kustomization.yaml in plaintext, so the task refuses
+// to run unless git ignores it. `mage deploy` never writes secrets to disk.
+// Set AUTOMUTEK8S_ENV to render kustomization.yaml of the environment.
+func Kustomization(ctx context.Context) error {
+	ignored, e := tools.IsGitIgnored("kustomization.yaml")
+	if e != nil {
+		return e
+	}
+	if !ignored {
+		return fmt.Errorf("kustomization.yaml is not ignored by git; add it to .gitignore not to commit secrets")
+	}
 
-			literalSources = append(literalSources, fmt.Sprintf("%s=%s", handle.Key, string(payload)))
+	for _, env := range config.Environments {
+		if e = env.Validate(); e != nil {
+			return e
 		}
-
-		secretArgs := kustomize.SecretArgs{
-			GeneratorArgs: kustomize.GeneratorArgs{
-				Name:     secret.Name,
-				Behavior: "create",
-				KvPairSources: kustomize.KvPairSources{
-					LiteralSources: literalSources,
-				},
-			},
+		if e = writeOverlay(ctx, env); e != nil {
+			return e
 		}
-		kustomization.SecretGenerator = append(kustomization.SecretGenerator, secretArgs)
-		kustomization.GeneratorOptions = &kustomize.GeneratorOptions{
-			DisableNameSuffixHash: false,
+	}
+
+	kustomization, overlays, e := renderKustomization(ctx)
+	if e != nil {
+		return e
+	}
+	for path, overlay := range overlays {
+		if e = tools.WriteOverlay(path, overlay); e != nil {
+			return e
 		}
 	}
 
@@ -279,10 +405,717 @@ func Kustomization(ctx context.Context) error {
 	}
 	defer out.Close()
 
-	return goyaml.NewEncoder(out).Encode(kustomization)
+	return tools.WriteKustomization(out, kustomization)
+}
+
+func planDeploy(ctx context.Context) (*cluster.Applier, []cluster.Change, error) {
+	env, e := currentEnvironment()
+	if e != nil {
+		return nil, nil, e
+	}
+	objs, e := tools.NewKustomizationRenderer(config, env).Build(ctx, ".")
+	if e != nil {
+		return nil, nil, e
+	}
+	if !env.IsDefault() {
+		objs = append([]*unstructured.Unstructured{env.NamespaceObject()}, objs...)
+	} else {
+		for _, tenant := range config.Tenants {
+			objs = append([]*unstructured.Unstructured{tenant.NamespaceObject()}, objs...)
+		}
+	}
+
+	c, e := currentCluster(ctx)
+	if e != nil {
+		return nil, nil, e
+	}
+	service, e := container.NewService(ctx)
+	if e != nil {
+		return nil, nil, e
+	}
+	restConfig, e := cluster.NewRESTConfig(ctx, service, c)
+	if e != nil {
+		return nil, nil, e
+	}
+	applier, e := cluster.NewApplier(restConfig, env.Namespace)
+	if e != nil {
+		return nil, nil, e
+	}
+	applier.Inventory = env.Inventory()
+
+	changes, e := applier.Plan(ctx, objs)
+	if e != nil {
+		return nil, nil, e
+	}
+	return applier, changes, nil
+}
+
+// Show what deploy will change in the cluster
+func Diff(ctx context.Context) error {
+	_, changes, e := planDeploy(ctx)
+	if e != nil {
+		return e
+	}
+	return cluster.WriteChanges(os.Stdout, changes)
+}
+
+// Check manifests in kubernetes/base for inconsistencies
+func Lint() error {
+	problems, e := tools.LintManifests("kubernetes/base")
+	if e != nil {
+		return e
+	}
+	for _, problem := range problems {
+		fmt.Printf("kubernetes/base/%s\n", problem.String())
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%d problems found in manifests", len(problems))
+	}
+	return nil
+}
+
+// Build kustomization and apply it to the cluster, pruning resources removed from manifests
+func Deploy(ctx context.Context) error {
+	applier, changes, e := planDeploy(ctx)
+	if e != nil {
+		return e
+	}
+	if e = cluster.WriteChanges(os.Stdout, changes); e != nil {
+		return e
+	}
+
+	pending := false
+	for _, change := range changes {
+		if change.Action != cluster.ActionUnchanged {
+			pending = true
+		}
+	}
+	if !pending {
+		log.Printf("nothing to deploy")
+		return nil
+	}
+
+	fmt.Print("Apply these changes? [y/N] ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	if answer = strings.TrimSpace(answer); answer != "y" && answer != "yes" {
+		return fmt.Errorf("deploy is cancelled")
+	}
+
+	return applier.Apply(ctx, changes)
+}
+
+// Render app.yaml for the gate, reverse proxy of galactus on App Engine
+func (GAE) Generate(ctx context.Context) error {
+	projectID, e := tools.GetProjectID(ctx)
+	if e != nil {
+		return e
+	}
+
+	galactusAddr, e := config.GateGalactusAddr()
+	if e != nil {
+		return e
+	}
+
+	out, e := os.OpenFile("app.yaml", os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if e != nil {
+		return e
+	}
+	defer out.Close()
+
+	if e = tools.RenderGateAppYaml(out, config, projectID, galactusAddr); e != nil {
+		return e
+	}
+
+	if config.Discord == nil {
+		return nil
+	}
+	discordOut, e := os.OpenFile(tools.DiscordAppYaml, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if e != nil {
+		return e
+	}
+	defer discordOut.Close()
+
+	return tools.RenderDiscordAppYaml(discordOut, config, projectID)
+}
+
+// Upload the gate (and the slash command service if configured) to App Engine
+func (GAE) Deploy(ctx context.Context) error {
+	mg.CtxDeps(ctx, GAE.Generate)
+
+	appYamls := []string{"app.yaml"}
+	if config.Discord != nil {
+		appYamls = append(appYamls, tools.DiscordAppYaml)
+	}
+	if e := tools.DeployGAEApp(os.Stdout, appYamls...); e != nil {
+		return e
+	}
+
+	projectID, e := tools.GetProjectID(ctx)
+	if e != nil {
+		return e
+	}
+	regionID, e := tools.GetGAERegionID(tools.RunCommand)
+	if e != nil {
+		return e
+	}
+	log.Printf("the gate is available at %s", config.GateURL(projectID, regionID))
+
+	return nil
+}
+
+func currentCluster(ctx context.Context) (cluster.Cluster, error) {
+	projectID, e := tools.GetProjectID(ctx)
+	if e != nil {
+		return cluster.Cluster{}, e
+	}
+	clusterName, clusterLocation := config.ClusterNameAndLocation()
+	return cluster.Cluster{
+		ProjectID: projectID,
+		Location:  clusterLocation,
+		Name:      clusterName,
+	}, nil
+}
+
+// newScaler builds Scaler of the current environment,
+// or of the tenant named by AUTOMUTEK8S_TENANT.
+func newScaler(ctx context.Context) (*cluster.Scaler, error) {
+	env, e := currentEnvironment()
+	if e != nil {
+		return nil, e
+	}
+	c, e := currentCluster(ctx)
+	if e != nil {
+		return nil, e
+	}
+
+	service, e := container.NewService(ctx)
+	if e != nil {
+		return nil, e
+	}
+	client, e := cluster.NewKubernetesClient(ctx, service, c)
+	if e != nil {
+		return nil, e
+	}
+
+	pool := config.NodePools()[0]
+	nodeCount := int64(pool.MinNodes)
+	if nodeCount < 1 {
+		nodeCount = 1
+	}
+
+	scaler := &cluster.Scaler{
+		NodePool: cluster.GKENodePool{
+			Service: service,
+			Cluster: c,
+			Name:    pool.Name,
+		},
+		NodeCount:  nodeCount,
+		Namespace:  env.Namespace,
+		NamePrefix: env.NamePrefix,
+		Client:     client,
+	}
+	if len(config.Environments) > 0 {
+		// the node pool is shared with other environments;
+		// cluster autoscaler removes nodes left idle instead.
+		scaler.NodePool = nil
+	}
+	scaler.KeepPostgres = config.KeepsPostgres(env)
+
+	if name := os.Getenv("AUTOMUTEK8S_TENANT"); name != "" {
+		if !env.IsDefault() {
+			return nil, fmt.Errorf("AUTOMUTEK8S_TENANT cannot be set with AUTOMUTEK8S_ENV")
+		}
+		tenant, e := config.Tenant(name)
+		if e != nil {
+			return nil, e
+		}
+		// the node pool and postgres are shared with the default stack
+		scaler.Namespace = tenant.Namespace
+		scaler.NodePool = nil
+		scaler.KeepPostgres = false
+	}
+	return scaler, nil
+}
+
+func collectStatus(ctx context.Context) (tools.StackStatus, error) {
+	env, e := currentEnvironment()
+	if e != nil {
+		return tools.StackStatus{}, e
+	}
+	secrets, e := loadSecretManifests()
+	if e != nil {
+		return tools.StackStatus{}, e
+	}
+	handles := make([]tools.SecretHandle, 0)
+	if env.IsDefault() {
+		handles = config.SecretHandles(secrets)
+	} else {
+		for _, secret := range secrets {
+			handles = append(handles, env.NewSecretHandles(secret)...)
+		}
+	}
+
+	return tools.CollectStackStatus(ctx, config, env, handles)
+}
+
+// Show health of the whole stack as a table
+func (Status) Table(ctx context.Context) error {
+	status, e := collectStatus(ctx)
+	if e != nil {
+		return e
+	}
+	if e = status.WriteTable(os.Stdout); e != nil {
+		return e
+	}
+	if !status.Healthy() {
+		return fmt.Errorf("the stack is not healthy")
+	}
+	return nil
+}
+
+// Show health of the whole stack as JSON
+func (Status) JSON(ctx context.Context) error {
+	status, e := collectStatus(ctx)
+	if e != nil {
+		return e
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if e = encoder.Encode(status); e != nil {
+		return e
+	}
+	if !status.Healthy() {
+		return fmt.Errorf("the stack is not healthy")
+	}
+	return nil
+}
+
+// Scale workloads and node pool to zero to save money
+func (Cluster) Stop(ctx context.Context) error {
+	scaler, e := newScaler(ctx)
+	if e != nil {
+		return e
+	}
+	return scaler.Stop(ctx)
+}
+
+// Restore node pool and workloads stopped by cluster:stop
+func (Cluster) Start(ctx context.Context) error {
+	scaler, e := newScaler(ctx)
+	if e != nil {
+		return e
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Minute)
+	defer cancel()
+	return scaler.Start(ctx)
+}
+
+// Add /automute slash command to the Discord application
+func (Discord) Register(ctx context.Context) error {
+	if config.Discord == nil {
+		return fmt.Errorf("discord block is not in config.yaml")
+	}
+
+	token, e := tools.DiscordBotToken.Unvail(ctx)
+	if e != nil {
+		return e
+	}
+
+	return tools.RegisterDiscordCommands(ctx, http.DefaultClient, cluster.DiscordAPIBase, config.Discord.ApplicationID, strings.TrimSpace(string(token)))
+}
+
+// kustomizations having images to be pinned.
+var imageKustomizations = []string{tools.BaseKustomizationPath, tools.BackupKustomizationPath}
+
+// Resolve tags of images in kustomization.yaml of kubernetes/base and its components to digests and pin them
+func (Images) Pin(ctx context.Context) error {
+	client := tools.NewRegistryClient(http.DefaultClient)
+	for _, path := range imageKustomizations {
+		content, e := ioutil.ReadFile(path)
+		if e != nil {
+			return e
+		}
+
+		content, pinned, e := tools.PinImages(ctx, client, content)
+		if e != nil {
+			return e
+		}
+		for _, image := range pinned {
+			log.Printf("pinned %s", image.String())
+		}
+
+		if e = ioutil.WriteFile(path, content, 0644); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// List images in kustomization.yaml of kubernetes/base and its components having newer tags or moved since pinned
+func (Images) Outdated(ctx context.Context) error {
+	client := tools.NewRegistryClient(http.DefaultClient)
+	for _, path := range imageKustomizations {
+		content, e := ioutil.ReadFile(path)
+		if e != nil {
+			return e
+		}
+
+		outdated, e := tools.OutdatedImages(ctx, client, content)
+		if e != nil {
+			return e
+		}
+		for _, image := range outdated {
+			fmt.Println(image.String())
+		}
+	}
+	return nil
 }
 
 // Setup credentials to kubectl
 func (GKE) GetCredentials(ctx context.Context) error {
-	return tools.GetGKECredentials(os.Stdout, config.Cluster.Name, config.Cluster.Location)
+	clusterName, clusterLocation := config.ClusterNameAndLocation()
+	return tools.GetGKECredentials(os.Stdout, clusterName, clusterLocation)
+}
+
+// postgresExec runs commands in postgres pod of the current environment.
+func postgresExec(ctx context.Context) (tools.PodExec, error) {
+	if config.DatabaseMode() != tools.BackendInCluster {
+		return nil, fmt.Errorf("postgres is replaced by %s; use backups of the managed instance instead", config.DatabaseMode())
+	}
+	env, e := currentEnvironment()
+	if e != nil {
+		return nil, e
+	}
+	c, e := currentCluster(ctx)
+	if e != nil {
+		return nil, e
+	}
+	service, e := container.NewService(ctx)
+	if e != nil {
+		return nil, e
+	}
+	restConfig, e := cluster.NewRESTConfig(ctx, service, c)
+	if e != nil {
+		return nil, e
+	}
+
+	executor := cluster.PodExecutor{
+		RESTConfig: restConfig,
+		Namespace:  env.Namespace,
+		Pod:        env.NamePrefix + "postgres-0",
+		Container:  "postgres",
+	}
+	return func(ctx context.Context, command []string, stdin io.Reader, stdout io.Writer) error {
+		return executor.Exec(ctx, command, stdin, stdout, os.Stderr)
+	}, nil
+}
+
+// withBackupBucket calls f with the bucket for backups;
+// one is created unless backup.bucket is managed by terraform.
+func withBackupBucket(ctx context.Context, f func(bucket *storage.BucketHandle) error) error {
+	client, e := storage.NewClient(ctx)
+	if e != nil {
+		return e
+	}
+	defer client.Close()
+
+	name := config.BackupBucket()
+	if name == "" {
+		if name, e = tools.CreateOrGetBackupBucket(ctx, client, config.Region); e != nil {
+			return e
+		}
+	}
+	return f(client.Bucket(name))
+}
+
+// Dump postgres into Cloud Storage, keeping the newest backup.keep backups
+func (DB) Backup(ctx context.Context) error {
+	exec, e := postgresExec(ctx)
+	if e != nil {
+		return e
+	}
+
+	env, e := currentEnvironment()
+	if e != nil {
+		return e
+	}
+
+	return withBackupBucket(ctx, func(bucket *storage.BucketHandle) error {
+		backup, e := tools.BackupPostgres(ctx, exec, bucket, env.Namespace, time.Now())
+		if e != nil {
+			return e
+		}
+		log.Printf("backed up: %s", backup.String())
+
+		pruned, e := tools.PruneBackups(ctx, bucket, env.Namespace, config.BackupKeep())
+		if e != nil {
+			return e
+		}
+		for _, backup := range pruned {
+			log.Printf("deleted: %s", backup.String())
+		}
+		return nil
+	})
+}
+
+// postgresClients returns scalers of workloads connected to postgres of the current environment,
+// including ones of tenants sharing it.
+func postgresClients(ctx context.Context) ([]*cluster.Scaler, error) {
+	if os.Getenv("AUTOMUTEK8S_TENANT") != "" {
+		return nil, fmt.Errorf("postgres is owned by the default stack; unset AUTOMUTEK8S_TENANT")
+	}
+	env, e := currentEnvironment()
+	if e != nil {
+		return nil, e
+	}
+	scaler, e := newScaler(ctx)
+	if e != nil {
+		return nil, e
+	}
+	scaler.NodePool = nil
+
+	scalers := []*cluster.Scaler{scaler}
+	if config.KeepsPostgres(env) {
+		for _, tenant := range config.Tenants {
+			tenantScaler := *scaler
+			tenantScaler.Namespace = tenant.Namespace
+			tenantScaler.KeepPostgres = false
+			scalers = append(scalers, &tenantScaler)
+		}
+	}
+	return scalers, nil
+}
+
+// Show backups of postgres, newest first
+func (DB) List(ctx context.Context) error {
+	env, e := currentEnvironment()
+	if e != nil {
+		return e
+	}
+
+	return withBackupBucket(ctx, func(bucket *storage.BucketHandle) error {
+		backups, e := tools.ListBackups(ctx, bucket, env.Namespace)
+		if e != nil {
+			return e
+		}
+		for _, backup := range backups {
+			fmt.Println(backup.String())
+		}
+		return nil
+	})
+}
+
+// Load the backup into postgres; name is one listed by db:list, or `latest`
+func (DB) Restore(ctx context.Context, name string) error {
+	exec, e := postgresExec(ctx)
+	if e != nil {
+		return e
+	}
+	env, e := currentEnvironment()
+	if e != nil {
+		return e
+	}
+	clients, e := postgresClients(ctx)
+	if e != nil {
+		return e
+	}
+
+	return withBackupBucket(ctx, func(bucket *storage.BucketHandle) error {
+		backups, e := tools.ListBackups(ctx, bucket, env.Namespace)
+		if e != nil {
+			return e
+		}
+		backup, e := tools.FindBackup(backups, name)
+		if e != nil {
+			return e
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, 20*time.Minute)
+		defer cancel()
+		// automuteus and galactus would see tables dropped by pg_restore --clean
+		for _, scaler := range clients {
+			if e := scaler.StopClients(ctx); e != nil {
+				return e
+			}
+		}
+		log.Printf("restoring from %s", backup.String())
+		if e := tools.RestorePostgres(ctx, exec, bucket, backup); e != nil {
+			return e
+		}
+		for _, scaler := range clients {
+			if e := scaler.Start(ctx); e != nil {
+				return e
+			}
+		}
+		return nil
+	})
+}
+
+// Apply POSTGRES_PASSWORD of postgres secret to the user of Cloud SQL, run after `terraform apply`
+func (DB) SetPassword(ctx context.Context) error {
+	if config.DatabaseMode() != tools.DatabaseCloudSQL {
+		return fmt.Errorf("database.mode is not %s", tools.DatabaseCloudSQL)
+	}
+	return tools.SetCloudSQLPassword(ctx)
+}
+
+// Show the last successful run of the backup CronJob and the newest backups
+func (Backup) Status(ctx context.Context) error {
+	env, e := currentEnvironment()
+	if e != nil {
+		return e
+	}
+	c, e := currentCluster(ctx)
+	if e != nil {
+		return e
+	}
+	service, e := container.NewService(ctx)
+	if e != nil {
+		return e
+	}
+	client, e := cluster.NewKubernetesClient(ctx, service, c)
+	if e != nil {
+		return e
+	}
+
+	status, e := tools.GetBackupJobStatus(ctx, client, env.Namespace)
+	if e != nil {
+		return e
+	}
+	fmt.Print(status.String())
+
+	return withBackupBucket(ctx, func(bucket *storage.BucketHandle) error {
+		backups, e := tools.ListBackups(ctx, bucket, env.Namespace)
+		if e != nil {
+			return e
+		}
+		if len(backups) > 3 {
+			backups = backups[:3]
+		}
+		for _, backup := range backups {
+			fmt.Println(backup.String())
+		}
+		return nil
+	})
+}
+
+// newSnapshotter returns Snapshotter of volumes of the current environment.
+func newSnapshotter(ctx context.Context) (*cluster.Snapshotter, error) {
+	env, e := currentEnvironment()
+	if e != nil {
+		return nil, e
+	}
+	c, e := currentCluster(ctx)
+	if e != nil {
+		return nil, e
+	}
+	service, e := container.NewService(ctx)
+	if e != nil {
+		return nil, e
+	}
+	restConfig, e := cluster.NewRESTConfig(ctx, service, c)
+	if e != nil {
+		return nil, e
+	}
+	client, e := kubernetes.NewForConfig(restConfig)
+	if e != nil {
+		return nil, e
+	}
+	dynamicClient, e := dynamic.NewForConfig(restConfig)
+	if e != nil {
+		return nil, e
+	}
+
+	return &cluster.Snapshotter{
+		Client:     client,
+		Dynamic:    dynamicClient,
+		Namespace:  env.Namespace,
+		NamePrefix: env.NamePrefix,
+		ClassName:  tools.SnapshotClassName,
+	}, nil
+}
+
+// findInClusterVolume returns volume of the StatefulSet unless it is replaced by managed backend.
+func findInClusterVolume(name string) (cluster.Volume, error) {
+	volume, e := cluster.FindVolume(name)
+	if e != nil {
+		return volume, e
+	}
+	for _, v := range config.InClusterVolumes() {
+		if v == volume {
+			return volume, nil
+		}
+	}
+	return volume, fmt.Errorf("%s is replaced by managed backend and has no volume", name)
+}
+
+// Take VolumeSnapshot of persistent disk of the StatefulSet; name is postgres or redis
+func (Volumes) Snapshot(ctx context.Context, name string) error {
+	volume, e := findInClusterVolume(name)
+	if e != nil {
+		return e
+	}
+	s, e := newSnapshotter(ctx)
+	if e != nil {
+		return e
+	}
+
+	snapshot, e := s.Take(ctx, volume, time.Now())
+	if e != nil {
+		return e
+	}
+	log.Printf("snapshot %s is being taken; it can be restored once volumes:list shows it ready", snapshot.Name)
+	return nil
+}
+
+// Show VolumeSnapshots of postgres and redis, newest first
+func (Volumes) List(ctx context.Context) error {
+	s, e := newSnapshotter(ctx)
+	if e != nil {
+		return e
+	}
+
+	for _, volume := range config.InClusterVolumes() {
+		snapshots, e := s.List(ctx, volume)
+		if e != nil {
+			return e
+		}
+		for _, snapshot := range snapshots {
+			fmt.Println(snapshot.String())
+		}
+	}
+	return nil
+}
+
+// Stop the stack and replace volume of the StatefulSet with one made from the snapshot listed by volumes:list
+func (Volumes) Restore(ctx context.Context, name string, snapshot string) error {
+	volume, e := findInClusterVolume(name)
+	if e != nil {
+		return e
+	}
+	s, e := newSnapshotter(ctx)
+	if e != nil {
+		return e
+	}
+	scaler, e := newScaler(ctx)
+	if e != nil {
+		return e
+	}
+	// keep nodes so that the stack starts again without waiting for them
+	scaler.NodePool = nil
+	if volume.StatefulSet == cluster.SharedPostgres.Name {
+		// postgres should be stopped to replace its volume even if tenants share it
+		scaler.KeepPostgres = false
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Minute)
+	defer cancel()
+	if e := scaler.Stop(ctx); e != nil {
+		return e
+	}
+	if e := s.Restore(ctx, volume, snapshot); e != nil {
+		return fmt.Errorf("failed to restore %s; the stack is left stopped, run cluster:start once the volume is fixed: %v", name, e)
+	}
+	return scaler.Start(ctx)
 }
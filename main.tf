@@ -1,13 +1,18 @@
+# Billing Budget API requires quota project with user credentials of `gcloud auth application-default login`.
 provider "google" {
   project = var.gcloud_project
   region = var.region
   zone = var.zone
+  billing_project = var.gcloud_project
+  user_project_override = true
 }
 
 provider "google-beta" {
   project = var.gcloud_project
   region = var.region
   zone = var.zone
+  billing_project = var.gcloud_project
+  user_project_override = true
 }
 
 variable "project_services" {
@@ -136,6 +141,15 @@ resource "google_container_cluster" "primary" {
   network = google_compute_network.primary-vpc.self_link
   subnetwork = google_compute_subnetwork.primary-vpc-subnet.self_link
 
+  # node pools are generated into auto.tf.json by `mage terraform`
+  remove_default_node_pool = true
+  initial_node_count = 1
+
+  # these force replacement of the cluster provisioned with the former inline node pool
+  lifecycle {
+    ignore_changes = [remove_default_node_pool, initial_node_count, node_pool, node_config]
+  }
+
   logging_service = "none"
   monitoring_service = "none"
 
@@ -156,6 +170,18 @@ resource "google_container_cluster" "primary" {
     horizontal_pod_autoscaling {
       disabled = true
     }
+    # provisions standard-rwo volumes of postgres and redis, which can be snapshotted
+    gce_persistent_disk_csi_driver_config {
+      enabled = true
+    }
+  }
+
+  # workload identity is enabled by `mage terraform` when secret_sync is configured
+  dynamic "workload_identity_config" {
+    for_each = var.workload_identity ? [1] : []
+    content {
+      workload_pool = format("%s.svc.id.goog", var.gcloud_project)
+    }
   }
 
   ip_allocation_policy {
@@ -166,50 +192,14 @@ resource "google_container_cluster" "primary" {
   cluster_autoscaling {
     enabled = true
     resource_limits {
-      maximum = 8
-      minimum = 0
+      maximum = var.cluster_autoscaling_cpu_max
+      minimum = var.cluster_autoscaling_cpu_min
       resource_type = "cpu"
     }
     resource_limits {
-      maximum = 4
-      minimum = 0
+      maximum = var.cluster_autoscaling_memory_max
+      minimum = var.cluster_autoscaling_memory_min
       resource_type = "memory"
     }
   }
-
-  node_pool {
-    initial_node_count = 1
-    name = "primary-pool"
-    node_locations = [ var.cluster_location ]
-    
-    autoscaling {
-      max_node_count = 4
-      min_node_count = 0
-    }
-
-    management {
-      auto_repair = true
-      auto_upgrade = true
-    }
-
-    node_config {
-      preemptible  = true
-      machine_type = "e2-micro"
-      disk_size_gb = 10
-
-      metadata = {
-        disable-legacy-endpoints = "true"
-      }
-
-      service_account = google_service_account.node.email
-      oauth_scopes    = [
-        "https://www.googleapis.com/auth/cloud-platform"
-      ]
-
-      shielded_instance_config {
-        enable_integrity_monitoring = true
-        enable_secure_boot = true
-      }
-    }
-  }
 }
@@ -0,0 +1,173 @@
+package tools
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/container/v1"
+	"google.golang.org/api/iam/v1"
+	"google.golang.org/api/option"
+)
+
+// NodeServiceAccountID is account ID of the service account
+// for cluster nodes, declared in main.tf.
+const NodeServiceAccountID = "automutek8s-node"
+
+// TFImport is pair of terraform resource address and
+// ID of existing cloud resource to be imported into the address.
+type TFImport struct {
+	Address string
+	ID      string
+}
+
+// Args returns command line arguments to import the resource.
+func (imp TFImport) Args() []string {
+	return []string{"terraform", "import", imp.Address, imp.ID}
+}
+
+func (imp TFImport) String() string {
+	return fmt.Sprintf("terraform import %s %s", imp.Address, imp.ID)
+}
+
+// CommandRunner runs command of args, writing its standard output to out.
+type CommandRunner func(args []string, out io.Writer) error
+
+// RunCommand is CommandRunner invoking the command,
+// whose standard error is reported along with its failure.
+func RunCommand(args []string, out io.Writer) error {
+	var stderr bytes.Buffer
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = out
+	cmd.Stderr = &stderr
+	if e := cmd.Run(); e != nil {
+		return fmt.Errorf("%v: %s", e, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return nil
+}
+
+// Run invokes `terraform import` with run and copies its output to out.
+func (imp TFImport) Run(run CommandRunner, out io.Writer) error {
+	return run(imp.Args(), out)
+}
+
+// ListTFState returns set of resource addresses recorded in terraform state,
+// invoking `terraform state list` with run.
+func ListTFState(run CommandRunner) (map[string]bool, error) {
+	var out bytes.Buffer
+	if e := run([]string{"terraform", "state", "list"}, &out); e != nil {
+		return nil, fmt.Errorf("failed to invoke terraform command: %v", e.Error())
+	}
+
+	addresses := map[string]bool{}
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			addresses[line] = true
+		}
+	}
+	return addresses, scanner.Err()
+}
+
+// DiscoverTFImports finds existing resources in the project named after the naming scheme
+// of main.tf and auto.tf.json, and returns imports for them.
+// opts are passed to clients of Google APIs.
+func DiscoverTFImports(ctx context.Context, config Config, projectID string, opts ...option.ClientOption) ([]TFImport, error) {
+	imports := make([]TFImport, 0)
+	found := func(address string, id string) {
+		log.Printf("found %s: %s", address, id)
+		imports = append(imports, TFImport{Address: address, ID: id})
+	}
+
+	computeService, e := compute.NewService(ctx, opts...)
+	if e != nil {
+		return nil, e
+	}
+
+	clusterName := config.Cluster.Name
+	region := config.Region
+
+	networkName := fmt.Sprintf("%s-vpc", clusterName)
+	if _, e = computeService.Networks.Get(projectID, networkName).Do(); e == nil {
+		found("google_compute_network.primary-vpc", fmt.Sprintf("projects/%s/global/networks/%s", projectID, networkName))
+	} else if !IsGoogleAPINotFound(e) {
+		return nil, e
+	}
+
+	subnetName := fmt.Sprintf("%s-vpc-subnet", clusterName)
+	if _, e = computeService.Subnetworks.Get(projectID, region, subnetName).Do(); e == nil {
+		found("google_compute_subnetwork.primary-vpc-subnet", fmt.Sprintf("projects/%s/regions/%s/subnetworks/%s", projectID, region, subnetName))
+	} else if !IsGoogleAPINotFound(e) {
+		return nil, e
+	}
+
+	addresses := []TFImport{
+		{Address: "google_compute_address.primary-vpc-nat", ID: fmt.Sprintf("%s-vpc-nat-ip", clusterName)},
+		{Address: "google_compute_address.primary-vpc-ingress", ID: config.Network.IngressIPResourceID},
+	}
+	for _, address := range addresses {
+		if _, e = computeService.Addresses.Get(projectID, region, address.ID).Do(); e == nil {
+			found(address.Address, fmt.Sprintf("projects/%s/regions/%s/addresses/%s", projectID, region, address.ID))
+		} else if !IsGoogleAPINotFound(e) {
+			return nil, e
+		}
+	}
+
+	routerName := fmt.Sprintf("%s-vpc-router", clusterName)
+	natName := fmt.Sprintf("%s-vpc-nat", clusterName)
+	if router, e := computeService.Routers.Get(projectID, region, routerName).Do(); e == nil {
+		found("google_compute_router.primary-vpc-router", fmt.Sprintf("projects/%s/regions/%s/routers/%s", projectID, region, routerName))
+		for _, nat := range router.Nats {
+			if nat.Name == natName {
+				found("google_compute_router_nat.primary-vpc-nat", fmt.Sprintf("%s/%s/%s/%s", projectID, region, routerName, natName))
+			}
+		}
+	} else if !IsGoogleAPINotFound(e) {
+		return nil, e
+	}
+
+	iamService, e := iam.NewService(ctx, opts...)
+	if e != nil {
+		return nil, e
+	}
+
+	serviceAccountPath := fmt.Sprintf("projects/%s/serviceAccounts/%s@%s.iam.gserviceaccount.com", projectID, NodeServiceAccountID, projectID)
+	if _, e = iamService.Projects.ServiceAccounts.Get(serviceAccountPath).Do(); e == nil {
+		found("google_service_account.node", serviceAccountPath)
+	} else if !IsGoogleAPINotFound(e) {
+		return nil, e
+	}
+
+	containerService, e := container.NewService(ctx, opts...)
+	if e != nil {
+		return nil, e
+	}
+
+	clusterPath := fmt.Sprintf("projects/%s/locations/%s/clusters/%s", projectID, config.Cluster.Location, clusterName)
+	if _, e = containerService.Projects.Locations.Clusters.Get(clusterPath).Do(); e == nil {
+		found("google_container_cluster.primary", clusterPath)
+
+		pools, e := containerService.Projects.Locations.Clusters.NodePools.List(clusterPath).Do()
+		if e != nil {
+			return nil, e
+		}
+		existingPools := map[string]bool{}
+		for _, pool := range pools.NodePools {
+			existingPools[pool.Name] = true
+		}
+		for _, pool := range config.NodePools() {
+			if existingPools[pool.Name] {
+				found(fmt.Sprintf("google_container_node_pool.%s", pool.Name), fmt.Sprintf("%s/%s/%s/%s", projectID, config.Cluster.Location, clusterName, pool.Name))
+			}
+		}
+	} else if !IsGoogleAPINotFound(e) {
+		return nil, e
+	}
+
+	return imports, nil
+}
@@ -0,0 +1,228 @@
+package tools
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"google.golang.org/api/option"
+)
+
+// fakeGoogleAPIs serves responses keyed by host and path of requests,
+// and 404 for others.
+type fakeGoogleAPIs map[string]fakeGoogleAPIResponse
+
+type fakeGoogleAPIResponse struct {
+	status int
+	body   string
+}
+
+func (fake fakeGoogleAPIs) RoundTrip(r *http.Request) (*http.Response, error) {
+	res, ok := fake[r.URL.Host+r.URL.Path]
+	if !ok {
+		res = fakeGoogleAPIResponse{status: http.StatusNotFound, body: `{"error":{"code":404,"message":"not found"}}`}
+	}
+	if res.status == 0 {
+		res.status = http.StatusOK
+	}
+	return &http.Response{
+		StatusCode: res.status,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       ioutil.NopCloser(strings.NewReader(res.body)),
+		Request:    r,
+	}, nil
+}
+
+func TestDiscoverTFImports(t *testing.T) {
+	t.Parallel()
+
+	config := Config{
+		Region:  "asia-northeast1",
+		Cluster: ClusterConfig{Name: "au-cluster", Location: "asia-northeast1-b"},
+		Network: NetworkConfig{IngressIPResourceID: "ingress-ip"},
+	}
+	const (
+		compute   = "compute.googleapis.com/compute/v1/projects/project"
+		container = "container.googleapis.com/v1/projects/project/locations/asia-northeast1-b/clusters/au-cluster"
+		node      = "iam.googleapis.com/v1/projects/project/serviceAccounts/automutek8s-node@project.iam.gserviceaccount.com"
+	)
+	ok := fakeGoogleAPIResponse{body: "{}"}
+
+	examples := []struct {
+		name      string
+		apis      fakeGoogleAPIs
+		addresses []string
+		fails     bool
+	}{
+		{name: "nothing", apis: fakeGoogleAPIs{}, addresses: []string{}},
+		{
+			name: "network and addresses",
+			apis: fakeGoogleAPIs{
+				compute + "/global/networks/au-cluster-vpc":                            ok,
+				compute + "/regions/asia-northeast1/subnetworks/au-cluster-vpc-subnet": ok,
+				compute + "/regions/asia-northeast1/addresses/ingress-ip":              ok,
+			},
+			addresses: []string{
+				"google_compute_network.primary-vpc",
+				"google_compute_subnetwork.primary-vpc-subnet",
+				"google_compute_address.primary-vpc-ingress",
+			},
+		},
+		{
+			name: "router with nat",
+			apis: fakeGoogleAPIs{
+				compute + "/regions/asia-northeast1/routers/au-cluster-vpc-router": {body: `{"nats":[{"name":"other"},{"name":"au-cluster-vpc-nat"}]}`},
+			},
+			addresses: []string{"google_compute_router.primary-vpc-router", "google_compute_router_nat.primary-vpc-nat"},
+		},
+		{
+			name: "cluster with node pools",
+			apis: fakeGoogleAPIs{
+				node:                     ok,
+				container:                ok,
+				container + "/nodePools": {body: `{"nodePools":[{"name":"primary-pool"},{"name":"created-by-hand"}]}`},
+			},
+			addresses: []string{"google_service_account.node", "google_container_cluster.primary", "google_container_node_pool.primary-pool"},
+		},
+		{
+			name:  "error other than not found",
+			apis:  fakeGoogleAPIs{compute + "/global/networks/au-cluster-vpc": {status: http.StatusForbidden, body: `{"error":{"code":403,"message":"forbidden"}}`}},
+			fails: true,
+		},
+	}
+
+	for _, example := range examples {
+		opts := []option.ClientOption{option.WithHTTPClient(&http.Client{Transport: example.apis})}
+		imports, e := DiscoverTFImports(context.Background(), config, "project", opts...)
+		if example.fails {
+			if e == nil {
+				t.Errorf("%s: expected error; got %v", example.name, imports)
+			}
+			continue
+		}
+		if e != nil {
+			t.Errorf("%s: %v", example.name, e)
+			continue
+		}
+		addresses := make([]string, 0, len(imports))
+		for _, imp := range imports {
+			addresses = append(addresses, imp.Address)
+		}
+		if !reflect.DeepEqual(addresses, example.addresses) {
+			t.Errorf("%s: expected %v; got %v", example.name, example.addresses, addresses)
+		}
+	}
+}
+
+func TestDiscoverTFImportsIDs(t *testing.T) {
+	t.Parallel()
+
+	config := Config{
+		Region:  "asia-northeast1",
+		Cluster: ClusterConfig{Name: "au-cluster", Location: "asia-northeast1-b"},
+	}
+	apis := fakeGoogleAPIs{
+		"compute.googleapis.com/compute/v1/projects/project/regions/asia-northeast1/addresses/au-cluster-vpc-nat-ip": {body: "{}"},
+		"container.googleapis.com/v1/projects/project/locations/asia-northeast1-b/clusters/au-cluster":               {body: "{}"},
+		"container.googleapis.com/v1/projects/project/locations/asia-northeast1-b/clusters/au-cluster/nodePools":     {body: `{"nodePools":[{"name":"primary-pool"}]}`},
+	}
+	imports, e := DiscoverTFImports(context.Background(), config, "project", option.WithHTTPClient(&http.Client{Transport: apis}))
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	expected := []string{
+		"terraform import google_compute_address.primary-vpc-nat projects/project/regions/asia-northeast1/addresses/au-cluster-vpc-nat-ip",
+		"terraform import google_container_cluster.primary projects/project/locations/asia-northeast1-b/clusters/au-cluster",
+		"terraform import google_container_node_pool.primary-pool project/asia-northeast1-b/au-cluster/primary-pool",
+	}
+	commands := make([]string, 0, len(imports))
+	for _, imp := range imports {
+		commands = append(commands, imp.String())
+	}
+	if !reflect.DeepEqual(commands, expected) {
+		t.Errorf("expected %v; got %v", expected, commands)
+	}
+}
+
+// fakeRunner writes output to out for expected args.
+func fakeRunner(t *testing.T, expected []string, output string, e error) CommandRunner {
+	return func(args []string, out io.Writer) error {
+		if !reflect.DeepEqual(args, expected) {
+			t.Errorf("expected %v to be run; got %v", expected, args)
+		}
+		io.WriteString(out, output)
+		return e
+	}
+}
+
+func TestListTFState(t *testing.T) {
+	t.Parallel()
+
+	examples := []struct {
+		output    string
+		e         error
+		addresses map[string]bool
+	}{
+		{output: "", addresses: map[string]bool{}},
+		{
+			output:    "google_compute_network.primary-vpc\n\ngoogle_container_cluster.primary\n",
+			addresses: map[string]bool{"google_compute_network.primary-vpc": true, "google_container_cluster.primary": true},
+		},
+		{e: fmt.Errorf("exit status 1: no state")},
+	}
+
+	for i, example := range examples {
+		run := fakeRunner(t, []string{"terraform", "state", "list"}, example.output, example.e)
+		addresses, e := ListTFState(run)
+		if example.e != nil {
+			if e == nil {
+				t.Errorf("example #%d: expected error; got %v", i, addresses)
+			}
+			continue
+		}
+		if e != nil {
+			t.Errorf("example #%d: %v", i, e)
+			continue
+		}
+		if !reflect.DeepEqual(addresses, example.addresses) {
+			t.Errorf("example #%d: expected %v; got %v", i, example.addresses, addresses)
+		}
+	}
+}
+
+func TestTFImportRun(t *testing.T) {
+	t.Parallel()
+
+	examples := []struct {
+		imp    TFImport
+		output string
+		e      error
+	}{
+		{
+			imp:    TFImport{Address: "google_service_account.node", ID: "projects/project/serviceAccounts/node"},
+			output: "Import successful!\n",
+		},
+		{
+			imp: TFImport{Address: "google_container_cluster.primary", ID: "projects/project/locations/l/clusters/c"},
+			e:   fmt.Errorf("exit status 1: resource already managed"),
+		},
+	}
+
+	for i, example := range examples {
+		var out bytes.Buffer
+		run := fakeRunner(t, []string{"terraform", "import", example.imp.Address, example.imp.ID}, example.output, example.e)
+		if e := example.imp.Run(run, &out); e != example.e {
+			t.Errorf("example #%d: expected %v; got %v", i, example.e, e)
+		}
+		if out.String() != example.output {
+			t.Errorf("example #%d: expected output %q; got %q", i, example.output, out.String())
+		}
+	}
+}
@@ -0,0 +1,363 @@
+package tools
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/oakcask/automutek8s/cluster"
+	"google.golang.org/api/option"
+	sqladmin "google.golang.org/api/sqladmin/v1beta4"
+	"sigs.k8s.io/kustomize/api/resid"
+	kustomize "sigs.k8s.io/kustomize/api/types"
+)
+
+const (
+	// BackendInCluster runs the backend as StatefulSet in kubernetes/base.
+	BackendInCluster = "incluster"
+	// DatabaseCloudSQL replaces postgres with Cloud SQL for PostgreSQL.
+	DatabaseCloudSQL = "cloudsql"
+	// CacheMemorystore replaces redis with Memorystore for Redis.
+	CacheMemorystore = "memorystore"
+)
+
+// CloudSQLInstanceName is name of Cloud SQL instance replacing postgres.
+const CloudSQLInstanceName = "automutek8s-postgres"
+
+// MemorystoreInstanceName is name of Memorystore instance replacing redis.
+const MemorystoreInstanceName = "automutek8s-redis"
+
+const defaultCloudSQLTier = "db-f1-micro"
+const defaultMemorystoreTier = "BASIC"
+
+// cloudSQLUser and cloudSQLPassword are credentials of Cloud SQL in postgres secret.
+var cloudSQLUser = SecretHandle{MetadataName: "postgres", Key: "POSTGRES_USER"}
+var cloudSQLPassword = SecretHandle{MetadataName: "postgres", Key: "POSTGRES_PASSWORD"}
+
+// DatabaseConfig is schema of database block in config.yaml.
+type DatabaseConfig struct {
+	Mode string `json:"mode"`
+	Tier string `json:"tier"`
+}
+
+// CacheConfig is schema of cache block in config.yaml.
+type CacheConfig struct {
+	Mode         string `json:"mode"`
+	Tier         string `json:"tier"`
+	MemorySizeGB int    `json:"memory_size_gb"`
+}
+
+// BackendAddrs are addresses of managed backends recorded in terraform state.
+// An address is empty if the backend runs in the cluster.
+type BackendAddrs struct {
+	Postgres string
+	Redis    string
+}
+
+// DatabaseMode returns where postgres runs; BackendInCluster without database block.
+func (config Config) DatabaseMode() string {
+	if config.Database == nil || config.Database.Mode == "" {
+		return BackendInCluster
+	}
+	return config.Database.Mode
+}
+
+// CacheMode returns where redis runs; BackendInCluster without cache block.
+func (config Config) CacheMode() string {
+	if config.Cache == nil || config.Cache.Mode == "" {
+		return BackendInCluster
+	}
+	return config.Cache.Mode
+}
+
+// HasManagedBackends returns true if postgres or redis is replaced by managed service.
+func (config Config) HasManagedBackends() bool {
+	return config.DatabaseMode() != BackendInCluster || config.CacheMode() != BackendInCluster
+}
+
+func (config Config) validateBackends() error {
+	if mode := config.DatabaseMode(); mode != BackendInCluster && mode != DatabaseCloudSQL {
+		return fmt.Errorf("database: mode should be one of %s and %s: %q", BackendInCluster, DatabaseCloudSQL, mode)
+	}
+	if mode := config.CacheMode(); mode != BackendInCluster && mode != CacheMemorystore {
+		return fmt.Errorf("cache: mode should be one of %s and %s: %q", BackendInCluster, CacheMemorystore, mode)
+	}
+	if config.Cache != nil && config.Cache.MemorySizeGB < 0 {
+		return fmt.Errorf("cache: memory_size_gb should not be negative")
+	}
+	if config.HasManagedBackends() && len(config.Environments) > 0 {
+		return fmt.Errorf("managed backends don't support environments; every environment would share one database and one cache")
+	}
+	return nil
+}
+
+// InClusterVolumes returns volumes of StatefulSets which are not replaced by managed services.
+func (config Config) InClusterVolumes() []cluster.Volume {
+	volumes := make([]cluster.Volume, 0, len(cluster.Volumes))
+	for _, volume := range cluster.Volumes {
+		if volume.StatefulSet == "postgres" && config.DatabaseMode() != BackendInCluster {
+			continue
+		}
+		if volume.StatefulSet == "redis" && config.CacheMode() != BackendInCluster {
+			continue
+		}
+		volumes = append(volumes, volume)
+	}
+	return volumes
+}
+
+// BackendAddrs returns addresses of managed backends from terraform state.
+func (config Config) BackendAddrs() (BackendAddrs, error) {
+	var addrs BackendAddrs
+	if !config.HasManagedBackends() {
+		return addrs, nil
+	}
+
+	outputs, e := GetTFOutputs()
+	if e != nil {
+		return addrs, e
+	}
+	if config.DatabaseMode() == DatabaseCloudSQL {
+		if outputs.PostgresAddr == "" {
+			return addrs, fmt.Errorf("address of Cloud SQL is not in terraform state; run `terraform apply` first")
+		}
+		addrs.Postgres = outputs.PostgresAddr
+	}
+	if config.CacheMode() == CacheMemorystore {
+		if outputs.RedisAddr == "" {
+			return addrs, fmt.Errorf("address of Memorystore is not in terraform state; run `terraform apply` first")
+		}
+		addrs.Redis = outputs.RedisAddr
+	}
+	return addrs, nil
+}
+
+// tenantPostgresAddr returns address of postgres which tenants share.
+func (addrs BackendAddrs) tenantPostgresAddr() string {
+	if addrs.Postgres == "" {
+		return SharedPostgresAddr
+	}
+	return addrs.Postgres
+}
+
+func deletePatch(apiVersion string, kind string, name string, labelSelector string) kustomize.Patch {
+	return kustomize.Patch{
+		Target: &kustomize.Selector{Gvk: resid.Gvk{Kind: kind}, Name: name, LabelSelector: labelSelector},
+		Patch:  fmt.Sprintf("apiVersion: %s\nkind: %s\nmetadata:\n  name: %s\n$patch: delete\n", apiVersion, kind, name),
+	}
+}
+
+// AddBackendsToKustomization drops StatefulSets and Services replaced by
+// managed backends, and points discovery ConfigMap to addrs instead.
+// Resources matching labelSelector are modified.
+func AddBackendsToKustomization(k *kustomize.Kustomization, addrs BackendAddrs, labelSelector string) error {
+	ops := make([]jsonPatchOp, 0)
+	if addrs.Postgres != "" {
+		ops = append(ops, jsonPatchOp{Op: "replace", Path: "/data/POSTGRES_ADDR", Value: addrs.Postgres})
+		k.Patches = append(k.Patches,
+			deletePatch("apps/v1", "StatefulSet", "postgres", labelSelector),
+			deletePatch("v1", "Service", "postgres", labelSelector),
+		)
+	}
+	if addrs.Redis != "" {
+		ops = append(ops, jsonPatchOp{Op: "replace", Path: "/data/REDIS_ADDR", Value: addrs.Redis})
+		k.Patches = append(k.Patches,
+			deletePatch("apps/v1", "StatefulSet", "redis", labelSelector),
+			deletePatch("v1", "Service", "redis", labelSelector),
+		)
+	}
+	if len(ops) == 0 {
+		return nil
+	}
+
+	discovery, e := jsonPatch("ConfigMap", "discovery", ops...)
+	if e != nil {
+		return e
+	}
+	discovery.Target.LabelSelector = labelSelector
+	k.PatchesJson6902 = append(k.PatchesJson6902, discovery)
+	return nil
+}
+
+// AddTFBackends adds Cloud SQL and Memorystore instances replacing postgres and redis,
+// which are reachable only with private IP on the primary VPC through private services access.
+// The user of Cloud SQL is read from postgres secret stored by `mage secrets:set`,
+// and its password is left to SetCloudSQLPassword to keep it out of terraform state.
+func AddTFBackends(ctx context.Context, doc *TFDocument, config Config) error {
+	if e := config.validateBackends(); e != nil {
+		return e
+	}
+	if !config.HasManagedBackends() {
+		return nil
+	}
+	if doc.Output == nil {
+		doc.Output = map[string]TFOutput{}
+	}
+
+	doc.AddResource("google_project_service", "servicenetworking", TFObject{
+		"project":            TFExpr("var.gcloud_project"),
+		"service":            "servicenetworking.googleapis.com",
+		"disable_on_destroy": false,
+	})
+	doc.AddResource("google_compute_global_address", "private-service-access", TFObject{
+		"name":          "automutek8s-private-service-access",
+		"purpose":       "VPC_PEERING",
+		"address_type":  "INTERNAL",
+		"prefix_length": 16,
+		"network":       TFExpr("google_compute_network.primary-vpc.id"),
+	})
+	doc.AddResource("google_service_networking_connection", "private-service-access", TFObject{
+		"depends_on":              []string{"google_project_service.servicenetworking"},
+		"network":                 TFExpr("google_compute_network.primary-vpc.id"),
+		"service":                 "servicenetworking.googleapis.com",
+		"reserved_peering_ranges": []string{TFExpr("google_compute_global_address.private-service-access.name")},
+	})
+
+	if config.DatabaseMode() == DatabaseCloudSQL {
+		if e := addTFCloudSQL(ctx, doc, config); e != nil {
+			return e
+		}
+	}
+	if config.CacheMode() == CacheMemorystore {
+		addTFMemorystore(doc, config)
+	}
+	return nil
+}
+
+func addTFCloudSQL(ctx context.Context, doc *TFDocument, config Config) error {
+	tier := config.Database.Tier
+	if tier == "" {
+		tier = defaultCloudSQLTier
+	}
+
+	secretName, e := cloudSQLUser.buildCloudSecretName(ctx)
+	if e != nil {
+		return e
+	}
+	doc.AddData("google_secret_manager_secret_version", "postgres-user", TFObject{
+		"secret": secretName,
+	})
+
+	doc.AddResource("google_project_service", "sqladmin", TFObject{
+		"project":            TFExpr("var.gcloud_project"),
+		"service":            "sqladmin.googleapis.com",
+		"disable_on_destroy": false,
+	})
+	doc.AddResource("google_sql_database_instance", "postgres", TFObject{
+		"depends_on":          []string{"google_project_service.sqladmin", "google_service_networking_connection.private-service-access"},
+		"name":                CloudSQLInstanceName,
+		"region":              TFExpr("var.region"),
+		"database_version":    "POSTGRES_12",
+		"deletion_protection": true,
+		"settings": TFObject{
+			"tier": tier,
+			"ip_configuration": TFObject{
+				"ipv4_enabled":    false,
+				"private_network": TFExpr("google_compute_network.primary-vpc.id"),
+			},
+			"backup_configuration": TFObject{
+				"enabled": true,
+			},
+		},
+	})
+	doc.AddResource("google_sql_user", "postgres", TFObject{
+		"instance": TFExpr("google_sql_database_instance.postgres.name"),
+		"name":     TFExpr("data.google_secret_manager_secret_version.postgres-user.secret_data"),
+	})
+	// postgres image creates database named after the user
+	doc.AddResource("google_sql_database", "postgres", TFObject{
+		"instance": TFExpr("google_sql_database_instance.postgres.name"),
+		"name":     TFExpr("google_sql_user.postgres.name"),
+	})
+	doc.Output[tfOutputPostgresAddr] = TFOutput{
+		Value:       fmt.Sprintf("%s:5432", TFExpr("google_sql_database_instance.postgres.private_ip_address")),
+		Description: "private address of Cloud SQL replacing postgres",
+	}
+	return nil
+}
+
+// SetCloudSQLPassword sets POSTGRES_PASSWORD of postgres secret as password
+// of the user of Cloud SQL with Cloud SQL Admin API,
+// so that the password never appears on command lines.
+func SetCloudSQLPassword(ctx context.Context) error {
+	projectID, e := GetProjectID(ctx)
+	if e != nil {
+		return e
+	}
+	user, e := cloudSQLUser.Unvail(ctx)
+	if e != nil {
+		return e
+	}
+	password, e := cloudSQLPassword.Unvail(ctx)
+	if e != nil {
+		return e
+	}
+	return updateCloudSQLPassword(ctx, projectID, strings.TrimSpace(string(user)), strings.TrimSpace(string(password)))
+}
+
+// cloudSQLPollInterval is interval to poll operation of Cloud SQL Admin API.
+const cloudSQLPollInterval = 2 * time.Second
+
+func updateCloudSQLPassword(ctx context.Context, projectID string, user string, password string, opts ...option.ClientOption) error {
+	service, e := sqladmin.NewService(ctx, opts...)
+	if e != nil {
+		return e
+	}
+	op, e := service.Users.Update(projectID, CloudSQLInstanceName, &sqladmin.User{Name: user, Password: password}).Name(user).Context(ctx).Do()
+	if e != nil {
+		return fmt.Errorf("failed to update password of %s: %v", user, e)
+	}
+
+	for op.Status != "DONE" {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(cloudSQLPollInterval):
+		}
+		if op, e = service.Operations.Get(projectID, op.Name).Context(ctx).Do(); e != nil {
+			return e
+		}
+	}
+	if op.Error != nil && len(op.Error.Errors) > 0 {
+		return fmt.Errorf("failed to update password of %s: %s", user, op.Error.Errors[0].Message)
+	}
+	return nil
+}
+
+func addTFMemorystore(doc *TFDocument, config Config) {
+	tier := config.Cache.Tier
+	if tier == "" {
+		tier = defaultMemorystoreTier
+	}
+	memorySize := config.Cache.MemorySizeGB
+	if memorySize == 0 {
+		memorySize = 1
+	}
+
+	doc.AddResource("google_project_service", "redis", TFObject{
+		"project":            TFExpr("var.gcloud_project"),
+		"service":            "redis.googleapis.com",
+		"disable_on_destroy": false,
+	})
+	doc.AddResource("google_redis_instance", "redis", TFObject{
+		"depends_on":         []string{"google_project_service.redis", "google_service_networking_connection.private-service-access"},
+		"name":               MemorystoreInstanceName,
+		"region":             TFExpr("var.region"),
+		"tier":               tier,
+		"memory_size_gb":     memorySize,
+		"redis_version":      "REDIS_6_X",
+		"authorized_network": TFExpr("google_compute_network.primary-vpc.id"),
+		"connect_mode":       "PRIVATE_SERVICE_ACCESS",
+		"auth_enabled":       true,
+	})
+	doc.Output[tfOutputRedisAddr] = TFOutput{
+		Value:       fmt.Sprintf("%s:%s", TFExpr("google_redis_instance.redis.host"), TFExpr("google_redis_instance.redis.port")),
+		Description: "private address of Memorystore replacing redis",
+	}
+	doc.Output[tfOutputRedisAuthString] = TFOutput{
+		Value:       TFExpr("google_redis_instance.redis.auth_string"),
+		Description: "AUTH string of Memorystore to be stored as REDIS_PASSWORD of redis secret",
+		Sensitive:   true,
+	}
+}
@@ -0,0 +1,134 @@
+package tools
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"google.golang.org/api/option"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+var managedBackends = Config{
+	Database: &DatabaseConfig{Mode: DatabaseCloudSQL},
+	Cache:    &CacheConfig{Mode: CacheMemorystore},
+}
+
+func TestRenderManagedBackends(t *testing.T) {
+	t.Parallel()
+
+	config := managedBackends
+	config.Tenants = fakeTenants
+	objs := buildObjects(t, fakeRenderer(config))
+
+	for _, name := range []string{"postgres", "redis"} {
+		if findNamespacedObject(objs, "", "StatefulSet", name) != nil || findNamespacedObject(objs, "", "Service", name) != nil {
+			t.Errorf("expected %s of the default stack to be dropped", name)
+		}
+	}
+	discovery := mustFindObject(t, objs, "", "ConfigMap", "discovery-")
+	data, _, _ := unstructured.NestedStringMap(discovery.Object, "data")
+	if data["POSTGRES_ADDR"] != "10.20.0.3:5432" || data["REDIS_ADDR"] != "10.20.0.4:6378" {
+		t.Errorf("expected discovery to point managed backends; got %v", data)
+	}
+
+	// tenants keep their own redis, sharing Cloud SQL instead of postgres of the default stack
+	if findNamespacedObject(objs, "tenant-alpha", "StatefulSet", "redis") == nil {
+		t.Errorf("expected redis of tenant to be left")
+	}
+	tenantDiscovery := mustFindObject(t, objs, "tenant-alpha", "ConfigMap", "discovery-")
+	data, _, _ = unstructured.NestedStringMap(tenantDiscovery.Object, "data")
+	if data["POSTGRES_ADDR"] != "10.20.0.3:5432" || data["REDIS_ADDR"] != "redis:6379" {
+		t.Errorf("expected tenant to share Cloud SQL; got %v", data)
+	}
+}
+
+func TestRenderEnvironmentWithCloudSQL(t *testing.T) {
+	t.Parallel()
+
+	config := Config{Environments: []EnvironmentConfig{prodEnvironment}, Database: managedBackends.Database}
+	renderer := fakeRenderer(config)
+	renderer.Environment = prodEnvironment
+	if _, e := renderer.Overlay(context.Background()); e == nil {
+		t.Errorf("expected error since environments would share Cloud SQL")
+	}
+	if e := AddTFBackends(context.Background(), &TFDocument{}, config); e == nil {
+		t.Errorf("expected error since environments would share Cloud SQL")
+	}
+}
+
+func TestAddTFBackends(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	doc := TFDocument{}
+	if e := AddTFBackends(ctx, &doc, Config{}); e != nil {
+		t.Fatal(e)
+	}
+	if len(doc.Resource) != 0 {
+		t.Errorf("expected nothing to be added with in-cluster backends; got %v", doc.Resource)
+	}
+
+	if e := AddTFBackends(ctx, &doc, Config{Database: &DatabaseConfig{Mode: "spanner"}}); e == nil {
+		t.Errorf("expected error with unknown mode")
+	}
+
+	if e := AddTFBackends(ctx, &doc, managedBackends); e != nil {
+		t.Fatal(e)
+	}
+	instance := doc.Resource["google_sql_database_instance"]["postgres"]
+	ipConfig := instance["settings"].(TFObject)["ip_configuration"].(TFObject)
+	if ipConfig["ipv4_enabled"] != false || ipConfig["private_network"] != "${google_compute_network.primary-vpc.id}" {
+		t.Errorf("expected Cloud SQL only with private IP on the primary VPC; got %v", ipConfig)
+	}
+	if _, ok := doc.Data["google_secret_manager_secret_version"]["postgres-password"]; ok {
+		t.Errorf("expected password of Cloud SQL not to be read into terraform state")
+	}
+	if _, ok := doc.Resource["google_sql_user"]["postgres"]["password"]; ok {
+		t.Errorf("expected password of Cloud SQL to be set out of terraform")
+	}
+	if redis := doc.Resource["google_redis_instance"]["redis"]; redis["connect_mode"] != "PRIVATE_SERVICE_ACCESS" || redis["memory_size_gb"] != 1 {
+		t.Errorf("unexpected Memorystore: %v", redis)
+	}
+	if _, ok := doc.Output[tfOutputRedisAddr]; !ok {
+		t.Errorf("expected address of Memorystore to be output; got %v", doc.Output)
+	}
+}
+
+func TestUpdateCloudSQLPassword(t *testing.T) {
+	t.Parallel()
+
+	const users = "sqladmin.googleapis.com/sql/v1beta4/projects/project/instances/automutek8s-postgres/users"
+	const operation = "sqladmin.googleapis.com/sql/v1beta4/projects/project/operations/op"
+	examples := []struct {
+		apis  fakeGoogleAPIs
+		fails bool
+	}{
+		{apis: fakeGoogleAPIs{users: {body: `{"name":"op","status":"DONE"}`}}},
+		{apis: fakeGoogleAPIs{
+			users:     {body: `{"name":"op","status":"PENDING"}`},
+			operation: {body: `{"name":"op","status":"DONE","error":{"errors":[{"message":"user not found"}]}}`},
+		}, fails: true},
+		{apis: fakeGoogleAPIs{users: {status: http.StatusForbidden, body: `{"error":{"code":403,"message":"forbidden"}}`}}, fails: true},
+	}
+
+	for i, example := range examples {
+		e := updateCloudSQLPassword(context.Background(), "project", "automuteus", "secret", option.WithHTTPClient(&http.Client{Transport: example.apis}))
+		if (e != nil) != example.fails {
+			t.Errorf("example #%d: expected failure to be %v; got %v", i, example.fails, e)
+		}
+		if e != nil && strings.Contains(e.Error(), "secret") {
+			t.Errorf("example #%d: expected password not to be in error; got %v", i, e)
+		}
+	}
+}
+
+func TestInClusterVolumes(t *testing.T) {
+	t.Parallel()
+
+	volumes := Config{Cache: managedBackends.Cache}.InClusterVolumes()
+	if len(volumes) != 1 || volumes[0].StatefulSet != "postgres" {
+		t.Errorf("expected only postgres volume; got %v", volumes)
+	}
+}
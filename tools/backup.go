@@ -0,0 +1,400 @@
+package tools
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	kustomize "sigs.k8s.io/kustomize/api/types"
+)
+
+// BackupConfig is schema of backup block in config.yaml.
+// With Schedule, postgres and redis are backed up to Bucket by a CronJob in the cluster.
+// Keep is how many backups of each namespace are kept.
+type BackupConfig struct {
+	Keep     int    `json:"keep"`
+	Schedule string `json:"schedule"`
+	Bucket   string `json:"bucket"`
+}
+
+// BackupBase is kustomization of the CronJob, which is added by AddBackupToKustomization.
+const BackupBase = "./kubernetes/base/backup"
+
+// BackupKustomizationPath is kustomization.yaml of BackupBase.
+const BackupKustomizationPath = "kubernetes/base/backup/kustomization.yaml"
+
+// BackupServiceAccountID is ID of Google service account of the CronJob.
+const BackupServiceAccountID = "automutek8s-backup"
+
+// BackupKSA is Kubernetes service account of the CronJob.
+const BackupKSA = "backup"
+
+// BackupCronJobName is name of the CronJob in BackupBase.
+const BackupCronJobName = "backup"
+
+// DefaultBackupKeep is how many backups are kept without backup block.
+const DefaultBackupKeep = 30
+
+// BackupBaseImages are images of the CronJob shared with kubernetes/base,
+// whose tags are taken from there so that dumps match the servers.
+var BackupBaseImages = []string{"postgres", "redis"}
+
+// PostgresBackupPrefix is prefix of objects of postgres backups in the bucket,
+// following namespace of the stack.
+const PostgresBackupPrefix = "postgres/"
+
+const backupBucketLabel = "automutek8s-backup"
+const backupTimeFormat = "20060102T150405Z"
+const postgresBackupSuffix = ".dump"
+
+// PgDumpCommand dumps the database of automuteus in custom format to stdout.
+// It runs in postgres container, where credentials are in the environment.
+var PgDumpCommand = []string{"sh", "-c", `pg_dump --format=custom --username="$POSTGRES_USER" "${POSTGRES_DB:-$POSTGRES_USER}"`}
+
+// PgRestoreCommand restores the database from a dump of PgDumpCommand in stdin,
+// dropping objects in the dump before recreating them.
+var PgRestoreCommand = []string{"sh", "-c", `pg_restore --clean --if-exists --no-owner --username="$POSTGRES_USER" --dbname="${POSTGRES_DB:-$POSTGRES_USER}"`}
+
+// PodExec runs command in the pod streaming stdin and stdout.
+type PodExec func(ctx context.Context, command []string, stdin io.Reader, stdout io.Writer) error
+
+// Backup is a dump of postgres in the bucket.
+type Backup struct {
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+	Size    int64     `json:"size"`
+}
+
+func (backup Backup) String() string {
+	return fmt.Sprintf("%s\t%s\t%d bytes", backup.Name, backup.Created.Local().Format(time.RFC3339), backup.Size)
+}
+
+// BackupKeep returns how many backups of each namespace are kept.
+func (config Config) BackupKeep() int {
+	if config.Backup == nil || config.Backup.Keep <= 0 {
+		return DefaultBackupKeep
+	}
+	return config.Backup.Keep
+}
+
+// ScheduledBackup returns true if backups are taken by the CronJob.
+func (config Config) ScheduledBackup() bool {
+	return config.Backup != nil && config.Backup.Schedule != ""
+}
+
+// BackupBucket returns name of the bucket managed by terraform,
+// or empty if the bucket is created on first db:backup.
+func (config Config) BackupBucket() string {
+	if config.Backup == nil {
+		return ""
+	}
+	return config.Backup.Bucket
+}
+
+func (config Config) validateBackup() error {
+	if config.ScheduledBackup() && config.BackupBucket() == "" {
+		return fmt.Errorf("backup: bucket is required with schedule")
+	}
+	return nil
+}
+
+// BackupPrefix returns prefix of objects of postgres backups of the stack in namespace,
+// so that environments and tenants sharing the bucket don't see backups of others.
+func BackupPrefix(namespace string) string {
+	return namespace + "/" + PostgresBackupPrefix
+}
+
+// BackupObjectName returns name of the backup of namespace taken at t.
+func BackupObjectName(namespace string, t time.Time) string {
+	return BackupPrefix(namespace) + t.UTC().Format(backupTimeFormat) + postgresBackupSuffix
+}
+
+// backupFromAttrs returns Backup of the object, or false if it is not a backup of namespace.
+func backupFromAttrs(attrs *storage.ObjectAttrs, namespace string) (Backup, bool) {
+	prefix := BackupPrefix(namespace)
+	if !strings.HasPrefix(attrs.Name, prefix) || !strings.HasSuffix(attrs.Name, postgresBackupSuffix) {
+		return Backup{}, false
+	}
+	timestamp := strings.TrimSuffix(strings.TrimPrefix(attrs.Name, prefix), postgresBackupSuffix)
+	created, e := time.Parse(backupTimeFormat, timestamp)
+	if e != nil {
+		return Backup{}, false
+	}
+	return Backup{Name: attrs.Name, Created: created, Size: attrs.Size}, true
+}
+
+// CreateOrGetBackupBucket returns name of the bucket for backups in the region,
+// creating one if there is none.
+func CreateOrGetBackupBucket(ctx context.Context, client *storage.Client, region string) (string, error) {
+	return createOrGetLabeledBucket(ctx, client, backupBucketLabel, "automutek8s-backup", &storage.BucketAttrs{
+		Location: region,
+	})
+}
+
+// ListBackups returns backups of namespace in the bucket, newest first.
+func ListBackups(ctx context.Context, bucket *storage.BucketHandle, namespace string) ([]Backup, error) {
+	backups := make([]Backup, 0)
+	itr := bucket.Objects(ctx, &storage.Query{Prefix: BackupPrefix(namespace)})
+	for {
+		attrs, e := itr.Next()
+		if e == iterator.Done {
+			break
+		}
+		if e != nil {
+			return nil, e
+		}
+		if backup, ok := backupFromAttrs(attrs, namespace); ok {
+			backups = append(backups, backup)
+		}
+	}
+	sortBackups(backups)
+	return backups, nil
+}
+
+func sortBackups(backups []Backup) {
+	sort.Slice(backups, func(i, j int) bool { return backups[i].Created.After(backups[j].Created) })
+}
+
+// PruneBackups deletes backups of namespace in the bucket except the newest keep,
+// returning deleted ones. Backups are never deleted only because they are old,
+// so that the last ones survive however long backups are not taken.
+func PruneBackups(ctx context.Context, bucket *storage.BucketHandle, namespace string, keep int) ([]Backup, error) {
+	backups, e := ListBackups(ctx, bucket, namespace)
+	if e != nil {
+		return nil, e
+	}
+	if keep < 1 || len(backups) <= keep {
+		return nil, nil
+	}
+
+	pruned := backups[keep:]
+	for _, backup := range pruned {
+		if e := bucket.Object(backup.Name).Delete(ctx); e != nil && e != storage.ErrObjectNotExist {
+			return nil, fmt.Errorf("failed to delete %s: %v", backup.Name, e)
+		}
+	}
+	return pruned, nil
+}
+
+// FindBackup returns the backup named name in backups sorted newest first.
+// Name may be "latest", or timestamp of the backup.
+func FindBackup(backups []Backup, name string) (Backup, error) {
+	if name == "latest" && len(backups) > 0 {
+		return backups[0], nil
+	}
+	for _, backup := range backups {
+		if backup.Name == name || backup.Created.UTC().Format(backupTimeFormat) == name {
+			return backup, nil
+		}
+	}
+	return Backup{}, fmt.Errorf("backup %s is not found", name)
+}
+
+// BackupPostgres streams dump of postgres in namespace to the bucket as the backup taken at now.
+// The upload is aborted if the dump fails, so that no broken backup is left.
+func BackupPostgres(ctx context.Context, exec PodExec, bucket *storage.BucketHandle, namespace string, now time.Time) (Backup, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	name := BackupObjectName(namespace, now)
+	w := bucket.Object(name).NewWriter(ctx)
+	w.ContentType = "application/octet-stream"
+
+	if e := exec(ctx, PgDumpCommand, nil, w); e != nil {
+		cancel()
+		w.Close()
+		return Backup{}, fmt.Errorf("failed to dump postgres: %v", e)
+	}
+	if e := w.Close(); e != nil {
+		return Backup{}, e
+	}
+	return Backup{Name: name, Created: now, Size: w.Attrs().Size}, nil
+}
+
+// RestorePostgres streams the backup in the bucket to pg_restore.
+// Clients of postgres should be stopped beforehand, as pg_restore drops their tables.
+func RestorePostgres(ctx context.Context, exec PodExec, bucket *storage.BucketHandle, backup Backup) error {
+	r, e := bucket.Object(backup.Name).NewReader(ctx)
+	if e != nil {
+		return e
+	}
+	defer r.Close()
+
+	if e := exec(ctx, PgRestoreCommand, r, ioutil.Discard); e != nil {
+		return fmt.Errorf("failed to restore postgres from %s: %v", backup.Name, e)
+	}
+	return nil
+}
+
+// AddBackupToKustomization deploys the CronJob with the kustomization
+// when backup.schedule is in config.yaml.
+// BackupBaseImages are looked up in baseImages, which are images of kubernetes/base.
+func AddBackupToKustomization(k *kustomize.Kustomization, config Config, projectID string, baseImages []kustomize.Image) error {
+	if !config.ScheduledBackup() {
+		return nil
+	}
+	if e := config.validateBackup(); e != nil {
+		return e
+	}
+
+	for _, name := range BackupBaseImages {
+		image, ok := findImage(baseImages, name)
+		if !ok {
+			return fmt.Errorf("image %s is not found in %s", name, BaseKustomizationPath)
+		}
+		k.Images = append(k.Images, image)
+	}
+
+	k.Bases = append(k.Bases, BackupBase)
+	k.ConfigMapGenerator = append(k.ConfigMapGenerator, kustomize.ConfigMapArgs{
+		GeneratorArgs: kustomize.GeneratorArgs{
+			Name:     "backup-config",
+			Behavior: "merge",
+			KvPairSources: kustomize.KvPairSources{
+				LiteralSources: []string{
+					fmt.Sprintf("BACKUP_BUCKET=%s", config.Backup.Bucket),
+					fmt.Sprintf("BACKUP_KEEP=%d", config.BackupKeep()),
+				},
+			},
+		},
+	})
+	k.Patches = append(k.Patches,
+		kustomize.Patch{
+			Patch: fmt.Sprintf(`apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: %s
+  annotations:
+    iam.gke.io/gcp-service-account: %s@%s.iam.gserviceaccount.com
+`, BackupKSA, BackupServiceAccountID, projectID),
+		},
+		kustomize.Patch{
+			Patch: fmt.Sprintf(`apiVersion: batch/v1beta1
+kind: CronJob
+metadata:
+  name: %s
+spec:
+  schedule: %q
+`, BackupCronJobName, config.Backup.Schedule),
+		},
+	)
+
+	if config.CacheMode() != BackendInCluster {
+		redisSnapshot, e := jsonPatch("CronJob", BackupCronJobName,
+			jsonPatchOp{Op: "remove", Path: "/spec/jobTemplate/spec/template/spec/initContainers/1"},
+		)
+		if e != nil {
+			return e
+		}
+		k.PatchesJson6902 = append(k.PatchesJson6902, redisSnapshot)
+	}
+	return nil
+}
+
+// AddTFBackup adds the bucket of backups when backup.bucket is in config.yaml.
+// With schedule, service account of the CronJob which can upload and prune backups in the bucket
+// is also added, bound to its Kubernetes service account in namespace of every environment.
+func AddTFBackup(doc *TFDocument, config Config) error {
+	if e := config.validateBackup(); e != nil {
+		return e
+	}
+	if config.BackupBucket() == "" {
+		return nil
+	}
+
+	doc.AddResource("google_storage_bucket", "backup", TFObject{
+		"name":                        config.Backup.Bucket,
+		"location":                    TFExpr("var.region"),
+		"uniform_bucket_level_access": true,
+		"labels":                      map[string]string{backupBucketLabel: ""},
+	})
+	if !config.ScheduledBackup() {
+		return nil
+	}
+
+	doc.AddResource("google_service_account", "backup", TFObject{
+		"account_id":   BackupServiceAccountID,
+		"display_name": "service account to upload backups from cluster",
+	})
+	doc.AddResource("google_storage_bucket_iam_member", "backup-admin", TFObject{
+		"bucket": TFExpr("google_storage_bucket.backup.name"),
+		"role":   "roles/storage.objectAdmin",
+		"member": "serviceAccount:" + TFExpr("google_service_account.backup.email"),
+	})
+	envs := append([]EnvironmentConfig{DefaultEnvironment}, config.Environments...)
+	for _, env := range envs {
+		name := "backup-workload-identity"
+		if !env.IsDefault() {
+			name = fmt.Sprintf("%s-%s", name, env.Name)
+		}
+		doc.AddResource("google_service_account_iam_member", name, TFObject{
+			"service_account_id": TFExpr("google_service_account.backup.name"),
+			"role":               "roles/iam.workloadIdentityUser",
+			"member":             fmt.Sprintf("serviceAccount:%s.svc.id.goog[%s/%s]", TFExpr("var.gcloud_project"), env.Namespace, BackupKSA),
+		})
+	}
+	return nil
+}
+
+// BackupJobStatus is status of Jobs of the CronJob.
+type BackupJobStatus struct {
+	LastSuccessfulJob  string    `json:"last_successful_job"`
+	LastSuccessfulTime time.Time `json:"last_successful_time"`
+	LastFailedJob      string    `json:"last_failed_job"`
+	LastFailedTime     time.Time `json:"last_failed_time"`
+	Active             int       `json:"active"`
+}
+
+func (status BackupJobStatus) String() string {
+	var b strings.Builder
+	if status.LastSuccessfulJob == "" {
+		b.WriteString("last successful backup: (none)\n")
+	} else {
+		fmt.Fprintf(&b, "last successful backup: %s (%s)\n", status.LastSuccessfulTime.Local().Format(time.RFC3339), status.LastSuccessfulJob)
+	}
+	if status.LastFailedJob != "" {
+		fmt.Fprintf(&b, "last failed backup: %s (%s)\n", status.LastFailedTime.Local().Format(time.RFC3339), status.LastFailedJob)
+	}
+	fmt.Fprintf(&b, "running: %d\n", status.Active)
+	return b.String()
+}
+
+// GetBackupJobStatus summarizes Jobs created by the CronJob in namespace.
+func GetBackupJobStatus(ctx context.Context, client kubernetes.Interface, namespace string) (BackupJobStatus, error) {
+	var status BackupJobStatus
+
+	jobs, e := client.BatchV1().Jobs(namespace).List(ctx, metav1.ListOptions{LabelSelector: "app=" + BackupCronJobName})
+	if e != nil {
+		return status, e
+	}
+	for _, job := range jobs.Items {
+		status.Active += int(job.Status.Active)
+		for _, condition := range job.Status.Conditions {
+			if condition.Status != corev1.ConditionTrue {
+				continue
+			}
+			at := condition.LastTransitionTime.Time
+			switch condition.Type {
+			case batchv1.JobComplete:
+				if at.After(status.LastSuccessfulTime) {
+					status.LastSuccessfulJob, status.LastSuccessfulTime = job.Name, at
+				}
+			case batchv1.JobFailed:
+				if at.After(status.LastFailedTime) {
+					status.LastFailedJob, status.LastFailedTime = job.Name, at
+				}
+			}
+		}
+	}
+	return status, nil
+}
@@ -0,0 +1,447 @@
+package tools
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/option"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestBackupFromAttrs(t *testing.T) {
+	t.Parallel()
+
+	taken := time.Date(2021, 2, 3, 4, 5, 6, 0, time.FixedZone("JST", 9*60*60))
+	name := BackupObjectName("default", taken)
+	if name != "default/postgres/20210202T190506Z.dump" {
+		t.Errorf("unexpected name of backup: %s", name)
+	}
+	backup, ok := backupFromAttrs(&storage.ObjectAttrs{Name: name, Size: 42}, "default")
+	if !ok || !backup.Created.Equal(taken) || backup.Size != 42 {
+		t.Errorf("expected backup taken at %v; got %v", taken, backup)
+	}
+	for _, name := range []string{
+		"default/postgres/",
+		"default/postgres/notes.txt",
+		"default/redis/20210202T190506Z.dump",
+		"default/postgres/yesterday.dump",
+		"community-b/postgres/20210202T190506Z.dump",
+	} {
+		if _, ok := backupFromAttrs(&storage.ObjectAttrs{Name: name}, "default"); ok {
+			t.Errorf("expected %s not to be a backup", name)
+		}
+	}
+}
+
+func TestFindBackup(t *testing.T) {
+	t.Parallel()
+
+	backups := []Backup{}
+	for _, name := range []string{"default/postgres/20210101T000000Z.dump", "default/postgres/20210301T000000Z.dump", "default/postgres/20210201T000000Z.dump"} {
+		backup, _ := backupFromAttrs(&storage.ObjectAttrs{Name: name}, "default")
+		backups = append(backups, backup)
+	}
+	sortBackups(backups)
+
+	if backup, e := FindBackup(backups, "latest"); e != nil || backup.Name != "default/postgres/20210301T000000Z.dump" {
+		t.Errorf("expected the newest backup; got %v %v", backup, e)
+	}
+	if backup, e := FindBackup(backups, "20210101T000000Z"); e != nil || backup.Name != "default/postgres/20210101T000000Z.dump" {
+		t.Errorf("expected backup found by timestamp; got %v %v", backup, e)
+	}
+	if _, e := FindBackup(backups, "20200101T000000Z"); e == nil {
+		t.Errorf("expected error with unknown backup")
+	}
+	if _, e := FindBackup(nil, "latest"); e == nil {
+		t.Errorf("expected error without backups")
+	}
+}
+
+func TestBackupKeep(t *testing.T) {
+	t.Parallel()
+
+	if keep := (Config{}).BackupKeep(); keep != DefaultBackupKeep {
+		t.Errorf("expected default number of backups; got %d", keep)
+	}
+	if keep := (Config{Backup: &BackupConfig{Keep: 7}}).BackupKeep(); keep != 7 {
+		t.Errorf("expected configured number of backups; got %d", keep)
+	}
+}
+
+func TestAddTFBackup(t *testing.T) {
+	t.Parallel()
+
+	doc := TFDocument{}
+	if e := AddTFBackup(&doc, Config{}); e != nil || len(doc.Resource) != 0 {
+		t.Errorf("expected nothing without backup.schedule; got %v %v", doc.Resource, e)
+	}
+	if e := AddTFBackup(&doc, Config{Backup: &BackupConfig{Schedule: "0 4 * * *"}}); e == nil {
+		t.Errorf("expected error without bucket")
+	}
+	if e := AddTFBackup(&doc, Config{Backup: &BackupConfig{Bucket: "automutek8s-backup-example"}}); e != nil {
+		t.Fatal(e)
+	}
+	if len(doc.Resource["google_storage_bucket"]) != 1 || len(doc.Resource["google_service_account"]) != 0 {
+		t.Errorf("expected only bucket without backup.schedule; got %v", doc.Resource)
+	}
+
+	config := Config{
+		Backup:       &BackupConfig{Schedule: "0 4 * * *", Bucket: "automutek8s-backup-example", Keep: 7},
+		Environments: []EnvironmentConfig{prodEnvironment},
+	}
+	if e := AddTFBackup(&doc, config); e != nil {
+		t.Fatal(e)
+	}
+	bucket := doc.Resource["google_storage_bucket"]["backup"]
+	if bucket["name"] != "automutek8s-backup-example" {
+		t.Errorf("expected bucket of backups; got %v", bucket)
+	}
+	if _, ok := bucket["lifecycle_rule"]; ok {
+		t.Errorf("expected backups not to be deleted by age; got %v", bucket)
+	}
+	if admin := doc.Resource["google_storage_bucket_iam_member"]["backup-admin"]; admin["role"] != "roles/storage.objectAdmin" {
+		t.Errorf("expected CronJob to be able to prune backups; got %v", admin)
+	}
+	binding := doc.Resource["google_service_account_iam_member"]["backup-workload-identity-prod"]
+	if binding["member"] != "serviceAccount:${var.gcloud_project}.svc.id.goog[community-b/backup]" {
+		t.Errorf("expected KSA in environment to be bound; got %v", binding)
+	}
+	if !config.WorkloadIdentity() {
+		t.Errorf("expected workload identity to be enabled for backup")
+	}
+}
+
+func TestRenderKustomizationWithBackup(t *testing.T) {
+	t.Parallel()
+
+	config := Config{Backup: &BackupConfig{Schedule: "30 3 * * *", Bucket: "automutek8s-backup-example"}}
+	objs := buildObjects(t, fakeRenderer(config))
+
+	cronJob := mustFindObject(t, objs, "", "CronJob", BackupCronJobName)
+	if schedule, _, _ := unstructured.NestedString(cronJob.Object, "spec", "schedule"); schedule != "30 3 * * *" {
+		t.Errorf("expected schedule of config; got %q", schedule)
+	}
+	pgDump := nestedFirst(t, cronJob.Object, "spec", "jobTemplate", "spec", "template", "spec", "initContainers")
+	if pgDump["image"] != "postgres:12-alpine" {
+		t.Errorf("expected pg_dump of the same version as postgres; got %v", pgDump["image"])
+	}
+	discovery := mustFindObject(t, objs, "", "ConfigMap", "discovery-")
+	if ref, _, _ := unstructured.NestedString(nestedFirst(t, pgDump, "envFrom"), "configMapRef", "name"); ref != discovery.GetName() {
+		t.Errorf("expected discovery to be referred as %s; got %v", discovery.GetName(), ref)
+	}
+
+	backupConfig := mustFindObject(t, objs, "", "ConfigMap", "backup-config-")
+	if bucket, _, _ := unstructured.NestedString(backupConfig.Object, "data", "BACKUP_BUCKET"); bucket != "automutek8s-backup-example" {
+		t.Errorf("expected bucket of config; got %q", bucket)
+	}
+	if keep, _, _ := unstructured.NestedString(backupConfig.Object, "data", "BACKUP_KEEP"); keep != "30" {
+		t.Errorf("expected default number of backups to keep; got %q", keep)
+	}
+	ksa := mustFindObject(t, objs, "", "ServiceAccount", BackupKSA)
+	if ksa.GetAnnotations()["iam.gke.io/gcp-service-account"] != "automutek8s-backup@project.iam.gserviceaccount.com" {
+		t.Errorf("expected KSA to be annotated; got %v", ksa.GetAnnotations())
+	}
+}
+
+func TestRenderKustomizationWithBackupOfManagedCache(t *testing.T) {
+	t.Parallel()
+
+	config := Config{
+		Backup: &BackupConfig{Schedule: "30 3 * * *", Bucket: "automutek8s-backup-example"},
+		Cache:  &CacheConfig{Mode: CacheMemorystore},
+	}
+	objs := buildObjects(t, fakeRenderer(config))
+
+	cronJob := mustFindObject(t, objs, "", "CronJob", BackupCronJobName)
+	initContainers, _, _ := unstructured.NestedFieldNoCopy(cronJob.Object, "spec", "jobTemplate", "spec", "template", "spec", "initContainers")
+	containers, ok := initContainers.([]interface{})
+	if !ok || len(containers) != 1 {
+		t.Fatalf("expected only pg-dump with Memorystore; got %v", initContainers)
+	}
+	if pgDump, ok := containers[0].(map[string]interface{}); !ok || pgDump["name"] != "pg-dump" {
+		t.Errorf("expected only pg-dump with Memorystore; got %v", containers[0])
+	}
+}
+
+func TestGetBackupJobStatus(t *testing.T) {
+	t.Parallel()
+
+	at := func(hour int) metav1.Time {
+		return metav1.NewTime(time.Date(2021, 2, 3, hour, 0, 0, 0, time.UTC))
+	}
+	job := func(name string, condition batchv1.JobConditionType, hour int) *batchv1.Job {
+		return &batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Labels: map[string]string{"app": BackupCronJobName}},
+			Status: batchv1.JobStatus{Conditions: []batchv1.JobCondition{
+				{Type: condition, Status: corev1.ConditionTrue, LastTransitionTime: at(hour)},
+			}},
+		}
+	}
+	client := fake.NewSimpleClientset(
+		job("backup-1", batchv1.JobComplete, 1),
+		job("backup-2", batchv1.JobComplete, 2),
+		job("backup-3", batchv1.JobFailed, 3),
+	)
+
+	status, e := GetBackupJobStatus(context.Background(), client, "default")
+	if e != nil {
+		t.Fatal(e)
+	}
+	if status.LastSuccessfulJob != "backup-2" || status.LastFailedJob != "backup-3" {
+		t.Errorf("expected backup-2 to be the last successful run; got %+v", status)
+	}
+}
+
+// fakeStorage serves objects of a bucket in memory through JSON API and XML API,
+// as far as storage.Client uses them for backups.
+type fakeStorage struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func newFakeBucket(t *testing.T, objects map[string][]byte) (*fakeStorage, *storage.BucketHandle) {
+	fake := &fakeStorage{objects: objects}
+	if fake.objects == nil {
+		fake.objects = map[string][]byte{}
+	}
+	client, e := storage.NewClient(context.Background(), option.WithHTTPClient(&http.Client{Transport: fake}))
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Cleanup(func() { client.Close() })
+	return fake, client.Bucket("backup")
+}
+
+func (fake *fakeStorage) names() []string {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	names := make([]string, 0, len(fake.objects))
+	for name := range fake.objects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (fake *fakeStorage) RoundTrip(r *http.Request) (*http.Response, error) {
+	const objectsPath = "/storage/v1/b/backup/o"
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/upload"+objectsPath:
+		return fake.upload(r)
+	case r.Method == http.MethodGet && r.URL.Path == objectsPath:
+		return fake.list(r)
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, objectsPath+"/"):
+		return fake.delete(strings.TrimPrefix(r.URL.Path, objectsPath+"/"))
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/backup/"):
+		return fake.read(strings.TrimPrefix(r.URL.Path, "/backup/"))
+	}
+	return nil, fmt.Errorf("unexpected request: %s %s", r.Method, r.URL)
+}
+
+func (fake *fakeStorage) upload(r *http.Request) (*http.Response, error) {
+	_, params, e := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if e != nil {
+		return nil, e
+	}
+	parts := multipart.NewReader(r.Body, params["boundary"])
+	var attrs struct {
+		Name string `json:"name"`
+	}
+	part, e := parts.NextPart()
+	if e != nil {
+		return nil, e
+	}
+	if e := json.NewDecoder(part).Decode(&attrs); e != nil {
+		return nil, e
+	}
+	part, e = parts.NextPart()
+	if e != nil {
+		return nil, e
+	}
+	content, e := ioutil.ReadAll(part)
+	if e != nil {
+		return nil, e
+	}
+	if e := r.Context().Err(); e != nil {
+		return nil, e
+	}
+
+	fake.mu.Lock()
+	fake.objects[attrs.Name] = content
+	fake.mu.Unlock()
+	return jsonResponse(fake.resource(attrs.Name, content))
+}
+
+func (fake *fakeStorage) list(r *http.Request) (*http.Response, error) {
+	items := make([]map[string]string, 0)
+	for _, name := range fake.names() {
+		if strings.HasPrefix(name, r.URL.Query().Get("prefix")) {
+			fake.mu.Lock()
+			items = append(items, fake.resource(name, fake.objects[name]))
+			fake.mu.Unlock()
+		}
+	}
+	return jsonResponse(map[string]interface{}{"kind": "storage#objects", "items": items})
+}
+
+func (fake *fakeStorage) delete(name string) (*http.Response, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if _, ok := fake.objects[name]; !ok {
+		return &http.Response{StatusCode: http.StatusNotFound, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+	}
+	delete(fake.objects, name)
+	return &http.Response{StatusCode: http.StatusNoContent, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+}
+
+func (fake *fakeStorage) read(name string) (*http.Response, error) {
+	fake.mu.Lock()
+	content, ok := fake.objects[name]
+	fake.mu.Unlock()
+	if !ok {
+		return &http.Response{StatusCode: http.StatusNotFound, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+	}
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{},
+		ContentLength: int64(len(content)),
+		Body:          ioutil.NopCloser(bytes.NewReader(content)),
+	}, nil
+}
+
+func (fake *fakeStorage) resource(name string, content []byte) map[string]string {
+	return map[string]string{"kind": "storage#object", "bucket": "backup", "name": name, "size": fmt.Sprint(len(content))}
+}
+
+func jsonResponse(body interface{}) (*http.Response, error) {
+	content, e := json.Marshal(body)
+	if e != nil {
+		return nil, e
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       ioutil.NopCloser(bytes.NewReader(content)),
+	}, nil
+}
+
+func TestBackupPostgres(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	fake, bucket := newFakeBucket(t, nil)
+	now := time.Date(2021, 2, 3, 4, 5, 6, 0, time.UTC)
+
+	exec := func(ctx context.Context, command []string, stdin io.Reader, stdout io.Writer) error {
+		if !reflect.DeepEqual(command, PgDumpCommand) {
+			t.Errorf("expected pg_dump; got %v", command)
+		}
+		_, e := stdout.Write([]byte("dump"))
+		return e
+	}
+	backup, e := BackupPostgres(ctx, exec, bucket, "community-b", now)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if backup.Name != "community-b/postgres/20210203T040506Z.dump" || backup.Size != 4 || !backup.Created.Equal(now) {
+		t.Errorf("expected backup of the namespace; got %v", backup)
+	}
+	if content := fake.objects[backup.Name]; string(content) != "dump" {
+		t.Errorf("expected dump to be uploaded; got %q", content)
+	}
+
+	failing := func(ctx context.Context, command []string, stdin io.Reader, stdout io.Writer) error {
+		stdout.Write([]byte("du"))
+		return fmt.Errorf("pg_dump: connection refused")
+	}
+	if _, e := BackupPostgres(ctx, failing, bucket, "community-b", now.Add(time.Hour)); e == nil {
+		t.Errorf("expected error when pg_dump fails")
+	}
+	if names := fake.names(); len(names) != 1 {
+		t.Errorf("expected broken dump not to be uploaded; got %v", names)
+	}
+}
+
+func TestRestorePostgres(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	name := "default/postgres/20210203T040506Z.dump"
+	_, bucket := newFakeBucket(t, map[string][]byte{name: []byte("dump")})
+
+	var restored []byte
+	exec := func(ctx context.Context, command []string, stdin io.Reader, stdout io.Writer) error {
+		if !reflect.DeepEqual(command, PgRestoreCommand) {
+			t.Errorf("expected pg_restore; got %v", command)
+		}
+		var e error
+		restored, e = ioutil.ReadAll(stdin)
+		return e
+	}
+	if e := RestorePostgres(ctx, exec, bucket, Backup{Name: name}); e != nil {
+		t.Fatal(e)
+	}
+	if string(restored) != "dump" {
+		t.Errorf("expected dump to be streamed to pg_restore; got %q", restored)
+	}
+
+	failing := func(ctx context.Context, command []string, stdin io.Reader, stdout io.Writer) error {
+		return fmt.Errorf("pg_restore: error")
+	}
+	if e := RestorePostgres(ctx, failing, bucket, Backup{Name: name}); e == nil {
+		t.Errorf("expected error when pg_restore fails")
+	}
+	if e := RestorePostgres(ctx, exec, bucket, Backup{Name: "default/postgres/20200101T000000Z.dump"}); e == nil {
+		t.Errorf("expected error with missing backup")
+	}
+}
+
+func TestPruneBackups(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	fake, bucket := newFakeBucket(t, map[string][]byte{
+		"default/postgres/20210101T000000Z.dump":     []byte("1"),
+		"default/postgres/20210201T000000Z.dump":     []byte("2"),
+		"default/postgres/20210301T000000Z.dump":     []byte("3"),
+		"community-b/postgres/20200101T000000Z.dump": []byte("b"),
+	})
+
+	pruned, e := PruneBackups(ctx, bucket, "default", 2)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(pruned) != 1 || pruned[0].Name != "default/postgres/20210101T000000Z.dump" {
+		t.Errorf("expected the oldest backup to be pruned; got %v", pruned)
+	}
+	expected := []string{
+		"community-b/postgres/20200101T000000Z.dump",
+		"default/postgres/20210201T000000Z.dump",
+		"default/postgres/20210301T000000Z.dump",
+	}
+	if names := fake.names(); !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected newest backups and ones of other namespace to be kept; got %v", names)
+	}
+
+	if pruned, e := PruneBackups(ctx, bucket, "community-b", 2); e != nil || len(pruned) != 0 {
+		t.Errorf("expected nothing to be pruned however old backups are; got %v %v", pruned, e)
+	}
+}
@@ -0,0 +1,127 @@
+package tools
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// BudgetConfig is schema of budget block in config.yaml
+type BudgetConfig struct {
+	Amount             int64     `json:"amount"`
+	Currency           string    `json:"currency"`
+	Thresholds         []float64 `json:"thresholds"`
+	NotificationEmails []string  `json:"notification_emails"`
+	PubsubTopic        string    `json:"pubsub_topic"`
+}
+
+var defaultBudgetThresholds = []float64{0.5, 0.9, 1.0}
+
+var currencyCodeRegexp = regexp.MustCompile(`\A[A-Z]{3}\z`)
+
+// Validate checks budget block is well-formed.
+func (budget BudgetConfig) Validate() error {
+	if budget.Amount <= 0 {
+		return fmt.Errorf("amount of budget should be positive: %d", budget.Amount)
+	}
+	if !currencyCodeRegexp.MatchString(budget.Currency) {
+		return fmt.Errorf("currency of budget should be ISO 4217 code: %s", budget.Currency)
+	}
+	for _, threshold := range budget.Thresholds {
+		if threshold <= 0 {
+			return fmt.Errorf("threshold of budget should be positive: %g", threshold)
+		}
+	}
+	return nil
+}
+
+// AddTFBudget adds monthly budget bound to billingAccount and
+// its notification channels to doc.
+// Nothing will be added unless budget block is configured.
+func AddTFBudget(doc *TFDocument, config Config, billingAccount string) error {
+	if config.Budget == nil {
+		return nil
+	}
+	budget := *config.Budget
+	if e := budget.Validate(); e != nil {
+		return e
+	}
+
+	thresholds := budget.Thresholds
+	if len(thresholds) == 0 {
+		thresholds = defaultBudgetThresholds
+	}
+
+	doc.Variable["billing_account"] = TFVariable{
+		Default: billingAccount,
+	}
+
+	doc.AddResource("google_project_service", "billingbudgets", TFObject{
+		"project":            TFExpr("var.gcloud_project"),
+		"service":            "billingbudgets.googleapis.com",
+		"disable_on_destroy": false,
+	})
+	doc.AddData("google_project", "project", TFObject{
+		"project_id": TFExpr("var.gcloud_project"),
+	})
+
+	thresholdRules := make([]TFObject, 0, len(thresholds))
+	for _, threshold := range thresholds {
+		thresholdRules = append(thresholdRules, TFObject{
+			"threshold_percent": threshold,
+		})
+	}
+
+	channels := make([]string, 0, len(budget.NotificationEmails))
+	for i, email := range budget.NotificationEmails {
+		name := fmt.Sprintf("budget-email-%d", i)
+		doc.AddResource("google_monitoring_notification_channel", name, TFObject{
+			"display_name": fmt.Sprintf("automutek8s budget alert to %s", email),
+			"type":         "email",
+			"labels": TFObject{
+				"email_address": email,
+			},
+		})
+		channels = append(channels, TFExpr("google_monitoring_notification_channel.%s.name", name))
+	}
+
+	allUpdatesRule := TFObject{
+		"monitoring_notification_channels": channels,
+	}
+
+	if budget.PubsubTopic != "" {
+		doc.AddResource("google_project_service", "pubsub", TFObject{
+			"project":            TFExpr("var.gcloud_project"),
+			"service":            "pubsub.googleapis.com",
+			"disable_on_destroy": false,
+		})
+		doc.AddResource("google_pubsub_topic", "budget", TFObject{
+			"depends_on": []string{"google_project_service.pubsub"},
+			"name":       budget.PubsubTopic,
+		})
+		allUpdatesRule["pubsub_topic"] = TFExpr("google_pubsub_topic.budget.id")
+	}
+
+	resource := TFObject{
+		"depends_on":      []string{"google_project_service.billingbudgets"},
+		"billing_account": TFExpr("var.billing_account"),
+		"display_name":    fmt.Sprintf("automutek8s %s", config.Cluster.Name),
+		"budget_filter": TFObject{
+			"projects": []string{"projects/" + TFExpr("data.google_project.project.number")},
+		},
+		"amount": TFObject{
+			"specified_amount": TFObject{
+				"currency_code": budget.Currency,
+				"units":         strconv.FormatInt(budget.Amount, 10),
+			},
+		},
+		"threshold_rules": thresholdRules,
+	}
+	// Billing Budget API rejects all_updates_rule without any destination.
+	if len(channels) > 0 || budget.PubsubTopic != "" {
+		resource["all_updates_rule"] = allUpdatesRule
+	}
+	doc.AddResource("google_billing_budget", "budget", resource)
+
+	return nil
+}
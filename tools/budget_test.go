@@ -0,0 +1,60 @@
+package tools
+
+import (
+	"testing"
+)
+
+func TestAddTFBudget(t *testing.T) {
+	t.Parallel()
+
+	var config Config
+	doc := TFDocument{Variable: map[string]TFVariable{}}
+	if e := AddTFBudget(&doc, config, "000000-000000-000000"); e != nil {
+		t.Fatalf("expected no error without budget; got %v", e)
+	}
+	if len(doc.Resource) != 0 {
+		t.Errorf("expected nothing to be added without budget; got %v", doc.Resource)
+	}
+
+	config.Budget = &BudgetConfig{Amount: 3000, Currency: "jpy"}
+	if e := AddTFBudget(&doc, config, "000000-000000-000000"); e == nil {
+		t.Errorf("expected error for malformed currency")
+	}
+
+	config.Budget = &BudgetConfig{
+		Amount:             3000,
+		Currency:           "JPY",
+		NotificationEmails: []string{"you@example.com"},
+		PubsubTopic:        "automutek8s-budget",
+	}
+	if e := AddTFBudget(&doc, config, "000000-000000-000000"); e != nil {
+		t.Fatalf("expected no error; got %v", e)
+	}
+	if doc.Variable["billing_account"].Default != "000000-000000-000000" {
+		t.Errorf("expected billing_account to be emitted; got %v", doc.Variable)
+	}
+
+	budget, ok := doc.Resource["google_billing_budget"]["budget"]
+	if !ok {
+		t.Fatalf("expected google_billing_budget to be emitted; got %v", doc.Resource)
+	}
+	if rules := budget["threshold_rules"].([]TFObject); len(rules) != len(defaultBudgetThresholds) {
+		t.Errorf("expected default thresholds; got %v", rules)
+	}
+	updates := budget["all_updates_rule"].(TFObject)
+	if updates["pubsub_topic"] != "${google_pubsub_topic.budget.id}" {
+		t.Errorf("unexpected pubsub_topic: %v", updates["pubsub_topic"])
+	}
+	if channels := updates["monitoring_notification_channels"].([]string); len(channels) != 1 {
+		t.Errorf("expected one notification channel; got %v", channels)
+	}
+
+	config.Budget = &BudgetConfig{Amount: 3000, Currency: "JPY"}
+	doc = TFDocument{Variable: map[string]TFVariable{}}
+	if e := AddTFBudget(&doc, config, "000000-000000-000000"); e != nil {
+		t.Fatal(e)
+	}
+	if updates, ok := doc.Resource["google_billing_budget"]["budget"]["all_updates_rule"]; ok {
+		t.Errorf("expected all_updates_rule to be omitted without channels and topic; got %v", updates)
+	}
+}
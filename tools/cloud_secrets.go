@@ -5,6 +5,8 @@ import (
 	"crypto/sha256"
 	"fmt"
 	"log"
+	"sort"
+	"strings"
 
 	"encoding/hex"
 
@@ -15,32 +17,58 @@ import (
 
 // SecretHandle hols information that points to
 // the secret data which managed by cloud secret manager.
+// Secrets in default namespace keep the cloud secret names
+// they had before Namespace was introduced.
 type SecretHandle struct {
+	Namespace    string
 	MetadataName string
 	Key          string
 }
 
-// NewSecretHandles builds SecretHandles from k8s Secret.
+// ParseSecretName splits "namespace/name" into namespace and name.
+// Namespace is empty if name has no namespace.
+func ParseSecretName(name string) (string, string) {
+	if i := strings.Index(name, "/"); i >= 0 {
+		return name[:i], name[i+1:]
+	}
+	return "", name
+}
+
+// NewSecretHandles builds SecretHandles from k8s Secret, sorted by key.
 func NewSecretHandles(secret corev1.Secret) []SecretHandle {
 	handles := make([]SecretHandle, 0)
 
 	for key := range secret.Data {
 		handle := SecretHandle{
+			Namespace:    secret.Namespace,
 			MetadataName: secret.Name,
 			Key:          key,
 		}
 		handles = append(handles, handle)
 	}
+	sort.Slice(handles, func(i, j int) bool { return handles[i].Key < handles[j].Key })
 
 	return handles
 }
 
+// namespace returns namespace of the secret, or empty for default namespace.
+func (handle SecretHandle) namespace() string {
+	if handle.Namespace == "default" {
+		return ""
+	}
+	return handle.Namespace
+}
+
 func (handle SecretHandle) buildCloudSecretLabels() map[string]string {
-	return map[string]string{
+	labels := map[string]string{
 		"automutek8s":       "v1",
 		"k8s-metadata-name": handle.MetadataName,
 		"key":               handle.Key,
 	}
+	if handle.namespace() != "" {
+		labels["k8s-namespace"] = handle.namespace()
+	}
+	return labels
 }
 
 func (handle SecretHandle) buildCloudSecretParentPath(ctx context.Context) (string, error) {
@@ -56,6 +84,9 @@ func (handle SecretHandle) buildCloudSecretName(ctx context.Context) (string, er
 	if !IsValidK8sMetadataName(handle.MetadataName) {
 		return "", fmt.Errorf("invalid name for Kubernates Secret: %s", handle.MetadataName)
 	}
+	if handle.Namespace != "" && !IsValidK8sMetadataName(handle.Namespace) {
+		return "", fmt.Errorf("invalid name for Kubernates Namespace: %s", handle.Namespace)
+	}
 	if len(handle.Key) <= 0 {
 		return "", fmt.Errorf("key name cannot be empty")
 	}
@@ -92,6 +123,9 @@ func (handle SecretHandle) buildCloudSecretVersionPath(ctx context.Context, vers
 }
 
 func (handle SecretHandle) String() string {
+	if handle.namespace() != "" {
+		return fmt.Sprintf("%v/%v %v", handle.namespace(), handle.MetadataName, handle.Key)
+	}
 	return fmt.Sprintf("%v %v", handle.MetadataName, handle.Key)
 }
 
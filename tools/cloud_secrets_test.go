@@ -0,0 +1,56 @@
+package tools
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestSecretHandleNamespace(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	legacy, e := SecretHandle{MetadataName: "postgres", Key: "POSTGRES_PASSWORD"}.buildCloudSecretName(ctx)
+	if e != nil {
+		t.Fatal(e)
+	}
+	// sha256 of "postgres POSTGRES_PASSWORD", as named before namespaces were introduced.
+	if legacy != "automutek8s_6984c03303cb993f36353c3a930c751fd257fd1ee47c582715e1a518c9808930" {
+		t.Errorf("unexpected cloud secret name: %s", legacy)
+	}
+
+	inDefault, _ := SecretHandle{Namespace: "default", MetadataName: "postgres", Key: "POSTGRES_PASSWORD"}.buildCloudSecretName(ctx)
+	if inDefault != legacy {
+		t.Errorf("expected secret in default namespace to keep its name %s; got %s", legacy, inDefault)
+	}
+	inTenant, _ := SecretHandle{Namespace: "tenant-alpha", MetadataName: "postgres", Key: "POSTGRES_PASSWORD"}.buildCloudSecretName(ctx)
+	if inTenant == legacy {
+		t.Errorf("expected secret in another namespace not to collide")
+	}
+	if _, e := (SecretHandle{Namespace: "tenant_alpha", MetadataName: "postgres", Key: "POSTGRES_PASSWORD"}).buildCloudSecretName(ctx); e == nil {
+		t.Errorf("expected error with invalid namespace")
+	}
+}
+
+func TestNewSecretHandlesWithNamespace(t *testing.T) {
+	t.Parallel()
+
+	secret := corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "discordbot", Namespace: "tenant-alpha"},
+		Data:       map[string][]byte{"DISCORD_BOT_TOKEN": nil},
+	}
+	handles := NewSecretHandles(secret)
+	if len(handles) != 1 || handles[0].String() != "tenant-alpha/discordbot DISCORD_BOT_TOKEN" {
+		t.Errorf("expected handle in namespace of the manifest; got %v", handles)
+	}
+
+	namespace, name := ParseSecretName("tenant-alpha/discordbot")
+	if namespace != "tenant-alpha" || name != "discordbot" {
+		t.Errorf("unexpected namespace and name: %s %s", namespace, name)
+	}
+	if namespace, name = ParseSecretName("discordbot"); namespace != "" || name != "discordbot" {
+		t.Errorf("unexpected namespace and name: %s %s", namespace, name)
+	}
+}
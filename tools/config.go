@@ -2,35 +2,52 @@ package tools
 
 import (
 	"context"
-	"fmt"
-	"strings"
+	"log"
 
 	"google.golang.org/api/compute/v1"
 )
 
 // Config is schema of config.yaml
 type Config struct {
-	Region  string        `json:"region"`
-	Zone    string        `json:"zone"`
-	Cluster ClusterConfig `json:"cluster"`
-	Network NetworkConfig `json:"network"`
-	Gate    GateConfig    `json:"gate"`
+	Region             string                    `json:"region"`
+	Zone               string                    `json:"zone"`
+	Cluster            ClusterConfig             `json:"cluster"`
+	Network            NetworkConfig             `json:"network"`
+	Gate               GateConfig                `json:"gate"`
+	NodePoolConfigs    []NodePoolConfig          `json:"node_pools"`
+	ClusterAutoscaling *ClusterAutoscalingConfig `json:"cluster_autoscaling"`
+	Budget             *BudgetConfig             `json:"budget"`
+	Schedule           *ScheduleConfig           `json:"schedule"`
+	Discord            *DiscordConfig            `json:"discord"`
+	SecretSync         *SecretSyncConfig         `json:"secret_sync"`
+	Environments       []EnvironmentConfig       `json:"environments"`
+	Tenants            []TenantConfig            `json:"tenants"`
+	Backup             *BackupConfig             `json:"backup"`
+	Snapshots          *SnapshotConfig           `json:"snapshots"`
+	Database           *DatabaseConfig           `json:"database"`
+	Cache              *CacheConfig              `json:"cache"`
 }
 
 func (Config) ProjectID() (string, error) {
 	return GetProjectID(context.Background())
 }
 
-func (config Config) RegionID() (string, error) {
-	region := config.Region
-	if strings.HasPrefix(region, "asia-northeast") {
-		return "an", nil
+// IngressIP returns IP address reserved for broker service.
+// terraform state is preferred; Compute API is used when
+// the state is unavailable.
+func (config Config) IngressIP() (string, error) {
+	outputs, e := GetTFOutputs()
+	if e != nil {
+		log.Printf("looking up ingress IP with Compute API: %v", e)
+	} else if outputs.IngressIP != "" {
+		return outputs.IngressIP, nil
 	}
 
-	return "", fmt.Errorf("unknown region for GAE Region ID: %s", region)
+	return config.lookupAddress(config.Network.IngressIPResourceID)
 }
 
-func (config Config) IngressIP() (string, error) {
+// lookupAddress returns IP address of the address resource in the region with Compute API.
+func (config Config) lookupAddress(resourceID string) (string, error) {
 	projectID, e := config.ProjectID()
 	if e != nil {
 		return "", e
@@ -41,7 +58,7 @@ func (config Config) IngressIP() (string, error) {
 		return "", e
 	}
 
-	addr, e := service.Addresses.Get(projectID, config.Region, config.Network.IngressIPResourceID).Do()
+	addr, e := service.Addresses.Get(projectID, config.Region, resourceID).Do()
 	if e != nil {
 		return "", e
 	}
@@ -49,6 +66,20 @@ func (config Config) IngressIP() (string, error) {
 	return addr.Address, nil
 }
 
+// ClusterNameAndLocation returns name and location of the GKE cluster.
+// terraform state is preferred; config.yaml is used when
+// the state is unavailable.
+func (config Config) ClusterNameAndLocation() (string, string) {
+	outputs, e := GetTFOutputs()
+	if e != nil {
+		log.Printf("using cluster in config.yaml: %v", e)
+	} else if outputs.ClusterName != "" && outputs.ClusterLocation != "" {
+		return outputs.ClusterName, outputs.ClusterLocation
+	}
+
+	return config.Cluster.Name, config.Cluster.Location
+}
+
 // ClusterConfig is schema of cluster block in config.yaml
 type ClusterConfig struct {
 	Name             string `json:"name"`
@@ -68,5 +99,11 @@ type NetworkConfig struct {
 
 // GateConfig is schema of gate block in config.yaml
 type GateConfig struct {
-	ServiceID string `json:"service_id"`
+	ServiceID     string `json:"service_id"`
+	Environment   string `json:"environment"`
+	InstanceClass string `json:"instance_class"`
+	MaxInstances  int    `json:"max_instances"`
+	GalactusAddr  string `json:"galactus_addr"`
+	Wake          bool   `json:"wake"`
+	IdleMinutes   int    `json:"idle_minutes"`
 }
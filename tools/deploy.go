@@ -0,0 +1,136 @@
+package tools
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+
+	goyaml "gopkg.in/yaml.v2"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/kustomize/api/filesys"
+	"sigs.k8s.io/kustomize/api/krusty"
+	kustomize "sigs.k8s.io/kustomize/api/types"
+)
+
+// overlayFs is file system on disk with some files replaced by ones in memory,
+// which are never written to disk.
+type overlayFs struct {
+	filesys.FileSystem
+	files map[string][]byte
+}
+
+func (fs overlayFs) Exists(path string) bool {
+	if _, ok := fs.files[path]; ok {
+		return true
+	}
+	return fs.isDirInMemory(path) || fs.FileSystem.Exists(path)
+}
+
+// isDirInMemory returns true if path is directory of files in memory.
+func (fs overlayFs) isDirInMemory(path string) bool {
+	for file := range fs.files {
+		if filepath.Dir(file) == path {
+			return true
+		}
+	}
+	return false
+}
+
+func (fs overlayFs) IsDir(path string) bool {
+	return fs.isDirInMemory(path) || fs.FileSystem.IsDir(path)
+}
+
+func (fs overlayFs) ReadFile(path string) ([]byte, error) {
+	if content, ok := fs.files[path]; ok {
+		return content, nil
+	}
+	return fs.FileSystem.ReadFile(path)
+}
+
+// CleanedAbs confirms parent directory of files in memory on disk,
+// as they don't exist there. Directories of files in memory,
+// which may not exist on disk either, are confirmed as they are.
+func (fs overlayFs) CleanedAbs(path string) (filesys.ConfirmedDir, string, error) {
+	if fs.isDirInMemory(path) {
+		return filesys.ConfirmedDir(path), "", nil
+	}
+	if _, ok := fs.files[path]; ok {
+		dir, _, e := fs.CleanedAbs(filepath.Dir(path))
+		return dir, filepath.Base(path), e
+	}
+	return fs.FileSystem.CleanedAbs(path)
+}
+
+func build(fs filesys.FileSystem, dir string) ([]*unstructured.Unstructured, error) {
+	options := krusty.MakeDefaultOptions()
+	options.DoLegacyResourceSort = true
+
+	resources, e := krusty.MakeKustomizer(fs, options).Run(dir)
+	if e != nil {
+		return nil, e
+	}
+
+	objs := make([]*unstructured.Unstructured, 0, resources.Size())
+	for _, resource := range resources.Resources() {
+		objs = append(objs, &unstructured.Unstructured{Object: resource.Map()})
+	}
+	return objs, nil
+}
+
+// BuildKustomization builds kustomization in dir in-process,
+// as `kustomize build` does, in the order kubectl would apply.
+func BuildKustomization(dir string) ([]*unstructured.Unstructured, error) {
+	return build(filesys.MakeFsOnDisk(), dir)
+}
+
+// BuildKustomizationInMemory builds k as kustomization.yaml in dir,
+// without writing it to disk, so that secrets in it never touch disk.
+func BuildKustomizationInMemory(dir string, k kustomize.Kustomization) ([]*unstructured.Unstructured, error) {
+	return BuildKustomizationWithOverlays(dir, k, nil)
+}
+
+// BuildKustomizationWithOverlays builds k as BuildKustomizationInMemory does,
+// with overlays in memory as well. Keys of overlays are their paths relative to dir.
+// Read-only tasks like `mage diff` use it not to write overlays to disk.
+func BuildKustomizationWithOverlays(dir string, k kustomize.Kustomization, overlays map[string]kustomize.Kustomization) ([]*unstructured.Unstructured, error) {
+	abs, e := filepath.Abs(dir)
+	if e != nil {
+		return nil, e
+	}
+	abs, e = filepath.EvalSymlinks(abs)
+	if e != nil {
+		return nil, e
+	}
+
+	files := map[string][]byte{}
+	for path, overlay := range overlays {
+		content, e := goyaml.Marshal(overlay)
+		if e != nil {
+			return nil, e
+		}
+		files[filepath.Join(abs, path, "kustomization.yaml")] = content
+	}
+	content, e := goyaml.Marshal(k)
+	if e != nil {
+		return nil, e
+	}
+	files[filepath.Join(abs, "kustomization.yaml")] = content
+
+	fs := overlayFs{
+		FileSystem: filesys.MakeFsOnDisk(),
+		files:      files,
+	}
+	return build(fs, abs)
+}
+
+// IsGitIgnored returns true if git ignores path.
+func IsGitIgnored(path string) (bool, error) {
+	e := exec.Command("git", "check-ignore", "-q", path).Run()
+	if e == nil {
+		return true, nil
+	}
+	if exitErr, ok := e.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+		return false, nil
+	}
+	return false, fmt.Errorf("failed to invoke git check-ignore: %v", e)
+}
@@ -0,0 +1,73 @@
+package tools
+
+import (
+	"testing"
+
+	kustomize "sigs.k8s.io/kustomize/api/types"
+)
+
+func TestBuildKustomization(t *testing.T) {
+	t.Parallel()
+
+	objs, e := BuildKustomization("../kubernetes/base")
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	kinds := map[string]int{}
+	for i, obj := range objs {
+		kinds[obj.GetKind()] = i
+	}
+	for _, kind := range []string{"ConfigMap", "Service", "Deployment", "StatefulSet"} {
+		if _, ok := kinds[kind]; !ok {
+			t.Errorf("expected %s to be built; got %v", kind, kinds)
+		}
+	}
+	if kinds["ConfigMap"] > kinds["Deployment"] {
+		t.Errorf("expected ConfigMap to be applied before Deployment; got %v", kinds)
+	}
+}
+
+func TestBuildKustomizationInMemory(t *testing.T) {
+	t.Parallel()
+
+	k := kustomize.Kustomization{
+		Resources: []string{"./services/redis.yaml"},
+		SecretGenerator: []kustomize.SecretArgs{{
+			GeneratorArgs: kustomize.GeneratorArgs{
+				Name:     "redis",
+				Behavior: "create",
+				KvPairSources: kustomize.KvPairSources{
+					LiteralSources: []string{"REDIS_PASSWORD=in-memory"},
+				},
+			},
+		}},
+	}
+
+	objs, e := BuildKustomizationInMemory("../kubernetes/base", k)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(objs) != 2 {
+		t.Fatalf("expected secret and service to be built from kustomization in memory; got %d objects", len(objs))
+	}
+	if objs[0].GetKind() != "Secret" || objs[1].GetKind() != "Service" {
+		t.Errorf("expected secret and service; got %s and %s", objs[0].GetKind(), objs[1].GetKind())
+	}
+}
+
+func TestBuildKustomizationInMemoryWithoutFileOnDisk(t *testing.T) {
+	t.Parallel()
+
+	k := kustomize.Kustomization{
+		Resources: []string{"./redis.yaml"},
+	}
+
+	objs, e := BuildKustomizationInMemory("../kubernetes/base/services", k)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(objs) != 1 || objs[0].GetKind() != "Service" {
+		t.Errorf("expected service to be built; got %v", objs)
+	}
+}
@@ -0,0 +1,160 @@
+package tools
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	goyaml "gopkg.in/yaml.v2"
+)
+
+// DiscordMain is package path of the slash command service deployed to App Engine.
+const DiscordMain = "./cmd/discord"
+
+// DiscordAppYaml is path of app.yaml for the slash command service.
+const DiscordAppYaml = "discord.yaml"
+
+// DiscordBotToken is the secret holding bot token of the Discord application,
+// which is used to register slash commands.
+var DiscordBotToken = SecretHandle{
+	MetadataName: "discord-commands",
+	Key:          "DISCORD_BOT_TOKEN",
+}
+
+// DiscordConfig is schema of discord block in config.yaml
+type DiscordConfig struct {
+	ServiceID     string   `json:"service_id"`
+	ApplicationID string   `json:"application_id"`
+	PublicKey     string   `json:"public_key"`
+	AllowedRoles  []string `json:"allowed_roles"`
+	InstanceClass string   `json:"instance_class"`
+}
+
+// Validate checks discord block has what the service needs.
+func (discord DiscordConfig) Validate() error {
+	if discord.ServiceID == "" {
+		return fmt.Errorf("discord: service_id is required")
+	}
+	if discord.ApplicationID == "" || discord.PublicKey == "" {
+		return fmt.Errorf("discord: application_id and public_key are required")
+	}
+	if len(discord.AllowedRoles) == 0 {
+		return fmt.Errorf("discord: allowed_roles is required to start or stop the stack")
+	}
+	return nil
+}
+
+// RenderDiscordAppYaml writes app.yaml to deploy the slash command service
+// to App Engine standard environment.
+// Basic scaling keeps the instance alive while the stack is starting
+// after the interaction is responded.
+func RenderDiscordAppYaml(out io.Writer, config Config, projectID string) error {
+	if config.Discord == nil {
+		return fmt.Errorf("discord block is not in config.yaml")
+	}
+	discord := *config.Discord
+	if e := discord.Validate(); e != nil {
+		return e
+	}
+
+	instanceClass := discord.InstanceClass
+	if instanceClass == "" {
+		instanceClass = "B1"
+	}
+
+	pool := config.NodePools()[0]
+	nodeCount := pool.MinNodes
+	if nodeCount < 1 {
+		nodeCount = 1
+	}
+
+	app := appYaml{
+		Runtime:       GAERuntime,
+		Main:          DiscordMain,
+		InstanceClass: instanceClass,
+		BasicScaling: map[string]interface{}{
+			"max_instances": 1,
+			"idle_timeout":  "20m",
+		},
+		Service:        discord.ServiceID,
+		ServiceAccount: GateServiceAccountEmail(projectID),
+		EnvVariables: map[string]string{
+			"DISCORD_PUBLIC_KEY":       discord.PublicKey,
+			"DISCORD_ALLOWED_ROLES":    strings.Join(discord.AllowedRoles, ","),
+			"DISCORD_PROJECT_ID":       projectID,
+			"DISCORD_CLUSTER_NAME":     config.Cluster.Name,
+			"DISCORD_CLUSTER_LOCATION": config.Cluster.Location,
+			"DISCORD_NODE_POOL":        pool.Name,
+			"DISCORD_NODE_COUNT":       strconv.Itoa(nodeCount),
+			"DISCORD_KEEP_POSTGRES":    strconv.FormatBool(config.KeepsPostgres(DefaultEnvironment)),
+		},
+		Handlers: []map[string]string{
+			{
+				"url":    "/.*",
+				"script": "auto",
+				"secure": "always",
+			},
+		},
+	}
+
+	return goyaml.NewEncoder(out).Encode(app)
+}
+
+type discordCommandOption struct {
+	Type        int    `json:"type"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+type discordCommand struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description"`
+	Options     []discordCommandOption `json:"options"`
+}
+
+const discordSubCommand = 1
+
+// DiscordCommands are slash commands served by the service.
+var DiscordCommands = []discordCommand{
+	{
+		Name:        "automute",
+		Description: "Operate AutoMuteUs",
+		Options: []discordCommandOption{
+			{Type: discordSubCommand, Name: "status", Description: "Tell whether AutoMuteUs is up"},
+			{Type: discordSubCommand, Name: "start", Description: "Start AutoMuteUs"},
+			{Type: discordSubCommand, Name: "stop", Description: "Stop AutoMuteUs"},
+		},
+	},
+}
+
+// RegisterDiscordCommands overwrites global slash commands of the application
+// with DiscordCommands.
+func RegisterDiscordCommands(ctx context.Context, client *http.Client, apiBase string, applicationID string, botToken string) error {
+	body, e := json.Marshal(DiscordCommands)
+	if e != nil {
+		return e
+	}
+
+	url := fmt.Sprintf("%s/applications/%s/commands", apiBase, applicationID)
+	req, e := http.NewRequestWithContext(ctx, http.MethodPut, url, bytes.NewReader(body))
+	if e != nil {
+		return e
+	}
+	req.Header.Set("Authorization", "Bot "+botToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	res, e := client.Do(req)
+	if e != nil {
+		return e
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("failed to register slash commands: discord responded %s", res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package tools
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	goyaml "gopkg.in/yaml.v2"
+)
+
+func TestRenderDiscordAppYaml(t *testing.T) {
+	t.Parallel()
+
+	config := Config{
+		Cluster: ClusterConfig{Name: "automuteus", Location: "asia-northeast1-a"},
+		Discord: &DiscordConfig{
+			ServiceID:     "discord",
+			ApplicationID: "1234",
+			PublicKey:     "abcd",
+		},
+	}
+
+	var buf bytes.Buffer
+	if e := RenderDiscordAppYaml(&buf, config, "project"); e == nil {
+		t.Errorf("expected error without allowed_roles")
+	}
+
+	config.Discord.AllowedRoles = []string{"111", "222"}
+	buf.Reset()
+	if e := RenderDiscordAppYaml(&buf, config, "project"); e != nil {
+		t.Fatal(e)
+	}
+
+	var app appYaml
+	if e := goyaml.Unmarshal(buf.Bytes(), &app); e != nil {
+		t.Fatal(e)
+	}
+	if app.Main != DiscordMain || app.Service != "discord" || app.InstanceClass != "B1" {
+		t.Errorf("expected discord service on B1 instance; got %+v", app)
+	}
+	if app.EnvVariables["DISCORD_ALLOWED_ROLES"] != "111,222" || app.EnvVariables["DISCORD_CLUSTER_NAME"] != "automuteus" {
+		t.Errorf("expected roles and cluster to be passed; got %v", app.EnvVariables)
+	}
+}
+
+func TestRegisterDiscordCommands(t *testing.T) {
+	t.Parallel()
+
+	var commands []discordCommand
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut || r.URL.Path != "/applications/1234/commands" {
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+		}
+		if r.Header.Get("Authorization") != "Bot token" {
+			t.Errorf("expected bot token; got %q", r.Header.Get("Authorization"))
+		}
+		json.NewDecoder(r.Body).Decode(&commands)
+		rw.Write([]byte("[]"))
+	}))
+	defer server.Close()
+
+	if e := RegisterDiscordCommands(context.Background(), server.Client(), server.URL, "1234", "token"); e != nil {
+		t.Fatal(e)
+	}
+	if len(commands) != 1 || commands[0].Name != "automute" || len(commands[0].Options) != 3 {
+		t.Errorf("expected automute command to be registered; got %+v", commands)
+	}
+}
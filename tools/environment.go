@@ -0,0 +1,208 @@
+package tools
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/oakcask/automutek8s/cluster"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/kustomize/api/resid"
+	kustomize "sigs.k8s.io/kustomize/api/types"
+)
+
+// OverlaysDir is directory of kustomize overlays generated per environment.
+const OverlaysDir = "kubernetes/overlays"
+
+// EnvironmentLabel labels resources with name of the environment.
+const EnvironmentLabel = "automutek8s.oakcask.github.io/environment"
+
+// EnvironmentConfig is schema of an entry of environments in config.yaml.
+// Each environment is another stack in its own namespace of the cluster,
+// such as a bot for another Discord community.
+type EnvironmentConfig struct {
+	Name                string            `json:"name"`
+	Namespace           string            `json:"namespace"`
+	NamePrefix          string            `json:"name_prefix"`
+	Labels              map[string]string `json:"labels"`
+	IngressIPResourceID string            `json:"ingress_ip_resource_id"`
+}
+
+// DefaultEnvironment is the stack in default namespace,
+// rendered from kustomization.yaml.template.
+var DefaultEnvironment = EnvironmentConfig{Namespace: "default"}
+
+// IsDefault returns true if env is DefaultEnvironment.
+func (env EnvironmentConfig) IsDefault() bool {
+	return env.Name == ""
+}
+
+// Validate checks the environment can be rendered as an overlay.
+func (env EnvironmentConfig) Validate() error {
+	if !IsValidK8sMetadataName(env.Name) {
+		return fmt.Errorf("environments: invalid name: %q", env.Name)
+	}
+	if !IsValidK8sMetadataName(env.Namespace) {
+		return fmt.Errorf("environments: %s: invalid namespace: %q", env.Name, env.Namespace)
+	}
+	if env.NamePrefix != "" && !IsValidK8sMetadataName(env.NamePrefix+"x") {
+		return fmt.Errorf("environments: %s: invalid name_prefix: %q", env.Name, env.NamePrefix)
+	}
+	if env.IngressIPResourceID == "" {
+		return fmt.Errorf("environments: %s: ingress_ip_resource_id is required for its own broker", env.Name)
+	}
+	return nil
+}
+
+// Inventory returns inventory of resources applied to the environment,
+// so that pruning doesn't touch other environments.
+func (env EnvironmentConfig) Inventory() string {
+	if env.IsDefault() {
+		return cluster.DefaultInventory
+	}
+	return fmt.Sprintf("%s-%s", cluster.DefaultInventory, env.Name)
+}
+
+// OverlayPath returns directory of the overlay of the environment.
+func (env EnvironmentConfig) OverlayPath() string {
+	return path.Join(OverlaysDir, env.Name)
+}
+
+// IngressIP returns IP address reserved for broker service of the environment.
+func (env EnvironmentConfig) IngressIP(config Config) (string, error) {
+	if env.IsDefault() {
+		return config.IngressIP()
+	}
+	return config.lookupAddress(env.IngressIPResourceID)
+}
+
+// NewSecretHandles builds SecretHandles of secret for the environment.
+// Secrets of environments other than DefaultEnvironment are in their namespaces,
+// so that each environment has its own bot token and passwords.
+func (env EnvironmentConfig) NewSecretHandles(secret corev1.Secret) []SecretHandle {
+	handles := NewSecretHandles(secret)
+	if env.IsDefault() {
+		return handles
+	}
+	for i := range handles {
+		handles[i].Namespace = env.Namespace
+	}
+	return handles
+}
+
+// NamespaceObject returns Namespace of the environment to be applied.
+func (env EnvironmentConfig) NamespaceObject() *unstructured.Unstructured {
+	return newNamespaceObject(env.Namespace)
+}
+
+func newNamespaceObject(name string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion("v1")
+	obj.SetKind("Namespace")
+	obj.SetName(name)
+	return obj
+}
+
+// Environment returns the environment named name in config.yaml.
+// Empty name is DefaultEnvironment.
+func (config Config) Environment(name string) (EnvironmentConfig, error) {
+	if name == "" {
+		return DefaultEnvironment, nil
+	}
+	for _, env := range config.Environments {
+		if env.Name == name {
+			return env, env.Validate()
+		}
+	}
+	return EnvironmentConfig{}, fmt.Errorf("environment %s is not in config.yaml", name)
+}
+
+type jsonPatchOp struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+func jsonPatch(kind string, name string, ops ...jsonPatchOp) (kustomize.Patch, error) {
+	patch, e := json.Marshal(ops)
+	if e != nil {
+		return kustomize.Patch{}, e
+	}
+	return kustomize.Patch{
+		Target: &kustomize.Selector{Gvk: resid.Gvk{Kind: kind}, Name: name},
+		Patch:  string(patch),
+	}, nil
+}
+
+// NewOverlay builds overlay of kubernetes/base for the environment.
+// Addresses in discovery ConfigMap are rewritten with name prefix,
+// since names of services are prefixed too.
+func NewOverlay(env EnvironmentConfig, ingressIP string) (kustomize.Kustomization, error) {
+	labels := map[string]string{}
+	for key, value := range env.Labels {
+		labels[key] = value
+	}
+	labels[EnvironmentLabel] = env.Name
+
+	broker, e := jsonPatch("Service", BrokerServiceName,
+		jsonPatchOp{Op: "add", Path: "/spec/loadBalancerIP", Value: ingressIP},
+	)
+	if e != nil {
+		return kustomize.Kustomization{}, e
+	}
+	discovery, e := jsonPatch("ConfigMap", "discovery",
+		jsonPatchOp{Op: "replace", Path: "/data/GALACTUS_EXTERNAL_URL", Value: fmt.Sprintf("http://%s/", ingressIP)},
+		jsonPatchOp{Op: "replace", Path: "/data/GALACTUS_ADDR", Value: fmt.Sprintf("http://%sgalactus:5858", env.NamePrefix)},
+		jsonPatchOp{Op: "replace", Path: "/data/REDIS_ADDR", Value: fmt.Sprintf("%sredis:6379", env.NamePrefix)},
+		jsonPatchOp{Op: "replace", Path: "/data/POSTGRES_ADDR", Value: fmt.Sprintf("%spostgres:5432", env.NamePrefix)},
+	)
+	if e != nil {
+		return kustomize.Kustomization{}, e
+	}
+
+	return kustomize.Kustomization{
+		TypeMeta: kustomize.TypeMeta{
+			APIVersion: kustomize.KustomizationVersion,
+			Kind:       kustomize.KustomizationKind,
+		},
+		Bases:           []string{"../../base"},
+		Namespace:       env.Namespace,
+		NamePrefix:      env.NamePrefix,
+		CommonLabels:    labels,
+		PatchesJson6902: []kustomize.Patch{broker, discovery},
+	}, nil
+}
+
+// WriteOverlay writes overlay as kustomization.yaml in dir.
+// The overlay has no secret, so it can be committed.
+func WriteOverlay(dir string, overlay kustomize.Kustomization) error {
+	if e := os.MkdirAll(dir, 0755); e != nil {
+		return e
+	}
+
+	var content strings.Builder
+	content.WriteString("# Generated by `mage kustomization` from config.yaml.\n")
+	if e := WriteKustomization(&content, overlay); e != nil {
+		return e
+	}
+	return ioutil.WriteFile(path.Join(dir, "kustomization.yaml"), []byte(content.String()), 0644)
+}
+
+// AddTFEnvironments reserves ingress address of every environment.
+func AddTFEnvironments(doc *TFDocument, config Config) error {
+	for _, env := range config.Environments {
+		if e := env.Validate(); e != nil {
+			return e
+		}
+		doc.AddResource("google_compute_address", fmt.Sprintf("ingress-%s", env.Name), TFObject{
+			"depends_on": []string{"google_project_service.service"},
+			"name":       env.IngressIPResourceID,
+			"region":     TFExpr("var.region"),
+		})
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package tools
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+var prodEnvironment = EnvironmentConfig{
+	Name:                "prod",
+	Namespace:           "community-b",
+	NamePrefix:          "b-",
+	Labels:              map[string]string{"community": "b"},
+	IngressIPResourceID: "ingress-ip-b",
+}
+
+func TestConfigEnvironment(t *testing.T) {
+	t.Parallel()
+
+	config := Config{Environments: []EnvironmentConfig{prodEnvironment, {Name: "broken", Namespace: "Broken"}}}
+	if env, e := config.Environment(""); e != nil || !env.IsDefault() || env.Inventory() != "automutek8s" {
+		t.Errorf("expected default environment; got %v %v", env, e)
+	}
+	if env, e := config.Environment("prod"); e != nil || env.Inventory() != "automutek8s-prod" || env.OverlayPath() != "kubernetes/overlays/prod" {
+		t.Errorf("expected prod environment; got %v %v", env, e)
+	}
+	if _, e := config.Environment("broken"); e == nil {
+		t.Errorf("expected error with invalid namespace")
+	}
+	if _, e := config.Environment("missing"); e == nil {
+		t.Errorf("expected error with unknown environment")
+	}
+}
+
+func TestRenderEnvironment(t *testing.T) {
+	t.Parallel()
+
+	renderer := fakeRenderer(Config{Environments: []EnvironmentConfig{prodEnvironment}})
+	renderer.Environment = prodEnvironment
+
+	overlays, e := renderer.Overlays(context.Background())
+	if e != nil {
+		t.Fatal(e)
+	}
+	if _, ok := overlays[prodEnvironment.OverlayPath()]; len(overlays) != 1 || !ok {
+		t.Fatalf("expected overlay of the environment; got %v", overlays)
+	}
+	dir := filepath.Join(t.TempDir(), prodEnvironment.OverlayPath())
+	if e := WriteOverlay(dir, overlays[prodEnvironment.OverlayPath()]); e != nil {
+		t.Fatal(e)
+	}
+	if written, e := LoadKustomization(filepath.Join(dir, "kustomization.yaml")); e != nil || written.Namespace != "community-b" {
+		t.Errorf("expected overlay to be written as kustomization.yaml; got %v %v", written, e)
+	}
+
+	k, e := renderer.Render(context.Background())
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(k.Bases) != 1 || k.Bases[0] != "./kubernetes/overlays/prod" || k.Namespace != "community-b" {
+		t.Errorf("expected kustomization on top of the overlay; got %v %s", k.Bases, k.Namespace)
+	}
+	for _, secret := range k.SecretGenerator {
+		for _, literal := range secret.LiteralSources {
+			if !strings.Contains(literal, "=fake-community-b-") {
+				t.Errorf("expected secrets of the environment to be read from its namespace; got %s", literal)
+			}
+		}
+	}
+
+	objs := buildObjects(t, renderer)
+	for _, obj := range objs {
+		if obj.GetNamespace() != "community-b" {
+			t.Errorf("expected %s %s to be in namespace of the environment; got %s", obj.GetKind(), obj.GetName(), obj.GetNamespace())
+		}
+		// secrets are generated on top of the overlay, so they are not labeled.
+		if obj.GetKind() != "Secret" && (obj.GetLabels()[EnvironmentLabel] != "prod" || obj.GetLabels()["community"] != "b") {
+			t.Errorf("expected %s %s to be labeled; got %v", obj.GetKind(), obj.GetName(), obj.GetLabels())
+		}
+	}
+
+	broker := mustFindObject(t, objs, "community-b", "Service", "b-broker")
+	if ip, _, _ := unstructured.NestedString(broker.Object, "spec", "loadBalancerIP"); ip != "203.0.113.10" {
+		t.Errorf("expected broker to have loadBalancerIP of ingress; got %q", ip)
+	}
+	discovery := mustFindObject(t, objs, "community-b", "ConfigMap", "b-discovery-")
+	if addr, _, _ := unstructured.NestedString(discovery.Object, "data", "REDIS_ADDR"); addr != "b-redis:6379" {
+		t.Errorf("expected REDIS_ADDR to point prefixed service; got %q", addr)
+	}
+	automuteus := mustFindObject(t, objs, "community-b", "Deployment", "b-automuteus")
+	container := nestedFirst(t, automuteus.Object, "spec", "template", "spec", "containers")
+	if name, _, _ := unstructured.NestedString(nestedFirst(t, container, "envFrom"), "secretRef", "name"); !strings.HasPrefix(name, "discordbot-") {
+		t.Errorf("expected generated secret to be referred; got %s", name)
+	}
+}
+
+func TestAddTFEnvironments(t *testing.T) {
+	t.Parallel()
+
+	doc := TFDocument{}
+	if e := AddTFEnvironments(&doc, Config{Environments: []EnvironmentConfig{prodEnvironment}}); e != nil {
+		t.Fatal(e)
+	}
+	if address := doc.Resource["google_compute_address"]["ingress-prod"]; address["name"] != "ingress-ip-b" {
+		t.Errorf("expected ingress address of prod to be reserved; got %v", doc.Resource)
+	}
+}
@@ -0,0 +1,272 @@
+package tools
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	gopipeline "github.com/mattn/go-pipeline"
+	goyaml "gopkg.in/yaml.v2"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// GateMain is package path of the reverse proxy deployed to App Engine.
+const GateMain = "./cmd/gate"
+
+const galactusServiceName = "galactus"
+const galactusPort = 5858
+
+// GetServiceLoadBalancerIP calls `kubectl get service` and returns
+// IP address of the load balancer provisioned for the service.
+func GetServiceLoadBalancerIP(serviceName string) (string, error) {
+	out, e := gopipeline.Output(
+		[]string{"kubectl", "get", "service", serviceName, "--output=json"},
+	)
+	if e != nil {
+		return "", fmt.Errorf("failed to invoke kubectl command: %v", e.Error())
+	}
+
+	var service corev1.Service
+	if e = json.Unmarshal(out, &service); e != nil {
+		return "", fmt.Errorf("failed to parse kubectl command output")
+	}
+
+	for _, ingress := range service.Status.LoadBalancer.Ingress {
+		if ingress.IP != "" {
+			return ingress.IP, nil
+		}
+	}
+
+	return "", fmt.Errorf("load balancer of service %s has no IP address yet", serviceName)
+}
+
+// GateGalactusAddr returns URL of galactus which the gate proxies to.
+// Unless galactus_addr is configured, it looks up internal load balancer
+// of galactus service in the cluster.
+func (config Config) GateGalactusAddr() (string, error) {
+	if config.Gate.GalactusAddr != "" {
+		return config.Gate.GalactusAddr, nil
+	}
+
+	ip, e := GetServiceLoadBalancerIP(galactusServiceName)
+	if e != nil {
+		return "", e
+	}
+
+	return fmt.Sprintf("http://%s:%d", ip, galactusPort), nil
+}
+
+// GAERuntime is runtime of the gate and the slash command service in App Engine standard environment.
+const GAERuntime = "go122"
+
+type gaeAppDescription struct {
+	DefaultHostname string `json:"defaultHostname"`
+}
+
+// GetGAERegionID returns region ID of the App Engine application, like "an" in
+// "project.an.r.appspot.com", from its default hostname told by `gcloud app describe`.
+func GetGAERegionID(run CommandRunner) (string, error) {
+	var out bytes.Buffer
+	if e := run([]string{"gcloud", "app", "describe", "--format=json"}, &out); e != nil {
+		return "", fmt.Errorf("failed to invoke gcloud command: %v", e.Error())
+	}
+	var app gaeAppDescription
+	if e := json.Unmarshal(out.Bytes(), &app); e != nil {
+		return "", fmt.Errorf("failed to parse gcloud command output")
+	}
+
+	labels := strings.Split(app.DefaultHostname, ".")
+	if len(labels) != 5 || strings.Join(labels[2:], ".") != "r.appspot.com" {
+		return "", fmt.Errorf("default hostname of App Engine has no region ID: %q", app.DefaultHostname)
+	}
+	return labels[1], nil
+}
+
+// GateURL returns URL of the gate served by App Engine in the region of regionID.
+func (config Config) GateURL(projectID string, regionID string) string {
+	if config.Gate.ServiceID == "" || config.Gate.ServiceID == "default" {
+		return fmt.Sprintf("https://%s.%s.r.appspot.com/", projectID, regionID)
+	}
+	return fmt.Sprintf("https://%s-dot-%s.%s.r.appspot.com/", config.Gate.ServiceID, projectID, regionID)
+}
+
+// RenderGateAppYaml writes app.yaml to deploy the gate to
+// App Engine standard or flexible environment.
+func RenderGateAppYaml(out io.Writer, config Config, projectID string, galactusAddr string) error {
+	if config.Gate.ServiceID == "" {
+		return fmt.Errorf("service_id of gate is required")
+	}
+
+	var app appYaml
+	switch config.Gate.Environment {
+	case "", "standard":
+		if !config.HasVPCConnector() {
+			return fmt.Errorf("vpc_connector_name of cluster is required to reach galactus from App Engine")
+		}
+		var e error
+		if app, e = standardGateAppYaml(config, projectID); e != nil {
+			return e
+		}
+	case "flexible":
+		app = flexibleGateAppYaml(config)
+	default:
+		return fmt.Errorf("environment of gate should be standard or flexible: %s", config.Gate.Environment)
+	}
+
+	app.Service = config.Gate.ServiceID
+	app.EnvVariables = map[string]string{
+		"GALACTUS_ADDR": galactusAddr,
+	}
+	if config.Gate.Wake {
+		app.EnvVariables["GATE_PROJECT_ID"] = projectID
+		app.EnvVariables["GATE_CLUSTER_NAME"] = config.Cluster.Name
+		app.EnvVariables["GATE_CLUSTER_LOCATION"] = config.Cluster.Location
+		app.EnvVariables["GATE_NODE_POOL"] = config.NodePools()[0].Name
+		app.EnvVariables["GATE_IDLE_MINUTES"] = strconv.Itoa(config.Gate.IdleMinutes)
+		app.EnvVariables["GATE_KEEP_POSTGRES"] = strconv.FormatBool(config.KeepsPostgres(DefaultEnvironment))
+		app.ServiceAccount = GateServiceAccountEmail(projectID)
+	}
+
+	return goyaml.NewEncoder(out).Encode(app)
+}
+
+// standardGateAppYaml builds app.yaml for standard environment.
+// Automatic scaling throttles CPU outside of requests, so the gate waking the stack
+// runs on a single manually scaled B-class instance to finish wake-up and idle shutdown in background.
+func standardGateAppYaml(config Config, projectID string) (appYaml, error) {
+	app := appYaml{
+		Runtime:       GAERuntime,
+		Main:          GateMain,
+		InstanceClass: config.Gate.InstanceClass,
+		VpcAccessConnector: map[string]string{
+			"name": fmt.Sprintf("projects/%s/locations/%s/connectors/%s", projectID, config.Region, config.Cluster.VPCConnectorName),
+		},
+		Handlers: []map[string]string{
+			{
+				"url":    "/.*",
+				"script": "auto",
+				"secure": "always",
+			},
+		},
+	}
+
+	if config.Gate.Wake {
+		if app.InstanceClass == "" {
+			app.InstanceClass = "B1"
+		}
+		if !strings.HasPrefix(app.InstanceClass, "B") {
+			return appYaml{}, fmt.Errorf("instance_class of gate should be B-class to wake the stack: %s", app.InstanceClass)
+		}
+		app.ManualScaling = map[string]interface{}{
+			"instances": 1,
+		}
+		return app, nil
+	}
+
+	if app.InstanceClass == "" {
+		app.InstanceClass = "F1"
+	}
+	maxInstances := config.Gate.MaxInstances
+	if maxInstances == 0 {
+		maxInstances = 1
+	}
+	app.AutomaticScaling = map[string]interface{}{
+		"min_instances": 0,
+		"max_instances": maxInstances,
+	}
+	return app, nil
+}
+
+// flexibleGateAppYaml builds app.yaml for flexible environment,
+// which supports WebSocket. Instances are placed into the VPC of the cluster
+// and built from Dockerfile. Scaling is manual so that the instance can be stopped.
+func flexibleGateAppYaml(config Config) appYaml {
+	// the gate has to receive requests to wake galactus up
+	readinessPath := "/_gate/readyz"
+	if config.Gate.Wake {
+		readinessPath = "/_gate/healthz"
+	}
+
+	return appYaml{
+		Runtime: "custom",
+		Env:     "flex",
+		ManualScaling: map[string]interface{}{
+			"instances": 1,
+		},
+		Network: map[string]string{
+			"name":            fmt.Sprintf("%s-vpc", config.Cluster.Name),
+			"subnetwork_name": fmt.Sprintf("%s-vpc-subnet", config.Cluster.Name),
+		},
+		LivenessCheck: map[string]string{
+			"path": "/_gate/healthz",
+		},
+		ReadinessCheck: map[string]string{
+			"path": readinessPath,
+		},
+	}
+}
+
+// DeployGAEApp calls `gcloud app deploy` and copies its output to out.
+func DeployGAEApp(out io.Writer, appYamlPaths ...string) error {
+	args := append([]string{"-q", "app", "deploy"}, appYamlPaths...)
+	cmd := exec.Command("gcloud", args...)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	return cmd.Run()
+}
+
+// GateServiceAccountID is ID of Google service account which the gate
+// and the slash command service run as on App Engine.
+const GateServiceAccountID = "automutek8s-gate"
+
+// gateRolePermissions are just enough to resize the node pool
+// and scale workloads of the stack through cluster.Scaler.
+var gateRolePermissions = []string{
+	"container.clusters.get",
+	"container.clusters.update",
+	"container.operations.get",
+	"container.deployments.get",
+	"container.deployments.update",
+	"container.statefulSets.get",
+	"container.statefulSets.update",
+}
+
+// GateServiceAccountEmail returns email of the service account of the gate.
+func GateServiceAccountEmail(projectID string) string {
+	return fmt.Sprintf("%s@%s.iam.gserviceaccount.com", GateServiceAccountID, projectID)
+}
+
+// HasGateServiceAccount returns true if AddTFGateIAM adds the service account.
+func (config Config) HasGateServiceAccount() bool {
+	return config.Gate.Wake || config.Discord != nil
+}
+
+// AddTFGateIAM adds service account of the gate and the slash command service,
+// with a custom role to scale node pool and workloads of the cluster.
+// App Engine default service account is left alone, since it is shared by every service of the app.
+// Nothing will be added unless wake is enabled for the gate or discord is configured.
+func AddTFGateIAM(doc *TFDocument, config Config) {
+	if !config.HasGateServiceAccount() {
+		return
+	}
+
+	doc.AddResource("google_service_account", "gate", TFObject{
+		"account_id":   GateServiceAccountID,
+		"display_name": "service account of the gate to start and stop the stack",
+	})
+	doc.AddResource("google_project_iam_custom_role", "gate", TFObject{
+		"role_id":     "automutek8sGate",
+		"title":       "automutek8s gate",
+		"description": "resize node pool and scale workloads of automutek8s",
+		"permissions": gateRolePermissions,
+	})
+	doc.AddResource("google_project_iam_member", "gate-scaler", TFObject{
+		"depends_on": []string{"google_project_service.service"},
+		"role":       TFExpr("google_project_iam_custom_role.gate.name"),
+		"member":     "serviceAccount:" + TFExpr("google_service_account.gate.email"),
+	})
+}
@@ -0,0 +1,173 @@
+package tools
+
+import (
+	"bytes"
+	"testing"
+
+	goyaml "gopkg.in/yaml.v2"
+)
+
+func TestAddTFGateIAM(t *testing.T) {
+	t.Parallel()
+
+	var doc TFDocument
+	AddTFGateIAM(&doc, Config{})
+	if len(doc.Resource) != 0 {
+		t.Errorf("expected nothing without wake; got %v", doc.Resource)
+	}
+
+	AddTFGateIAM(&doc, Config{Gate: GateConfig{Wake: true}})
+	if sa := doc.Resource["google_service_account"]["gate"]; sa["account_id"] != GateServiceAccountID {
+		t.Errorf("expected service account of the gate; got %v", sa)
+	}
+	role := doc.Resource["google_project_iam_custom_role"]["gate"]
+	permissions, _ := role["permissions"].([]string)
+	for _, permission := range permissions {
+		if permission == "container.clusters.delete" || permission == "container.secrets.get" {
+			t.Errorf("unexpected permission: %s", permission)
+		}
+	}
+	if len(permissions) == 0 {
+		t.Errorf("expected permissions to scale the stack; got %v", role)
+	}
+	for name, member := range doc.Resource["google_project_iam_member"] {
+		if member["member"] != "serviceAccount:${google_service_account.gate.email}" {
+			t.Errorf("expected %s to be granted to the gate; got %v", name, member["member"])
+		}
+		if member["role"] != "${google_project_iam_custom_role.gate.name}" {
+			t.Errorf("expected %s to grant the custom role; got %v", name, member["role"])
+		}
+	}
+}
+
+func TestRenderGateAppYamlRunsAsGateServiceAccount(t *testing.T) {
+	t.Parallel()
+
+	config := Config{
+		Cluster: ClusterConfig{Name: "automuteus", Location: "asia-northeast1-a", VPCConnectorName: "connector"},
+		Gate:    GateConfig{ServiceID: "gate", Wake: true},
+	}
+
+	var buf bytes.Buffer
+	if e := RenderGateAppYaml(&buf, config, "project", "10.0.0.1:8123"); e != nil {
+		t.Fatal(e)
+	}
+	var app appYaml
+	if e := goyaml.Unmarshal(buf.Bytes(), &app); e != nil {
+		t.Fatal(e)
+	}
+	if app.ServiceAccount != "automutek8s-gate@project.iam.gserviceaccount.com" {
+		t.Errorf("expected gate to run as its own service account; got %q", app.ServiceAccount)
+	}
+}
+
+func TestRenderGateAppYaml(t *testing.T) {
+	t.Parallel()
+
+	cluster := ClusterConfig{Name: "automuteus", Location: "asia-northeast1-a", VPCConnectorName: "connector"}
+	examples := []struct {
+		name   string
+		config Config
+		check  func(app appYaml) bool
+		fails  bool
+	}{
+		{name: "without service_id", config: Config{Cluster: cluster}, fails: true},
+		{name: "unknown environment", config: Config{Cluster: cluster, Gate: GateConfig{ServiceID: "gate", Environment: "classic"}}, fails: true},
+		{name: "standard without connector", config: Config{Gate: GateConfig{ServiceID: "gate"}}, fails: true},
+		{
+			name:   "standard",
+			config: Config{Region: "asia-northeast1", Cluster: cluster, Gate: GateConfig{ServiceID: "gate"}},
+			check: func(app appYaml) bool {
+				return app.Runtime == GAERuntime && app.Main == GateMain && app.InstanceClass == "F1" &&
+					app.VpcAccessConnector["name"] == "projects/project/locations/asia-northeast1/connectors/connector" &&
+					app.AutomaticScaling["min_instances"] == 0 && app.EnvVariables["GALACTUS_ADDR"] == "http://10.0.0.1:5858" &&
+					app.ServiceAccount == ""
+			},
+		},
+		{
+			name:   "standard waking the stack",
+			config: Config{Region: "asia-northeast1", Cluster: cluster, Gate: GateConfig{ServiceID: "gate", Wake: true, IdleMinutes: 30}},
+			check: func(app appYaml) bool {
+				return app.InstanceClass == "B1" && app.ManualScaling["instances"] == 1 && app.AutomaticScaling == nil &&
+					app.EnvVariables["GATE_IDLE_MINUTES"] == "30" &&
+					app.EnvVariables["GATE_NODE_POOL"] == defaultNodePool.Name
+			},
+		},
+		{
+			name:   "standard waking the stack on F-class",
+			config: Config{Region: "asia-northeast1", Cluster: cluster, Gate: GateConfig{ServiceID: "gate", InstanceClass: "F1", Wake: true}},
+			fails:  true,
+		},
+		{
+			name:   "flexible",
+			config: Config{Cluster: ClusterConfig{Name: "automuteus"}, Gate: GateConfig{ServiceID: "gate", Environment: "flexible"}},
+			check: func(app appYaml) bool {
+				return app.Runtime == "custom" && app.Env == "flex" && app.Network["name"] == "automuteus-vpc" &&
+					app.ReadinessCheck["path"] == "/_gate/readyz"
+			},
+		},
+	}
+
+	for _, example := range examples {
+		var buf bytes.Buffer
+		e := RenderGateAppYaml(&buf, example.config, "project", "http://10.0.0.1:5858")
+		if example.fails {
+			if e == nil {
+				t.Errorf("%s: expected error; got %s", example.name, buf.String())
+			}
+			continue
+		}
+		if e != nil {
+			t.Errorf("%s: %v", example.name, e)
+			continue
+		}
+		var app appYaml
+		if e := goyaml.Unmarshal(buf.Bytes(), &app); e != nil {
+			t.Fatal(e)
+		}
+		if app.Service != "gate" || !example.check(app) {
+			t.Errorf("%s: unexpected app.yaml:\n%s", example.name, buf.String())
+		}
+	}
+}
+
+func TestGateURL(t *testing.T) {
+	t.Parallel()
+
+	examples := []struct {
+		serviceID string
+		url       string
+	}{
+		{"", "https://project.an.r.appspot.com/"},
+		{"default", "https://project.an.r.appspot.com/"},
+		{"gate", "https://gate-dot-project.an.r.appspot.com/"},
+	}
+	for _, example := range examples {
+		config := Config{Gate: GateConfig{ServiceID: example.serviceID}}
+		if url := config.GateURL("project", "an"); url != example.url {
+			t.Errorf("expected URL of service %q to be %s; got %s", example.serviceID, example.url, url)
+		}
+	}
+}
+
+func TestGetGAERegionID(t *testing.T) {
+	t.Parallel()
+
+	examples := []struct {
+		output   string
+		regionID string
+		fails    bool
+	}{
+		{output: `{"defaultHostname": "project.an.r.appspot.com"}`, regionID: "an"},
+		{output: `{"defaultHostname": "project.uc.r.appspot.com"}`, regionID: "uc"},
+		{output: `{"defaultHostname": "project.appspot.com"}`, fails: true},
+		{output: `not json`, fails: true},
+	}
+	for _, example := range examples {
+		run := fakeRunner(t, []string{"gcloud", "app", "describe", "--format=json"}, example.output, nil)
+		regionID, e := GetGAERegionID(run)
+		if (e != nil) != example.fails || regionID != example.regionID {
+			t.Errorf("expected region ID of %s to be %q (fails=%v); got %q, %v", example.output, example.regionID, example.fails, regionID, e)
+		}
+	}
+}
@@ -20,11 +20,20 @@ type gcloudConfigOutput struct {
 
 type appYaml struct {
 	Runtime            string                 `yaml:"runtime"`
-	InstanceClass      string                 `yaml:"instance_class"`
-	AutomaticScaling   map[string]interface{} `yaml:"automatic_scaling"`
-	VpcAccessConnector map[string]string      `yaml:"vpc_access_connector"`
+	Env                string                 `yaml:"env,omitempty"`
+	Main               string                 `yaml:"main,omitempty"`
+	InstanceClass      string                 `yaml:"instance_class,omitempty"`
+	AutomaticScaling   map[string]interface{} `yaml:"automatic_scaling,omitempty"`
+	ManualScaling      map[string]interface{} `yaml:"manual_scaling,omitempty"`
+	BasicScaling       map[string]interface{} `yaml:"basic_scaling,omitempty"`
+	VpcAccessConnector map[string]string      `yaml:"vpc_access_connector,omitempty"`
+	Network            map[string]string      `yaml:"network,omitempty"`
+	LivenessCheck      map[string]string      `yaml:"liveness_check,omitempty"`
+	ReadinessCheck     map[string]string      `yaml:"readiness_check,omitempty"`
 	EnvVariables       map[string]string      `yaml:"env_variables"`
 	Service            string                 `yaml:"service"`
+	ServiceAccount     string                 `yaml:"service_account,omitempty"`
+	Handlers           []map[string]string    `yaml:"handlers,omitempty"`
 }
 
 var projectIDMemo *string = nil
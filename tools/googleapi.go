@@ -0,0 +1,16 @@
+package tools
+
+import (
+	"net/http"
+
+	"google.golang.org/api/googleapi"
+)
+
+// IsGoogleAPINotFound returns true if the error is representing
+// HTTP 404 returned by Google REST API. false if not.
+func IsGoogleAPINotFound(e error) bool {
+	if apiErr, ok := e.(*googleapi.Error); ok && apiErr.Code == http.StatusNotFound {
+		return true
+	}
+	return false
+}
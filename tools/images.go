@@ -0,0 +1,459 @@
+package tools
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// BaseKustomizationPath is kustomization.yaml of kubernetes/base,
+// whose images are pinned by PinImages.
+const BaseKustomizationPath = "kubernetes/base/kustomization.yaml"
+
+// manifestMediaTypes are accepted manifests when resolving digests.
+// Manifest lists come first, so that digests stay valid for every platform.
+var manifestMediaTypes = []string{
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+}
+
+// RegistryClient talks to container registries with Docker Registry HTTP API v2.
+// Pull tokens are requested anonymously as registries challenge.
+type RegistryClient struct {
+	Client *http.Client
+
+	mu     sync.Mutex
+	tokens map[string]string
+}
+
+// NewRegistryClient builds RegistryClient with client.
+func NewRegistryClient(client *http.Client) *RegistryClient {
+	return &RegistryClient{Client: client, tokens: map[string]string{}}
+}
+
+// ParseImageName splits image name into registry host and repository,
+// as docker does; "postgres" is "library/postgres" on Docker Hub.
+func ParseImageName(name string) (registry string, repository string) {
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		registry, repository = parts[0], parts[1]
+	} else {
+		registry, repository = "docker.io", name
+	}
+
+	if registry == "docker.io" {
+		registry = "registry-1.docker.io"
+		if !strings.Contains(repository, "/") {
+			repository = "library/" + repository
+		}
+	}
+	return registry, repository
+}
+
+func (c *RegistryClient) do(ctx context.Context, method string, rawurl string, repository string, accept []string) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, e := http.NewRequestWithContext(ctx, method, rawurl, nil)
+		if e != nil {
+			return nil, e
+		}
+		if len(accept) > 0 {
+			req.Header.Set("Accept", strings.Join(accept, ", "))
+		}
+		c.mu.Lock()
+		token := c.tokens[repository]
+		c.mu.Unlock()
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		res, e := c.Client.Do(req)
+		if e != nil {
+			return nil, e
+		}
+		if res.StatusCode != http.StatusUnauthorized || attempt > 0 {
+			return res, nil
+		}
+
+		challenge := res.Header.Get("WWW-Authenticate")
+		res.Body.Close()
+		token, e = c.fetchToken(ctx, challenge)
+		if e != nil {
+			return nil, fmt.Errorf("failed to authorize to %s: %v", rawurl, e)
+		}
+		c.mu.Lock()
+		c.tokens[repository] = token
+		c.mu.Unlock()
+	}
+}
+
+var challengeParamPattern = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// fetchToken requests anonymous bearer token for the challenge in WWW-Authenticate.
+func (c *RegistryClient) fetchToken(ctx context.Context, challenge string) (string, error) {
+	if !strings.HasPrefix(challenge, "Bearer ") {
+		return "", fmt.Errorf("unsupported challenge: %q", challenge)
+	}
+	params := map[string]string{}
+	for _, match := range challengeParamPattern.FindAllStringSubmatch(challenge, -1) {
+		params[match[1]] = match[2]
+	}
+	realm, e := url.Parse(params["realm"])
+	if e != nil || params["realm"] == "" {
+		return "", fmt.Errorf("no realm in challenge: %q", challenge)
+	}
+	query := realm.Query()
+	for _, key := range []string{"service", "scope"} {
+		if params[key] != "" {
+			query.Set(key, params[key])
+		}
+	}
+	realm.RawQuery = query.Encode()
+
+	req, e := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if e != nil {
+		return "", e
+	}
+	res, e := c.Client.Do(req)
+	if e != nil {
+		return "", e
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token server responded %s", res.Status)
+	}
+
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if e := json.NewDecoder(res.Body).Decode(&body); e != nil {
+		return "", e
+	}
+	if body.Token != "" {
+		return body.Token, nil
+	}
+	return body.AccessToken, nil
+}
+
+// Digest resolves tag of image to digest of its manifest.
+func (c *RegistryClient) Digest(ctx context.Context, image string, tag string) (string, error) {
+	registry, repository := ParseImageName(image)
+	rawurl := fmt.Sprintf("https://%s/v2/%s/manifests/%s", registry, repository, tag)
+
+	res, e := c.do(ctx, http.MethodHead, rawurl, repository, manifestMediaTypes)
+	if e != nil {
+		return "", e
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to resolve %s:%s: registry responded %s", image, tag, res.Status)
+	}
+
+	digest := res.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		return "", fmt.Errorf("failed to resolve %s:%s: no digest in response", image, tag)
+	}
+	return digest, nil
+}
+
+var nextLinkPattern = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
+
+// Tags lists every tag of image, following pagination.
+func (c *RegistryClient) Tags(ctx context.Context, image string) ([]string, error) {
+	registry, repository := ParseImageName(image)
+	base, e := url.Parse(fmt.Sprintf("https://%s/v2/%s/tags/list", registry, repository))
+	if e != nil {
+		return nil, e
+	}
+
+	tags := make([]string, 0)
+	next := base
+	for next != nil {
+		res, e := c.do(ctx, http.MethodGet, next.String(), repository, nil)
+		if e != nil {
+			return nil, e
+		}
+		body, e := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if e != nil {
+			return nil, e
+		}
+		if res.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("failed to list tags of %s: registry responded %s", image, res.Status)
+		}
+
+		var list struct {
+			Tags []string `json:"tags"`
+		}
+		if e := json.Unmarshal(body, &list); e != nil {
+			return nil, e
+		}
+		tags = append(tags, list.Tags...)
+
+		next = nil
+		if match := nextLinkPattern.FindStringSubmatch(res.Header.Get("Link")); match != nil {
+			if next, e = base.Parse(match[1]); e != nil {
+				return nil, e
+			}
+		}
+	}
+	return tags, nil
+}
+
+var versionTagPattern = regexp.MustCompile(`^(v?)(\d+(?:\.\d+)*)(.*)$`)
+
+func parseVersionTag(tag string) (prefix string, version []int, suffix string, ok bool) {
+	match := versionTagPattern.FindStringSubmatch(tag)
+	if match == nil {
+		return "", nil, "", false
+	}
+	for _, part := range strings.Split(match[2], ".") {
+		n, e := strconv.Atoi(part)
+		if e != nil {
+			return "", nil, "", false
+		}
+		version = append(version, n)
+	}
+	return match[1], version, match[3], true
+}
+
+func compareVersions(a []int, b []int) int {
+	for i := range a {
+		if a[i] != b[i] {
+			if a[i] < b[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+var releaseTagPattern = regexp.MustCompile(`^v?\d+\.\d+\.\d+$`)
+
+// NewerTags returns tags of higher version than current, looking alike;
+// "13-alpine" is newer than "12-alpine" but "12.5-alpine" and "13" are not.
+// Tags without version like "latest" or "sha-528a327" can't be compared,
+// so the newest release tag like "2.5.0" is returned to pin instead.
+func NewerTags(current string, tags []string) []string {
+	prefix, version, suffix, ok := parseVersionTag(current)
+	if !ok {
+		return newestRelease(tags)
+	}
+
+	type candidate struct {
+		tag     string
+		version []int
+	}
+	newer := make([]candidate, 0)
+	for _, tag := range tags {
+		p, v, s, ok := parseVersionTag(tag)
+		if !ok || p != prefix || s != suffix || len(v) != len(version) {
+			continue
+		}
+		if compareVersions(v, version) > 0 {
+			newer = append(newer, candidate{tag, v})
+		}
+	}
+	sort.Slice(newer, func(i, j int) bool {
+		return compareVersions(newer[i].version, newer[j].version) < 0
+	})
+
+	result := make([]string, 0, len(newer))
+	for _, c := range newer {
+		result = append(result, c.tag)
+	}
+	return result
+}
+
+// newestRelease returns the highest tag versioned as MAJOR.MINOR.PATCH, if any.
+func newestRelease(tags []string) []string {
+	newest, newestVersion := "", []int(nil)
+	for _, tag := range tags {
+		if !releaseTagPattern.MatchString(tag) {
+			continue
+		}
+		_, v, _, _ := parseVersionTag(tag)
+		if newestVersion == nil || compareVersions(v, newestVersion) > 0 {
+			newest, newestVersion = tag, v
+		}
+	}
+	if newest == "" {
+		return nil
+	}
+	return []string{newest}
+}
+
+// kustomizationImage is an entry of images in kustomization.yaml,
+// with the node to rewrite it. Name is newName if given.
+// Tag is "latest" if newTag is missing, which Unpinned tells.
+type kustomizationImage struct {
+	Name     string
+	Tag      string
+	Digest   string
+	Unpinned bool
+	node     *yamlv3.Node
+}
+
+func mappingValue(node *yamlv3.Node, key string) *yamlv3.Node {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func setMappingValue(node *yamlv3.Node, key string, value string) {
+	if v := mappingValue(node, key); v != nil {
+		v.SetString(value)
+		return
+	}
+	var k, v yamlv3.Node
+	k.SetString(key)
+	v.SetString(value)
+	node.Content = append(node.Content, &k, &v)
+}
+
+func loadKustomizationImages(content []byte) (*yamlv3.Node, []kustomizationImage, error) {
+	var doc yamlv3.Node
+	if e := yamlv3.Unmarshal(content, &doc); e != nil {
+		return nil, nil, e
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil, fmt.Errorf("empty kustomization")
+	}
+
+	images := make([]kustomizationImage, 0)
+	seq := mappingValue(doc.Content[0], "images")
+	if seq == nil {
+		return &doc, images, nil
+	}
+	for _, node := range seq.Content {
+		image := kustomizationImage{Tag: "latest", Unpinned: true, node: node}
+		if v := mappingValue(node, "name"); v != nil {
+			image.Name = v.Value
+		}
+		if v := mappingValue(node, "newName"); v != nil && v.Value != "" {
+			image.Name = v.Value
+		}
+		if v := mappingValue(node, "newTag"); v != nil && v.Value != "" {
+			image.Tag = v.Value
+			image.Unpinned = false
+		}
+		if v := mappingValue(node, "digest"); v != nil {
+			image.Digest = v.Value
+		}
+		images = append(images, image)
+	}
+	return &doc, images, nil
+}
+
+// PinnedImage is an image pinned by PinImages.
+type PinnedImage struct {
+	Name   string
+	Tag    string
+	Digest string
+}
+
+func (image PinnedImage) String() string {
+	return fmt.Sprintf("%s:%s@%s", image.Name, image.Tag, image.Digest)
+}
+
+// PinImages resolves tags of images in kustomization.yaml content to digests
+// and returns content with `digest` added to every entry.
+// newTag is kept, so that OutdatedImages knows which tag to follow.
+func PinImages(ctx context.Context, client *RegistryClient, content []byte) ([]byte, []PinnedImage, error) {
+	doc, images, e := loadKustomizationImages(content)
+	if e != nil {
+		return nil, nil, e
+	}
+
+	pinned := make([]PinnedImage, 0, len(images))
+	for _, image := range images {
+		digest, e := client.Digest(ctx, image.Name, image.Tag)
+		if e != nil {
+			return nil, nil, e
+		}
+		setMappingValue(image.node, "digest", digest)
+		pinned = append(pinned, PinnedImage{Name: image.Name, Tag: image.Tag, Digest: digest})
+	}
+
+	var out strings.Builder
+	encoder := yamlv3.NewEncoder(&out)
+	encoder.SetIndent(2)
+	if e := encoder.Encode(doc); e != nil {
+		return nil, nil, e
+	}
+	return []byte(out.String()), pinned, nil
+}
+
+// OutdatedImage is an image in kustomization.yaml which has newer tags,
+// whose tag has moved since it was pinned, or which has no newTag.
+type OutdatedImage struct {
+	Name          string
+	Tag           string
+	Digest        string
+	CurrentDigest string
+	NewerTags     []string
+	Unpinned      bool
+}
+
+func (image OutdatedImage) String() string {
+	lines := make([]string, 0, 3)
+	if image.Unpinned {
+		lines = append(lines, fmt.Sprintf("%s has no newTag and follows latest", image.Name))
+	}
+	if image.Digest != "" && image.Digest != image.CurrentDigest {
+		lines = append(lines, fmt.Sprintf("%s:%s moved from %s to %s", image.Name, image.Tag, image.Digest, image.CurrentDigest))
+	}
+	if len(image.NewerTags) > 0 {
+		lines = append(lines, fmt.Sprintf("%s:%s has newer tags: %s", image.Name, image.Tag, strings.Join(image.NewerTags, ", ")))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// OutdatedImages lists images in kustomization.yaml content which have
+// newer tags in registries, or whose pinned digest differs from the tag.
+func OutdatedImages(ctx context.Context, client *RegistryClient, content []byte) ([]OutdatedImage, error) {
+	_, images, e := loadKustomizationImages(content)
+	if e != nil {
+		return nil, e
+	}
+
+	outdated := make([]OutdatedImage, 0)
+	for _, image := range images {
+		tags, e := client.Tags(ctx, image.Name)
+		if e != nil {
+			return nil, e
+		}
+		result := OutdatedImage{
+			Name:      image.Name,
+			Tag:       image.Tag,
+			Digest:    image.Digest,
+			NewerTags: NewerTags(image.Tag, tags),
+			Unpinned:  image.Unpinned,
+		}
+		if image.Digest != "" {
+			if result.CurrentDigest, e = client.Digest(ctx, image.Name, image.Tag); e != nil {
+				return nil, e
+			}
+		}
+		if len(result.NewerTags) > 0 || result.Digest != result.CurrentDigest || result.Unpinned {
+			outdated = append(outdated, result)
+		}
+	}
+	return outdated, nil
+}
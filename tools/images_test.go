@@ -0,0 +1,164 @@
+package tools
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseImageName(t *testing.T) {
+	t.Parallel()
+
+	for image, expected := range map[string][2]string{
+		"postgres":                   {"registry-1.docker.io", "library/postgres"},
+		"denverquane/amongusdiscord": {"registry-1.docker.io", "denverquane/amongusdiscord"},
+		"gcr.io/project/scheduler":   {"gcr.io", "project/scheduler"},
+		"localhost:5000/redis":       {"localhost:5000", "redis"},
+	} {
+		registry, repository := ParseImageName(image)
+		if registry != expected[0] || repository != expected[1] {
+			t.Errorf("expected %s to be %v; got %s %s", image, expected, registry, repository)
+		}
+	}
+}
+
+func TestNewerTags(t *testing.T) {
+	t.Parallel()
+
+	tags := []string{"latest", "alpine", "12-alpine", "14-alpine", "13-alpine", "12.5-alpine", "13", "sha-528a327", "2.9.1", "2.10.0", "2.11.0-rc1"}
+	if newer := NewerTags("12-alpine", tags); !reflect.DeepEqual(newer, []string{"13-alpine", "14-alpine"}) {
+		t.Errorf("expected newer alpine tags; got %v", newer)
+	}
+	for _, current := range []string{"latest", "sha-528a327"} {
+		if newer := NewerTags(current, tags); !reflect.DeepEqual(newer, []string{"2.10.0"}) {
+			t.Errorf("expected newest release to be compared with %s; got %v", current, newer)
+		}
+	}
+	if newer := NewerTags("latest", []string{"latest", "alpine"}); len(newer) != 0 {
+		t.Errorf("expected nothing without releases; got %v", newer)
+	}
+}
+
+// registryStub is a local stand-in of a registry requiring bearer token.
+func registryStub(t *testing.T, digests map[string]string, tags []string) *httptest.Server {
+	var server *httptest.Server
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("scope") != "repository:automuteus/galactus:pull" {
+			t.Errorf("unexpected scope: %v", r.URL.Query())
+		}
+		fmt.Fprint(w, `{"token": "pull-token"}`)
+	})
+	mux.HandleFunc("/v2/automuteus/galactus/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer pull-token" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="stub",scope="repository:automuteus/galactus:pull"`, server.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		path := strings.TrimPrefix(r.URL.Path, "/v2/automuteus/galactus/")
+		switch {
+		case strings.HasPrefix(path, "manifests/"):
+			digest, ok := digests[strings.TrimPrefix(path, "manifests/")]
+			if !ok || r.Method != http.MethodHead {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if !strings.Contains(r.Header.Get("Accept"), "manifest.list.v2+json") {
+				t.Errorf("expected manifest list to be accepted; got %s", r.Header.Get("Accept"))
+			}
+			w.Header().Set("Docker-Content-Digest", digest)
+		case path == "tags/list" && r.URL.Query().Get("last") == "":
+			w.Header().Set("Link", `</v2/automuteus/galactus/tags/list?n=2&last=b>; rel="next"`)
+			fmt.Fprintf(w, `{"tags": ["%s"]}`, strings.Join(tags[:2], `", "`))
+		case path == "tags/list":
+			fmt.Fprintf(w, `{"tags": ["%s"]}`, strings.Join(tags[2:], `", "`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	server = httptest.NewTLSServer(mux)
+	return server
+}
+
+const imagesFixture = `apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+images:
+  - name: automuteus/galactus
+    newName: %s/automuteus/galactus
+    # newTag: sha-cf6b321
+    newTag: 2.4.1
+`
+
+func TestPinImages(t *testing.T) {
+	t.Parallel()
+
+	server := registryStub(t, map[string]string{"2.4.1": "sha256:aaaa"}, []string{"2.4.0", "2.4.1", "2.5.0", "latest"})
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "https://")
+	client := NewRegistryClient(server.Client())
+
+	content, pinned, e := PinImages(context.Background(), client, []byte(fmt.Sprintf(imagesFixture, host)))
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(pinned) != 1 || pinned[0].Digest != "sha256:aaaa" {
+		t.Errorf("expected galactus to be pinned; got %v", pinned)
+	}
+	for _, line := range []string{"# newTag: sha-cf6b321", "newTag: 2.4.1", "digest: sha256:aaaa"} {
+		if !strings.Contains(string(content), line) {
+			t.Errorf("expected %q in pinned kustomization; got\n%s", line, content)
+		}
+	}
+
+	outdated, e := OutdatedImages(context.Background(), client, content)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(outdated) != 1 || !reflect.DeepEqual(outdated[0].NewerTags, []string{"2.5.0"}) || outdated[0].CurrentDigest != "sha256:aaaa" {
+		t.Errorf("expected 2.5.0 to be newer; got %v", outdated)
+	}
+}
+
+func TestOutdatedImagesMovedTag(t *testing.T) {
+	t.Parallel()
+
+	server := registryStub(t, map[string]string{"2.4.1": "sha256:bbbb"}, []string{"2.4.0", "2.4.1"})
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "https://")
+	client := NewRegistryClient(server.Client())
+
+	content := fmt.Sprintf(imagesFixture, host) + "    digest: sha256:aaaa\n"
+	outdated, e := OutdatedImages(context.Background(), client, []byte(content))
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(outdated) != 1 || !strings.Contains(outdated[0].String(), "moved from sha256:aaaa to sha256:bbbb") {
+		t.Errorf("expected tag to be moved; got %v", outdated)
+	}
+}
+
+func TestOutdatedImagesUnpinned(t *testing.T) {
+	t.Parallel()
+
+	server := registryStub(t, map[string]string{}, []string{"2.4.0", "2.4.1", "latest"})
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "https://")
+	client := NewRegistryClient(server.Client())
+
+	content := strings.Replace(fmt.Sprintf(imagesFixture, host), "    newTag: 2.4.1\n", "", 1)
+	outdated, e := OutdatedImages(context.Background(), client, []byte(content))
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(outdated) != 1 || !outdated[0].Unpinned || !reflect.DeepEqual(outdated[0].NewerTags, []string{"2.4.1"}) {
+		t.Fatalf("expected image without newTag to be reported with newest release; got %v", outdated)
+	}
+	if !strings.Contains(outdated[0].String(), "has no newTag") {
+		t.Errorf("expected unpinned image to be told; got %q", outdated[0].String())
+	}
+}
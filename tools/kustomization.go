@@ -0,0 +1,349 @@
+package tools
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	goyaml "gopkg.in/yaml.v2"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	kustomize "sigs.k8s.io/kustomize/api/types"
+)
+
+// KustomizationTemplatePath is template of kustomization.yaml at the root of the repository.
+const KustomizationTemplatePath = "kustomization.yaml.template"
+
+// SecretSource reads payload of the secret pointed by handle.
+type SecretSource func(ctx context.Context, handle SecretHandle) ([]byte, error)
+
+// UnvailSecret reads the secret from Secret Manager.
+func UnvailSecret(ctx context.Context, handle SecretHandle) ([]byte, error) {
+	return handle.Unvail(ctx)
+}
+
+// KustomizationRenderer renders kustomization.yaml of the environment;
+// DefaultEnvironment is rendered from its template, and others are rendered
+// on top of their overlays.
+// Tenants are rendered along with DefaultEnvironment on top of their overlays.
+// Lookups of secrets, ingress IP, project ID and addresses of managed backends
+// are replaceable for testing.
+type KustomizationRenderer struct {
+	Config                Config
+	Environment           EnvironmentConfig
+	TemplatePath          string
+	BaseKustomizationPath string
+	SecretManifestsDir    string
+	Secrets               SecretSource
+	IngressIP             func(ctx context.Context) (string, error)
+	TenantIngressIP       func(ctx context.Context, tenant TenantConfig) (string, error)
+	ProjectID             func(ctx context.Context) (string, error)
+	BackendAddrs          func(ctx context.Context) (BackendAddrs, error)
+}
+
+// NewKustomizationRenderer builds KustomizationRenderer of env looking up
+// Secret Manager, terraform state and Google Cloud.
+func NewKustomizationRenderer(config Config, env EnvironmentConfig) KustomizationRenderer {
+	return KustomizationRenderer{
+		Config:                config,
+		Environment:           env,
+		TemplatePath:          KustomizationTemplatePath,
+		BaseKustomizationPath: BaseKustomizationPath,
+		SecretManifestsDir:    SecretManifestsDir,
+		Secrets:               UnvailSecret,
+		IngressIP: func(context.Context) (string, error) {
+			return env.IngressIP(config)
+		},
+		TenantIngressIP: func(_ context.Context, tenant TenantConfig) (string, error) {
+			return tenant.IngressIP(config)
+		},
+		ProjectID: GetProjectID,
+		BackendAddrs: func(context.Context) (BackendAddrs, error) {
+			return config.BackendAddrs()
+		},
+	}
+}
+
+// kustomizationTemplateData is data of kustomization.yaml.template.
+// IngressIP shadows Config.IngressIP, so that the address is resolved by the renderer.
+type kustomizationTemplateData struct {
+	Config
+	IngressIP string
+}
+
+// Overlay renders overlay of the environment, which should be written
+// to its OverlayPath before Render.
+func (r KustomizationRenderer) Overlay(ctx context.Context) (kustomize.Kustomization, error) {
+	ingressIP, e := r.IngressIP(ctx)
+	if e != nil {
+		return kustomize.Kustomization{}, e
+	}
+	overlay, e := NewOverlay(r.Environment, ingressIP)
+	if e != nil {
+		return overlay, e
+	}
+
+	addrs, e := r.backendAddrs(ctx)
+	if e != nil {
+		return overlay, e
+	}
+	return overlay, AddBackendsToKustomization(&overlay, addrs, "")
+}
+
+// TenantOverlay renders overlay of the tenant, which should be written
+// to its OverlayPath before Render.
+func (r KustomizationRenderer) TenantOverlay(ctx context.Context, tenant TenantConfig) (kustomize.Kustomization, error) {
+	ingressIP, e := r.TenantIngressIP(ctx, tenant)
+	if e != nil {
+		return kustomize.Kustomization{}, e
+	}
+	addrs, e := r.backendAddrs(ctx)
+	if e != nil {
+		return kustomize.Kustomization{}, e
+	}
+	return NewTenantOverlay(tenant, ingressIP, addrs.tenantPostgresAddr())
+}
+
+// addBackends replaces backends of the default stack with managed ones,
+// leaving tenants as their overlays patched.
+func (r KustomizationRenderer) addBackends(ctx context.Context, k *kustomize.Kustomization) error {
+	addrs, e := r.backendAddrs(ctx)
+	if e != nil {
+		return e
+	}
+	return AddBackendsToKustomization(k, addrs, "!"+TenantLabel)
+}
+
+// backendAddrs returns addresses of managed backends, looking them up only if configured.
+func (r KustomizationRenderer) backendAddrs(ctx context.Context) (BackendAddrs, error) {
+	if e := r.Config.validateBackends(); e != nil {
+		return BackendAddrs{}, e
+	}
+	if !r.Config.HasManagedBackends() {
+		return BackendAddrs{}, nil
+	}
+	return r.BackendAddrs(ctx)
+}
+
+// Overlays renders overlays which kustomization of the environment refers to,
+// keyed by their paths: one of the environment, or ones of tenants of DefaultEnvironment.
+func (r KustomizationRenderer) Overlays(ctx context.Context) (map[string]kustomize.Kustomization, error) {
+	overlays := map[string]kustomize.Kustomization{}
+	if !r.Environment.IsDefault() {
+		if e := r.Environment.Validate(); e != nil {
+			return nil, e
+		}
+		overlay, e := r.Overlay(ctx)
+		if e != nil {
+			return nil, e
+		}
+		overlays[r.Environment.OverlayPath()] = overlay
+		return overlays, nil
+	}
+
+	if e := r.Config.ValidateTenants(); e != nil {
+		return nil, e
+	}
+	for _, tenant := range r.Config.Tenants {
+		overlay, e := r.TenantOverlay(ctx, tenant)
+		if e != nil {
+			return nil, e
+		}
+		overlays[tenant.OverlayPath()] = overlay
+	}
+	return overlays, nil
+}
+
+// tenants returns tenants rendered along with the environment.
+func (r KustomizationRenderer) tenants() []TenantConfig {
+	if r.Environment.IsDefault() {
+		return r.Config.Tenants
+	}
+	return nil
+}
+
+// Render renders kustomization with secrets read from r.Secrets.
+// With secret_sync, secrets are left to the in-cluster controller instead.
+func (r KustomizationRenderer) Render(ctx context.Context) (kustomize.Kustomization, error) {
+	var kustomization kustomize.Kustomization
+	var e error
+
+	if r.Environment.IsDefault() {
+		kustomization, e = r.renderTemplate(ctx)
+		if e == nil {
+			e = r.addBackends(ctx, &kustomization)
+		}
+	} else {
+		kustomization = kustomize.Kustomization{
+			Bases:     []string{"./" + r.Environment.OverlayPath()},
+			Namespace: r.Environment.Namespace,
+		}
+	}
+	if e != nil {
+		return kustomization, e
+	}
+
+	if e = AddSchedulerToKustomization(&kustomization, r.Config, r.Environment); e != nil {
+		return kustomization, e
+	}
+
+	if e = AddSnapshotsToKustomization(&kustomization, r.Config, r.Environment); e != nil {
+		return kustomization, e
+	}
+
+	if r.Config.ScheduledBackup() {
+		projectID, e := r.ProjectID(ctx)
+		if e != nil {
+			return kustomization, e
+		}
+		base, e := LoadKustomization(r.BaseKustomizationPath)
+		if e != nil {
+			return kustomization, e
+		}
+		if e = AddBackupToKustomization(&kustomization, r.Config, projectID, base.Images); e != nil {
+			return kustomization, e
+		}
+	}
+
+	tenants := r.tenants()
+	if len(tenants) > 0 {
+		if e = r.Config.ValidateTenants(); e != nil {
+			return kustomization, e
+		}
+	}
+	for _, tenant := range tenants {
+		kustomization.Resources = append(kustomization.Resources, "./"+tenant.OverlayPath())
+	}
+
+	if r.Config.SecretSync != nil {
+		if len(tenants) > 0 {
+			return kustomization, fmt.Errorf("secret_sync doesn't support tenants; secrets of tenants would be left out")
+		}
+		projectID, e := r.ProjectID(ctx)
+		if e != nil {
+			return kustomization, e
+		}
+		return kustomization, AddSecretSyncToKustomization(&kustomization, r.Config, projectID, r.SecretManifestsDir)
+	}
+
+	secrets, e := LoadSecretManifests(r.SecretManifestsDir)
+	if e != nil {
+		return kustomization, e
+	}
+
+	for _, secret := range secrets {
+		secretArgs, e := r.secretArgs(ctx, secret.Name, secret.Namespace, r.Environment.NewSecretHandles(secret))
+		if e != nil {
+			return kustomization, e
+		}
+		kustomization.SecretGenerator = append(kustomization.SecretGenerator, secretArgs)
+
+		for _, tenant := range tenants {
+			secretArgs, e := r.secretArgs(ctx, secret.Name, tenant.Namespace, tenant.NewSecretHandles(secret))
+			if e != nil {
+				return kustomization, e
+			}
+			kustomization.SecretGenerator = append(kustomization.SecretGenerator, secretArgs)
+		}
+	}
+	if len(kustomization.SecretGenerator) > 0 {
+		kustomization.GeneratorOptions = &kustomize.GeneratorOptions{
+			DisableNameSuffixHash: false,
+		}
+	}
+
+	return kustomization, nil
+}
+
+// Build renders overlays and kustomization of r, and builds them in dir
+// without writing either to disk, as `mage deploy` does.
+func (r KustomizationRenderer) Build(ctx context.Context, dir string) ([]*unstructured.Unstructured, error) {
+	overlays, e := r.Overlays(ctx)
+	if e != nil {
+		return nil, e
+	}
+	k, e := r.Render(ctx)
+	if e != nil {
+		return nil, e
+	}
+	return BuildKustomizationWithOverlays(dir, k, overlays)
+}
+
+// secretArgs generates secret named name in namespace from handles.
+func (r KustomizationRenderer) secretArgs(ctx context.Context, name string, namespace string, handles []SecretHandle) (kustomize.SecretArgs, error) {
+	var literalSources []string
+
+	for _, handle := range handles {
+		payload, e := r.Secrets(ctx, handle)
+		if e != nil {
+			return kustomize.SecretArgs{}, fmt.Errorf("failed to read %s: %v", handle.String(), e)
+		}
+
+		literalSources = append(literalSources, fmt.Sprintf("%s=%s", handle.Key, string(payload)))
+	}
+
+	return kustomize.SecretArgs{
+		GeneratorArgs: kustomize.GeneratorArgs{
+			Namespace: namespace,
+			Name:      name,
+			Behavior:  "create",
+			KvPairSources: kustomize.KvPairSources{
+				LiteralSources: literalSources,
+			},
+		},
+	}, nil
+}
+
+// renderTemplate renders kustomization.yaml.template of DefaultEnvironment.
+func (r KustomizationRenderer) renderTemplate(ctx context.Context) (kustomize.Kustomization, error) {
+	var kustomization kustomize.Kustomization
+
+	ingressIP, e := r.IngressIP(ctx)
+	if e != nil {
+		return kustomization, e
+	}
+
+	yamlfile, e := os.Open(r.TemplatePath)
+	if e != nil {
+		return kustomization, e
+	}
+	defer yamlfile.Close()
+
+	templatedYamlFile, e := ApplyTextTemplate(yamlfile, kustomizationTemplateData{Config: r.Config, IngressIP: ingressIP})
+	if e != nil {
+		return kustomization, e
+	}
+
+	e = yaml.NewYAMLOrJSONDecoder(templatedYamlFile, 4096).Decode(&kustomization)
+	return kustomization, e
+}
+
+// LoadKustomization reads kustomization.yaml at path.
+func LoadKustomization(path string) (kustomize.Kustomization, error) {
+	var kustomization kustomize.Kustomization
+
+	yamlfile, e := os.Open(path)
+	if e != nil {
+		return kustomization, e
+	}
+	defer yamlfile.Close()
+
+	e = yaml.NewYAMLOrJSONDecoder(yamlfile, 4096).Decode(&kustomization)
+	return kustomization, e
+}
+
+// findImage returns the image named name in images.
+func findImage(images []kustomize.Image, name string) (kustomize.Image, bool) {
+	for _, image := range images {
+		if image.Name == name {
+			return image, true
+		}
+	}
+	return kustomize.Image{}, false
+}
+
+// WriteKustomization writes k as kustomization.yaml.
+func WriteKustomization(out io.Writer, k kustomize.Kustomization) error {
+	return goyaml.NewEncoder(out).Encode(k)
+}
@@ -0,0 +1,205 @@
+package tools
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+var update = flag.Bool("update", false, "update golden files in testdata")
+
+func fakeRenderer(config Config) KustomizationRenderer {
+	return KustomizationRenderer{
+		Config:                config,
+		TemplatePath:          "../" + KustomizationTemplatePath,
+		BaseKustomizationPath: "../" + BaseKustomizationPath,
+		SecretManifestsDir:    "../" + SecretManifestsDir,
+		Secrets: func(ctx context.Context, handle SecretHandle) ([]byte, error) {
+			if handle.Namespace != "" {
+				return []byte(fmt.Sprintf("fake-%s-%s", handle.Namespace, strings.ToLower(handle.Key))), nil
+			}
+			return []byte(fmt.Sprintf("fake-%s", strings.ToLower(handle.Key))), nil
+		},
+		IngressIP: func(context.Context) (string, error) {
+			return "203.0.113.10", nil
+		},
+		TenantIngressIP: func(_ context.Context, tenant TenantConfig) (string, error) {
+			if tenant.IngressIPResourceID != "" {
+				return "203.0.113.20", nil
+			}
+			return "203.0.113.10", nil
+		},
+		ProjectID: func(context.Context) (string, error) {
+			return "project", nil
+		},
+		BackendAddrs: func(context.Context) (BackendAddrs, error) {
+			var addrs BackendAddrs
+			if config.DatabaseMode() == DatabaseCloudSQL {
+				addrs.Postgres = "10.20.0.3:5432"
+			}
+			if config.CacheMode() == CacheMemorystore {
+				addrs.Redis = "10.20.0.4:6378"
+			}
+			return addrs, nil
+		},
+	}
+}
+
+// overlayRoot makes repository-like directory with kubernetes/base linked,
+// so that overlays can be built without touching the repository.
+func overlayRoot(t *testing.T) string {
+	root := t.TempDir()
+	base, e := filepath.Abs("../kubernetes/base")
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e := os.MkdirAll(filepath.Join(root, "kubernetes"), 0755); e != nil {
+		t.Fatal(e)
+	}
+	if e := os.Symlink(base, filepath.Join(root, "kubernetes", "base")); e != nil {
+		t.Fatal(e)
+	}
+	return root
+}
+
+// buildObjects builds kustomization of renderer with its overlays in overlayRoot,
+// checking that the overlays are never written to disk.
+func buildObjects(t *testing.T, renderer KustomizationRenderer) []*unstructured.Unstructured {
+	t.Helper()
+	root := overlayRoot(t)
+	objs, e := renderer.Build(context.Background(), root)
+	if e != nil {
+		t.Fatal(e)
+	}
+	for _, dir := range []string{"kubernetes/overlays", "kubernetes/tenants"} {
+		if _, e := os.Stat(filepath.Join(root, dir)); !os.IsNotExist(e) {
+			t.Errorf("expected overlays not to be written to disk; got %v", e)
+		}
+	}
+	return objs
+}
+
+func findObject(objs []*unstructured.Unstructured, kind string, namePrefix string) *unstructured.Unstructured {
+	for _, obj := range objs {
+		if obj.GetKind() == kind && strings.HasPrefix(obj.GetName(), namePrefix) {
+			return obj
+		}
+	}
+	return nil
+}
+
+func findNamespacedObject(objs []*unstructured.Unstructured, namespace string, kind string, namePrefix string) *unstructured.Unstructured {
+	for _, obj := range objs {
+		if obj.GetNamespace() == namespace {
+			if found := findObject([]*unstructured.Unstructured{obj}, kind, namePrefix); found != nil {
+				return found
+			}
+		}
+	}
+	return nil
+}
+
+// mustFindObject is findNamespacedObject failing the test if nothing is found.
+func mustFindObject(t *testing.T, objs []*unstructured.Unstructured, namespace string, kind string, namePrefix string) *unstructured.Unstructured {
+	t.Helper()
+	obj := findNamespacedObject(objs, namespace, kind, namePrefix)
+	if obj == nil {
+		t.Fatalf("expected %s %s in namespace %q", kind, namePrefix, namespace)
+	}
+	return obj
+}
+
+// nestedFirst returns the first element of the list at fields of obj,
+// like the first container, failing the test unless it is an object.
+// Fields are looked up without copying, since numbers built by kustomize
+// may not be JSON compatible.
+func nestedFirst(t *testing.T, obj map[string]interface{}, fields ...string) map[string]interface{} {
+	t.Helper()
+	value, found, e := unstructured.NestedFieldNoCopy(obj, fields...)
+	if e != nil || !found {
+		t.Fatalf("expected %s to exist; got %v", strings.Join(fields, "."), e)
+	}
+	list, ok := value.([]interface{})
+	if !ok || len(list) == 0 {
+		t.Fatalf("expected %s to be a non-empty list; got %v", strings.Join(fields, "."), value)
+	}
+	first, ok := list[0].(map[string]interface{})
+	if !ok {
+		t.Fatalf("expected %s to be a list of objects; got %v", strings.Join(fields, "."), list[0])
+	}
+	return first
+}
+
+func TestRenderKustomization(t *testing.T) {
+	t.Parallel()
+
+	k, e := fakeRenderer(Config{}).Render(context.Background())
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	var out bytes.Buffer
+	if e := WriteKustomization(&out, k); e != nil {
+		t.Fatal(e)
+	}
+	golden := "testdata/kustomization.golden.yaml"
+	if *update {
+		if e := ioutil.WriteFile(golden, out.Bytes(), 0644); e != nil {
+			t.Fatal(e)
+		}
+	}
+	expected, e := ioutil.ReadFile(golden)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if !bytes.Equal(out.Bytes(), expected) {
+		t.Errorf("kustomization.yaml differs from %s (run `go test ./tools -update` if intended):\n%s", golden, out.String())
+	}
+
+	objs, e := BuildKustomizationInMemory("..", k)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	broker := findObject(objs, "Service", "broker")
+	if ip, _, _ := unstructured.NestedString(broker.Object, "spec", "loadBalancerIP"); ip != "203.0.113.10" {
+		t.Errorf("expected broker to have loadBalancerIP of ingress; got %q", ip)
+	}
+	discovery := findObject(objs, "ConfigMap", "discovery-")
+	if url, _, _ := unstructured.NestedString(discovery.Object, "data", "GALACTUS_EXTERNAL_URL"); url != "http://203.0.113.10/" {
+		t.Errorf("expected GALACTUS_EXTERNAL_URL to point the ingress; got %q", url)
+	}
+	secret := findObject(objs, "Secret", "postgres-")
+	if password, _, _ := unstructured.NestedString(secret.Object, "data", "POSTGRES_PASSWORD"); password != "ZmFrZS1wb3N0Z3Jlc19wYXNzd29yZA==" {
+		t.Errorf("expected POSTGRES_PASSWORD to be read from secret source; got %q", password)
+	}
+}
+
+func TestRenderKustomizationWithSecretSync(t *testing.T) {
+	t.Parallel()
+
+	config := Config{SecretSync: &SecretSyncConfig{Image: "gcr.io/project/automutek8s-secretsync:v1"}}
+	renderer := fakeRenderer(config)
+	renderer.Secrets = func(ctx context.Context, handle SecretHandle) ([]byte, error) {
+		return nil, fmt.Errorf("secrets should be left to secretsync")
+	}
+
+	k, e := renderer.Render(context.Background())
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(k.SecretGenerator) != 0 {
+		t.Errorf("expected no secret generator; got %v", k.SecretGenerator)
+	}
+	if !strings.Contains(k.Patches[0].Patch, "automutek8s-secretsync@project.iam.gserviceaccount.com") {
+		t.Errorf("expected service account of project; got %v", k.Patches)
+	}
+}
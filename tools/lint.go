@@ -0,0 +1,437 @@
+package tools
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	kustomize "sigs.k8s.io/kustomize/api/types"
+)
+
+// LintProblem is an inconsistency found in manifests by LintManifests.
+type LintProblem struct {
+	File    string
+	Message string
+}
+
+func (problem LintProblem) String() string {
+	return fmt.Sprintf("%s: %s", problem.File, problem.Message)
+}
+
+// renderedImages are replaced with images in config.yaml by Kustomization,
+// so that they don't have tags in manifests.
+var renderedImages = map[string]bool{
+	SchedulerImage:  true,
+	SecretSyncImage: true,
+	SnapshotImage:   true,
+}
+
+var varReferencePattern = regexp.MustCompile(`\$\(([A-Za-z_][A-Za-z0-9_]*)\)`)
+
+type lintWorkload struct {
+	file     string
+	name     string
+	template corev1.PodTemplateSpec
+}
+
+type lintService struct {
+	file    string
+	service corev1.Service
+}
+
+type lintDocument struct {
+	file   string
+	keys   map[string]string
+	source string
+}
+
+// linter is what LintManifests has learned from manifests.
+type linter struct {
+	dir        string
+	problems   []LintProblem
+	configMaps map[string]map[string]bool
+	secrets    map[string]map[string]bool
+	generated  map[string]map[string]string
+	documents  []lintDocument
+	images     map[string]kustomize.Image
+	workloads  []lintWorkload
+	services   []lintService
+}
+
+// LintManifests parses every manifest under dir and reports inconsistencies
+// between them: missing ConfigMaps, Secrets and keys referenced by containers,
+// containers without requests or limits, services selecting no pods and
+// images tagged `latest`.
+func LintManifests(dir string) ([]LintProblem, error) {
+	l := &linter{
+		dir:        dir,
+		configMaps: map[string]map[string]bool{},
+		secrets:    map[string]map[string]bool{},
+		generated:  map[string]map[string]string{},
+		images:     map[string]kustomize.Image{},
+	}
+
+	e := filepath.Walk(dir, func(path string, info os.FileInfo, e error) error {
+		if e != nil {
+			return e
+		}
+		if info.IsDir() || (filepath.Ext(path) != ".yaml" && filepath.Ext(path) != ".yml") {
+			return nil
+		}
+		return l.load(path)
+	})
+	if e != nil {
+		return nil, e
+	}
+
+	l.lintDocuments()
+	for _, workload := range l.workloads {
+		l.lintWorkload(workload)
+	}
+	for _, service := range l.services {
+		l.lintService(service)
+	}
+
+	sort.SliceStable(l.problems, func(i, j int) bool {
+		return l.problems[i].File < l.problems[j].File
+	})
+	return l.problems, nil
+}
+
+func (l *linter) report(file string, format string, args ...interface{}) {
+	l.problems = append(l.problems, LintProblem{File: file, Message: fmt.Sprintf(format, args...)})
+}
+
+func (l *linter) relative(path string) string {
+	if rel, e := filepath.Rel(l.dir, path); e == nil {
+		return filepath.ToSlash(rel)
+	}
+	return path
+}
+
+func addKeys(sources map[string]map[string]bool, name string, keys map[string]string) {
+	if sources[name] == nil {
+		sources[name] = map[string]bool{}
+	}
+	for key := range keys {
+		sources[name][key] = true
+	}
+}
+
+// load reads every document in the file at path.
+func (l *linter) load(path string) error {
+	f, e := os.Open(path)
+	if e != nil {
+		return e
+	}
+	defer f.Close()
+
+	file := l.relative(path)
+	decoder := yaml.NewYAMLOrJSONDecoder(f, 4096)
+	for {
+		var raw runtime.RawExtension
+		if e := decoder.Decode(&raw); e == io.EOF {
+			return nil
+		} else if e != nil {
+			return fmt.Errorf("%s: %v", file, e)
+		}
+		if len(raw.Raw) == 0 {
+			continue
+		}
+		if e := l.loadDocument(path, file, raw.Raw); e != nil {
+			return fmt.Errorf("%s: %v", file, e)
+		}
+	}
+}
+
+func (l *linter) loadDocument(path string, file string, raw []byte) error {
+	var typeMeta metav1.TypeMeta
+	if e := json.Unmarshal(raw, &typeMeta); e != nil {
+		return e
+	}
+
+	switch typeMeta.Kind {
+	case "Kustomization":
+		var k kustomize.Kustomization
+		if e := json.Unmarshal(raw, &k); e != nil {
+			return e
+		}
+		return l.loadKustomization(filepath.Dir(path), file, k)
+	case "ConfigMap":
+		var configMap corev1.ConfigMap
+		if e := json.Unmarshal(raw, &configMap); e != nil {
+			return e
+		}
+		l.documents = append(l.documents, lintDocument{file: file, keys: configMap.Data, source: configMap.Name})
+		addKeys(l.configMaps, configMap.Name, configMap.Data)
+	case "Secret":
+		var secret corev1.Secret
+		if e := json.Unmarshal(raw, &secret); e != nil {
+			return e
+		}
+		keys := map[string]string{}
+		for key := range secret.Data {
+			keys[key] = ""
+		}
+		for key := range secret.StringData {
+			keys[key] = ""
+		}
+		addKeys(l.secrets, secret.Name, keys)
+	case "Deployment":
+		var deployment appsv1.Deployment
+		if e := json.Unmarshal(raw, &deployment); e != nil {
+			return e
+		}
+		l.workloads = append(l.workloads, lintWorkload{file: file, name: deployment.Name, template: deployment.Spec.Template})
+	case "StatefulSet":
+		var statefulSet appsv1.StatefulSet
+		if e := json.Unmarshal(raw, &statefulSet); e != nil {
+			return e
+		}
+		l.workloads = append(l.workloads, lintWorkload{file: file, name: statefulSet.Name, template: statefulSet.Spec.Template})
+	case "CronJob":
+		var cronJob batchv1beta1.CronJob
+		if e := json.Unmarshal(raw, &cronJob); e != nil {
+			return e
+		}
+		l.workloads = append(l.workloads, lintWorkload{file: file, name: cronJob.Name, template: cronJob.Spec.JobTemplate.Spec.Template})
+	case "Service":
+		var service corev1.Service
+		if e := json.Unmarshal(raw, &service); e != nil {
+			return e
+		}
+		l.services = append(l.services, lintService{file: file, service: service})
+	}
+	return nil
+}
+
+func (l *linter) loadKustomization(dir string, file string, k kustomize.Kustomization) error {
+	for _, generator := range k.ConfigMapGenerator {
+		keys, e := generatorKeys(dir, generator.KvPairSources)
+		if e != nil {
+			return e
+		}
+		addKeys(l.configMaps, generator.Name, keys)
+		if l.generated[generator.Name] == nil {
+			l.generated[generator.Name] = map[string]string{}
+		}
+		for key, value := range keys {
+			l.generated[generator.Name][key] = value
+		}
+	}
+	for _, generator := range k.SecretGenerator {
+		keys, e := generatorKeys(dir, generator.KvPairSources)
+		if e != nil {
+			return e
+		}
+		addKeys(l.secrets, generator.Name, keys)
+	}
+	for _, image := range k.Images {
+		l.images[image.Name] = image
+	}
+	return nil
+}
+
+func addKeyValue(keys map[string]string, kv string) {
+	pair := strings.SplitN(kv, "=", 2)
+	if len(pair) == 2 {
+		keys[pair[0]] = pair[1]
+	} else {
+		keys[pair[0]] = ""
+	}
+}
+
+// generatorKeys returns keys and values given by literals, env files and files of a generator.
+func generatorKeys(dir string, sources kustomize.KvPairSources) (map[string]string, error) {
+	keys := map[string]string{}
+	for _, literal := range sources.LiteralSources {
+		addKeyValue(keys, literal)
+	}
+	for _, source := range sources.FileSources {
+		kv := strings.SplitN(source, "=", 2)
+		keys[filepath.Base(kv[0])] = ""
+	}
+
+	for _, env := range sources.EnvSources {
+		f, e := os.Open(filepath.Join(dir, env))
+		if e != nil {
+			return nil, e
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			addKeyValue(keys, line)
+		}
+		f.Close()
+		if e := scanner.Err(); e != nil {
+			return nil, e
+		}
+	}
+	return keys, nil
+}
+
+// lintDocuments reports ConfigMaps documenting generated ones but disagreeing with the generator.
+// Values left empty in documents are placeholders and not compared.
+func (l *linter) lintDocuments() {
+	for _, document := range l.documents {
+		generated, ok := l.generated[document.source]
+		if !ok {
+			continue
+		}
+		for _, key := range sortedKeys(document.keys) {
+			value, ok := generated[key]
+			if !ok {
+				l.report(document.file, "%s is not in configMapGenerator %s", key, document.source)
+			} else if document.keys[key] != "" && document.keys[key] != value {
+				l.report(document.file, "%s is %q but configMapGenerator %s gives %q", key, document.keys[key], document.source, value)
+			}
+		}
+	}
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (l *linter) lintWorkload(workload lintWorkload) {
+	for _, container := range workload.template.Spec.InitContainers {
+		l.lintContainer(workload, container)
+	}
+	for _, container := range workload.template.Spec.Containers {
+		l.lintContainer(workload, container)
+	}
+}
+
+func (l *linter) lintContainer(workload lintWorkload, container corev1.Container) {
+	file := workload.file
+	where := fmt.Sprintf("container %s of %s", container.Name, workload.name)
+
+	defined := map[string]bool{}
+	for _, envFrom := range container.EnvFrom {
+		var keys map[string]bool
+		var ok bool
+		if ref := envFrom.ConfigMapRef; ref != nil {
+			if keys, ok = l.configMaps[ref.Name]; !ok && !optional(ref.Optional) {
+				l.report(file, "%s refers to ConfigMap %s which does not exist", where, ref.Name)
+			}
+		}
+		if ref := envFrom.SecretRef; ref != nil {
+			if keys, ok = l.secrets[ref.Name]; !ok && !optional(ref.Optional) {
+				l.report(file, "%s refers to Secret %s which does not exist", where, ref.Name)
+			}
+		}
+		for key := range keys {
+			defined[envFrom.Prefix+key] = true
+		}
+	}
+
+	for _, env := range container.Env {
+		l.lintVarReferences(file, where, env.Value, defined)
+		defined[env.Name] = true
+
+		if env.ValueFrom == nil {
+			continue
+		}
+		if ref := env.ValueFrom.ConfigMapKeyRef; ref != nil && !optional(ref.Optional) {
+			if keys, ok := l.configMaps[ref.Name]; !ok {
+				l.report(file, "%s refers to ConfigMap %s which does not exist", where, ref.Name)
+			} else if !keys[ref.Key] {
+				l.report(file, "%s refers to %s which is not in ConfigMap %s", where, ref.Key, ref.Name)
+			}
+		}
+		if ref := env.ValueFrom.SecretKeyRef; ref != nil && !optional(ref.Optional) {
+			if keys, ok := l.secrets[ref.Name]; !ok {
+				l.report(file, "%s refers to Secret %s which does not exist", where, ref.Name)
+			} else if !keys[ref.Key] {
+				l.report(file, "%s refers to %s which is not in Secret %s", where, ref.Key, ref.Name)
+			}
+		}
+	}
+	for _, arg := range append(append([]string{}, container.Command...), container.Args...) {
+		l.lintVarReferences(file, where, arg, defined)
+	}
+
+	if len(container.Resources.Requests) == 0 {
+		l.report(file, "%s has no resource requests", where)
+	}
+	if len(container.Resources.Limits) == 0 {
+		l.report(file, "%s has no resource limits", where)
+	}
+
+	l.lintImage(file, where, container.Image)
+}
+
+func optional(b *bool) bool {
+	return b != nil && *b
+}
+
+func (l *linter) lintVarReferences(file string, where string, value string, defined map[string]bool) {
+	for _, match := range varReferencePattern.FindAllStringSubmatch(value, -1) {
+		if !defined[match[1]] {
+			l.report(file, "%s refers to $(%s) which is defined by no envFrom source", where, match[1])
+		}
+	}
+}
+
+func (l *linter) lintImage(file string, where string, image string) {
+	name, tag, digest := splitImage(image)
+	if renderedImages[name] {
+		return
+	}
+	if override, ok := l.images[name]; ok {
+		if override.NewName != "" {
+			name = override.NewName
+		}
+		if override.NewTag != "" {
+			tag = override.NewTag
+		}
+		if override.Digest != "" {
+			digest = override.Digest
+		}
+	}
+	if digest == "" && (tag == "" || tag == "latest") {
+		l.report(file, "%s uses image %s:latest", where, name)
+	}
+}
+
+func (l *linter) lintService(s lintService) {
+	selector := s.service.Spec.Selector
+	if len(selector) == 0 {
+		return
+	}
+	for _, workload := range l.workloads {
+		if selects(selector, workload.template.Labels) {
+			return
+		}
+	}
+	l.report(s.file, "service %s selects no pods", s.service.Name)
+}
+
+func selects(selector map[string]string, labels map[string]string) bool {
+	for key, value := range selector {
+		if labels[key] != value {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,122 @@
+package tools
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLintManifestsBase(t *testing.T) {
+	t.Parallel()
+
+	problems, e := LintManifests("../kubernetes/base")
+	if e != nil {
+		t.Fatal(e)
+	}
+	for _, problem := range problems {
+		// images are pinned by images:pin
+		if !strings.HasSuffix(problem.Message, ":latest") {
+			t.Errorf("unexpected problem in kubernetes/base: %v", problem)
+		}
+	}
+}
+
+const lintFixture = `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  template:
+    metadata:
+      labels:
+        app: web
+    spec:
+      containers:
+      - name: web
+        image: nginx
+        resources:
+          limits:
+            memory: "16Mi"
+        envFrom:
+        - configMapRef:
+            name: web-config
+        - secretRef:
+            name: missing
+        env:
+        - name: PASS
+          value: $(PASSWORD)
+        - name: MODE
+          valueFrom:
+            configMapKeyRef:
+              name: web-config
+              key: MODE
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: api
+spec:
+  selector:
+    app: api
+`
+
+const lintKustomizationFixture = `apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+resources:
+- ./web.yaml
+configMapGenerator:
+- name: web-config
+  literals:
+  - PORT=8080
+images:
+- name: nginx
+  newTag: latest
+`
+
+const lintConfigMapFixture = `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: web-config
+data:
+  PORT: "80"
+  HOST: ""
+`
+
+func TestLintManifests(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"web.yaml":           lintFixture,
+		"kustomization.yaml": lintKustomizationFixture,
+		"configmap.yaml":     lintConfigMapFixture,
+	} {
+		if e := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); e != nil {
+			t.Fatal(e)
+		}
+	}
+
+	problems, e := LintManifests(dir)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	var got []string
+	for _, problem := range problems {
+		got = append(got, problem.String())
+	}
+	expected := []string{
+		`configmap.yaml: HOST is not in configMapGenerator web-config`,
+		`configmap.yaml: PORT is "80" but configMapGenerator web-config gives "8080"`,
+		`web.yaml: container web of web refers to Secret missing which does not exist`,
+		`web.yaml: container web of web refers to $(PASSWORD) which is defined by no envFrom source`,
+		`web.yaml: container web of web refers to MODE which is not in ConfigMap web-config`,
+		`web.yaml: container web of web has no resource requests`,
+		`web.yaml: container web of web uses image nginx:latest`,
+		`web.yaml: service api selects no pods`,
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(got, "\n"))
+	}
+}
@@ -0,0 +1,305 @@
+package tools
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"google.golang.org/api/compute/v1"
+)
+
+// NodePoolConfig is schema of each item in node_pools block in config.yaml
+type NodePoolConfig struct {
+	Name        string            `json:"name"`
+	MachineType string            `json:"machine_type"`
+	Spot        bool              `json:"spot"`
+	Preemptible bool              `json:"preemptible"`
+	DiskSizeGB  int               `json:"disk_size_gb"`
+	MinNodes    int               `json:"min_node_count"`
+	MaxNodes    int               `json:"max_node_count"`
+	Labels      map[string]string `json:"labels"`
+	Taints      []NodeTaintConfig `json:"taints"`
+}
+
+// NodeTaintConfig is schema of each item in taints block of node pool.
+type NodeTaintConfig struct {
+	Key    string `json:"key"`
+	Value  string `json:"value"`
+	Effect string `json:"effect"`
+}
+
+// ClusterAutoscalingConfig is schema of cluster_autoscaling block in config.yaml
+type ClusterAutoscalingConfig struct {
+	MinCPU      int `json:"min_cpu"`
+	MaxCPU      int `json:"max_cpu"`
+	MinMemoryGB int `json:"min_memory_gb"`
+	MaxMemoryGB int `json:"max_memory_gb"`
+}
+
+// MachineTypeSpec is amount of resources provided by single node.
+type MachineTypeSpec struct {
+	CPU      int
+	MemoryGB float64
+}
+
+var defaultNodePool = NodePoolConfig{
+	Name:        "primary-pool",
+	MachineType: "e2-micro",
+	Preemptible: true,
+	DiskSizeGB:  10,
+	MinNodes:    0,
+	MaxNodes:    4,
+}
+
+var defaultClusterAutoscaling = ClusterAutoscalingConfig{
+	MinCPU:      0,
+	MaxCPU:      8,
+	MinMemoryGB: 0,
+	MaxMemoryGB: 4,
+}
+
+var taintEffects = map[string]bool{
+	"NO_SCHEDULE":        true,
+	"PREFER_NO_SCHEDULE": true,
+	"NO_EXECUTE":         true,
+}
+
+var wellKnownMachineTypes = map[string]MachineTypeSpec{
+	"e2-micro":  {CPU: 2, MemoryGB: 1},
+	"e2-small":  {CPU: 2, MemoryGB: 2},
+	"e2-medium": {CPU: 2, MemoryGB: 4},
+	"f1-micro":  {CPU: 1, MemoryGB: 0.6},
+	"g1-small":  {CPU: 1, MemoryGB: 1.7},
+}
+
+var standardMachineTypeRegexp = regexp.MustCompile(`\A(e2|n1|n2|n2d)-(standard|highmem|highcpu)-(\d+)\z`)
+var customMachineTypeRegexp = regexp.MustCompile(`\A(?:(?:e2|n2|n2d)-)?custom-(\d+)-(\d+)\z`)
+
+// NodePools returns node pools configured in config.yaml,
+// or single pool which is equivalent to the traditional "primary-pool"
+// if none is configured.
+func (config Config) NodePools() []NodePoolConfig {
+	if len(config.NodePoolConfigs) == 0 {
+		return []NodePoolConfig{defaultNodePool}
+	}
+	return config.NodePoolConfigs
+}
+
+// Autoscaling returns resource limits of cluster autoscaling.
+func (config Config) Autoscaling() ClusterAutoscalingConfig {
+	if config.ClusterAutoscaling == nil {
+		return defaultClusterAutoscaling
+	}
+	return *config.ClusterAutoscaling
+}
+
+// LookupWellKnownMachineType returns spec of machine type without
+// asking to cloud, by name of the machine type.
+func LookupWellKnownMachineType(machineType string) (MachineTypeSpec, bool) {
+	if spec, ok := wellKnownMachineTypes[machineType]; ok {
+		return spec, true
+	}
+
+	if m := standardMachineTypeRegexp.FindStringSubmatch(machineType); m != nil {
+		cpu, e := strconv.Atoi(m[3])
+		if e != nil {
+			return MachineTypeSpec{}, false
+		}
+		memoryPerCPU := map[string]float64{
+			"standard": 4,
+			"highmem":  8,
+			"highcpu":  1,
+		}[m[2]]
+		if m[1] == "n1" {
+			memoryPerCPU = map[string]float64{
+				"standard": 3.75,
+				"highmem":  6.5,
+				"highcpu":  0.9,
+			}[m[2]]
+		}
+		return MachineTypeSpec{CPU: cpu, MemoryGB: memoryPerCPU * float64(cpu)}, true
+	}
+
+	if m := customMachineTypeRegexp.FindStringSubmatch(machineType); m != nil {
+		cpu, e := strconv.Atoi(m[1])
+		if e != nil {
+			return MachineTypeSpec{}, false
+		}
+		memoryMB, e := strconv.Atoi(m[2])
+		if e != nil {
+			return MachineTypeSpec{}, false
+		}
+		return MachineTypeSpec{CPU: cpu, MemoryGB: float64(memoryMB) / 1024}, true
+	}
+
+	return MachineTypeSpec{}, false
+}
+
+// GetMachineTypeSpec returns spec of machine type.
+// It asks Compute API unless the machine type is well known.
+func GetMachineTypeSpec(ctx context.Context, zone string, machineType string) (MachineTypeSpec, error) {
+	if spec, ok := LookupWellKnownMachineType(machineType); ok {
+		return spec, nil
+	}
+
+	projectID, e := GetProjectID(ctx)
+	if e != nil {
+		return MachineTypeSpec{}, e
+	}
+
+	service, e := compute.NewService(ctx)
+	if e != nil {
+		return MachineTypeSpec{}, e
+	}
+
+	mt, e := service.MachineTypes.Get(projectID, zone, machineType).Do()
+	if e != nil {
+		return MachineTypeSpec{}, e
+	}
+
+	return MachineTypeSpec{CPU: int(mt.GuestCpus), MemoryGB: float64(mt.MemoryMb) / 1024}, nil
+}
+
+// ValidateNodePools checks node pools are well-formed and
+// they fit within resource limits of cluster autoscaling
+// even when every pool scaled out to its maximum.
+func ValidateNodePools(pools []NodePoolConfig, limits ClusterAutoscalingConfig, specOf func(machineType string) (MachineTypeSpec, error)) error {
+	if limits.MinCPU < 0 || limits.MaxCPU < limits.MinCPU {
+		return fmt.Errorf("invalid cpu limits of cluster_autoscaling: min %d, max %d", limits.MinCPU, limits.MaxCPU)
+	}
+	if limits.MinMemoryGB < 0 || limits.MaxMemoryGB < limits.MinMemoryGB {
+		return fmt.Errorf("invalid memory limits of cluster_autoscaling: min %d, max %d", limits.MinMemoryGB, limits.MaxMemoryGB)
+	}
+
+	names := map[string]bool{}
+	totalCPU := 0
+	totalMemoryGB := 0.0
+
+	for _, pool := range pools {
+		if !IsValidK8sMetadataName(pool.Name) {
+			return fmt.Errorf("invalid name for node pool: %s", pool.Name)
+		}
+		if names[pool.Name] {
+			return fmt.Errorf("node pool %s is defined twice", pool.Name)
+		}
+		names[pool.Name] = true
+
+		if pool.MachineType == "" {
+			return fmt.Errorf("machine_type is required for node pool %s", pool.Name)
+		}
+		if pool.Spot && pool.Preemptible {
+			return fmt.Errorf("node pool %s cannot be spot and preemptible at once", pool.Name)
+		}
+		if pool.DiskSizeGB != 0 && pool.DiskSizeGB < 10 {
+			return fmt.Errorf("disk_size_gb of node pool %s should be 10 or more", pool.Name)
+		}
+		if pool.MinNodes < 0 || pool.MaxNodes < pool.MinNodes || pool.MaxNodes == 0 {
+			return fmt.Errorf("invalid node count of node pool %s: min %d, max %d", pool.Name, pool.MinNodes, pool.MaxNodes)
+		}
+		for _, taint := range pool.Taints {
+			if taint.Key == "" {
+				return fmt.Errorf("taint key of node pool %s cannot be empty", pool.Name)
+			}
+			if !taintEffects[taint.Effect] {
+				return fmt.Errorf("unknown taint effect for node pool %s: %s", pool.Name, taint.Effect)
+			}
+		}
+
+		spec, e := specOf(pool.MachineType)
+		if e != nil {
+			return e
+		}
+		totalCPU += spec.CPU * pool.MaxNodes
+		totalMemoryGB += spec.MemoryGB * float64(pool.MaxNodes)
+	}
+
+	if totalCPU > limits.MaxCPU {
+		return fmt.Errorf("node pools may scale up to %d CPUs; exceeds max_cpu %d of cluster_autoscaling", totalCPU, limits.MaxCPU)
+	}
+	if totalMemoryGB > float64(limits.MaxMemoryGB) {
+		return fmt.Errorf("node pools may scale up to %gGB memory; exceeds max_memory_gb %d of cluster_autoscaling", totalMemoryGB, limits.MaxMemoryGB)
+	}
+
+	return nil
+}
+
+// AddTFNodePools adds variables of cluster autoscaling and
+// node pools belonging to the primary cluster to doc.
+func AddTFNodePools(doc *TFDocument, config Config) {
+	limits := config.Autoscaling()
+	doc.Variable["cluster_autoscaling_cpu_min"] = TFVariable{Default: limits.MinCPU}
+	doc.Variable["cluster_autoscaling_cpu_max"] = TFVariable{Default: limits.MaxCPU}
+	doc.Variable["cluster_autoscaling_memory_min"] = TFVariable{Default: limits.MinMemoryGB}
+	doc.Variable["cluster_autoscaling_memory_max"] = TFVariable{Default: limits.MaxMemoryGB}
+
+	for _, pool := range config.NodePools() {
+		diskSizeGB := pool.DiskSizeGB
+		if diskSizeGB == 0 {
+			diskSizeGB = defaultNodePool.DiskSizeGB
+		}
+		initialNodeCount := pool.MinNodes
+		if initialNodeCount < 1 {
+			initialNodeCount = 1
+		}
+
+		taints := make([]TFObject, 0, len(pool.Taints))
+		for _, taint := range pool.Taints {
+			taints = append(taints, TFObject{
+				"key":    taint.Key,
+				"value":  taint.Value,
+				"effect": taint.Effect,
+			})
+		}
+
+		labels := pool.Labels
+		if labels == nil {
+			labels = map[string]string{}
+		}
+
+		nodeConfig := TFObject{
+			"preemptible":  pool.Preemptible,
+			"machine_type": pool.MachineType,
+			"disk_size_gb": diskSizeGB,
+			"labels":       labels,
+			"taint":        taints,
+			"metadata": TFObject{
+				"disable-legacy-endpoints": "true",
+			},
+			"service_account": TFExpr("google_service_account.node.email"),
+			"oauth_scopes": []string{
+				"https://www.googleapis.com/auth/cloud-platform",
+			},
+			"shielded_instance_config": TFObject{
+				"enable_integrity_monitoring": true,
+				"enable_secure_boot":          true,
+			},
+		}
+		// older google provider does not know spot attribute
+		if pool.Spot {
+			nodeConfig["spot"] = true
+		}
+		if config.WorkloadIdentity() {
+			nodeConfig["workload_metadata_config"] = TFObject{
+				"mode": "GKE_METADATA",
+			}
+		}
+
+		doc.AddResource("google_container_node_pool", pool.Name, TFObject{
+			"name":               pool.Name,
+			"location":           TFExpr("var.cluster_location"),
+			"cluster":            TFExpr("google_container_cluster.primary.name"),
+			"initial_node_count": initialNodeCount,
+			"node_locations":     []string{TFExpr("var.cluster_location")},
+			"autoscaling": TFObject{
+				"min_node_count": pool.MinNodes,
+				"max_node_count": pool.MaxNodes,
+			},
+			"management": TFObject{
+				"auto_repair":  true,
+				"auto_upgrade": true,
+			},
+			"node_config": nodeConfig,
+		})
+	}
+}
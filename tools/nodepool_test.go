@@ -0,0 +1,123 @@
+package tools
+
+import (
+	"fmt"
+	"testing"
+)
+
+func wellKnownMachineTypeSpec(machineType string) (MachineTypeSpec, error) {
+	if spec, ok := LookupWellKnownMachineType(machineType); ok {
+		return spec, nil
+	}
+	return MachineTypeSpec{}, fmt.Errorf("unknown machine type: %s", machineType)
+}
+
+func TestLookupWellKnownMachineType(t *testing.T) {
+	t.Parallel()
+
+	examples := []struct {
+		machineType string
+		spec        MachineTypeSpec
+		ok          bool
+	}{
+		{"e2-micro", MachineTypeSpec{CPU: 2, MemoryGB: 1}, true},
+		{"e2-standard-4", MachineTypeSpec{CPU: 4, MemoryGB: 16}, true},
+		{"n1-standard-2", MachineTypeSpec{CPU: 2, MemoryGB: 7.5}, true},
+		{"e2-custom-2-3072", MachineTypeSpec{CPU: 2, MemoryGB: 3}, true},
+		{"a2-highgpu-1g", MachineTypeSpec{}, false},
+	}
+
+	for _, example := range examples {
+		spec, ok := LookupWellKnownMachineType(example.machineType)
+		if ok != example.ok || spec != example.spec {
+			t.Errorf("expected LookupWellKnownMachineType(%v) to be %v, %v; got %v, %v", example.machineType, example.spec, example.ok, spec, ok)
+		}
+	}
+}
+
+func TestValidateNodePools(t *testing.T) {
+	t.Parallel()
+
+	pool := func(name string, machineType string, max int) NodePoolConfig {
+		return NodePoolConfig{Name: name, MachineType: machineType, MaxNodes: max}
+	}
+
+	examples := []struct {
+		pools []NodePoolConfig
+		valid bool
+	}{
+		{[]NodePoolConfig{defaultNodePool}, true},
+		{[]NodePoolConfig{pool("a", "e2-micro", 2), pool("b", "e2-micro", 2)}, true},
+		{[]NodePoolConfig{pool("a", "e2-micro", 2), pool("a", "e2-micro", 2)}, false},
+		{[]NodePoolConfig{pool("a", "e2-micro", 5)}, false},
+		{[]NodePoolConfig{pool("a", "e2-medium", 2)}, false},
+		{[]NodePoolConfig{pool("a", "e2-micro", 0)}, false},
+		{[]NodePoolConfig{pool("a", "unknown-type", 1)}, false},
+		{[]NodePoolConfig{{Name: "a", MachineType: "e2-micro", MaxNodes: 1, Spot: true, Preemptible: true}}, false},
+		{[]NodePoolConfig{{Name: "a", MachineType: "e2-micro", MaxNodes: 1, Taints: []NodeTaintConfig{{Key: "k", Effect: "NO_SCHEDULE"}}}}, true},
+		{[]NodePoolConfig{{Name: "a", MachineType: "e2-micro", MaxNodes: 1, Taints: []NodeTaintConfig{{Key: "k", Effect: "NoSchedule"}}}}, false},
+	}
+
+	for i, example := range examples {
+		e := ValidateNodePools(example.pools, defaultClusterAutoscaling, wellKnownMachineTypeSpec)
+		if (e == nil) != example.valid {
+			t.Errorf("example #%d: expected valid to be %v; got %v", i, example.valid, e)
+		}
+	}
+}
+
+func TestAddTFNodePools(t *testing.T) {
+	t.Parallel()
+
+	config := Config{
+		ClusterAutoscaling: &ClusterAutoscalingConfig{MinCPU: 0, MaxCPU: 4, MinMemoryGB: 0, MaxMemoryGB: 8},
+		NodePoolConfigs: []NodePoolConfig{
+			defaultNodePool,
+			{
+				Name:        "spot-pool",
+				MachineType: "e2-small",
+				Spot:        true,
+				MinNodes:    2,
+				MaxNodes:    2,
+				Labels:      map[string]string{"role": "bot"},
+				Taints:      []NodeTaintConfig{{Key: "dedicated", Value: "bot", Effect: "NO_SCHEDULE"}},
+			},
+		},
+	}
+	doc := TFDocument{Variable: map[string]TFVariable{}}
+	AddTFNodePools(&doc, config)
+
+	if doc.Variable["cluster_autoscaling_cpu_max"].Default != 4 || doc.Variable["cluster_autoscaling_memory_max"].Default != 8 {
+		t.Errorf("expected limits of cluster_autoscaling; got %v", doc.Variable)
+	}
+
+	primary := doc.Resource["google_container_node_pool"]["primary-pool"]
+	if primary["initial_node_count"] != 1 {
+		t.Errorf("expected pool scaling from zero to start with a node; got %v", primary["initial_node_count"])
+	}
+	nodeConfig := primary["node_config"].(TFObject)
+	if nodeConfig["preemptible"] != true || nodeConfig["disk_size_gb"] != 10 {
+		t.Errorf("unexpected node_config of primary-pool: %v", nodeConfig)
+	}
+	if _, ok := nodeConfig["spot"]; ok {
+		t.Errorf("expected spot to be omitted for older google provider; got %v", nodeConfig)
+	}
+
+	spot := doc.Resource["google_container_node_pool"]["spot-pool"]
+	if spot["initial_node_count"] != 2 {
+		t.Errorf("expected pool to start with min_node_count; got %v", spot["initial_node_count"])
+	}
+	if autoscaling := spot["autoscaling"].(TFObject); autoscaling["min_node_count"] != 2 || autoscaling["max_node_count"] != 2 {
+		t.Errorf("unexpected autoscaling: %v", autoscaling)
+	}
+	nodeConfig = spot["node_config"].(TFObject)
+	if nodeConfig["spot"] != true || nodeConfig["disk_size_gb"] != defaultNodePool.DiskSizeGB {
+		t.Errorf("expected spot with default disk size; got %v", nodeConfig)
+	}
+	if labels := nodeConfig["labels"].(map[string]string); labels["role"] != "bot" {
+		t.Errorf("expected labels of config; got %v", labels)
+	}
+	if taints := nodeConfig["taint"].([]TFObject); len(taints) != 1 || taints[0]["effect"] != "NO_SCHEDULE" {
+		t.Errorf("expected taints of config; got %v", taints)
+	}
+}
@@ -0,0 +1,107 @@
+package tools
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/oakcask/automutek8s/cluster"
+	kustomize "sigs.k8s.io/kustomize/api/types"
+)
+
+// SchedulerBase is kustomization of in-cluster scheduler,
+// which stops the stack on schedule or when players are idle.
+const SchedulerBase = "./kubernetes/base/scheduler"
+
+// SchedulerImage is image name of the scheduler in SchedulerBase.
+const SchedulerImage = "automutek8s-scheduler"
+
+// ScheduleConfig is schema of schedule block in config.yaml
+type ScheduleConfig struct {
+	Timezone        string   `json:"timezone"`
+	Shutdown        []string `json:"shutdown"`
+	IdleMinutes     int      `json:"idle_minutes"`
+	ActivityPattern string   `json:"activity_pattern"`
+	Image           string   `json:"image"`
+}
+
+// Validate checks schedule block is understood by the scheduler.
+func (schedule ScheduleConfig) Validate() error {
+	if len(schedule.Shutdown) == 0 && schedule.IdleMinutes <= 0 {
+		return fmt.Errorf("schedule: either shutdown or idle_minutes is required")
+	}
+	if schedule.IdleMinutes < 0 {
+		return fmt.Errorf("schedule: idle_minutes should not be negative")
+	}
+	if schedule.Image == "" {
+		return fmt.Errorf("schedule: image is required")
+	}
+	if _, e := cluster.ParseSchedule(strings.Join(schedule.Shutdown, ";"), schedule.timezone()); e != nil {
+		return fmt.Errorf("schedule: %v", e)
+	}
+	if schedule.ActivityPattern != "" {
+		if _, e := regexp.Compile(schedule.ActivityPattern); e != nil {
+			return fmt.Errorf("schedule: activity_pattern is malformed: %v", e)
+		}
+	}
+	return nil
+}
+
+func (schedule ScheduleConfig) timezone() string {
+	if schedule.Timezone == "" {
+		return "UTC"
+	}
+	return schedule.Timezone
+}
+
+// splitImage splits image reference into name and tag (or digest).
+func splitImage(image string) (name string, tag string, digest string) {
+	if i := strings.LastIndex(image, "@"); i >= 0 {
+		return image[:i], "", image[i+1:]
+	}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		return image[:i], image[i+1:], ""
+	}
+	return image, "", ""
+}
+
+// AddSchedulerToKustomization deploys the scheduler with the kustomization
+// when schedule block is in config.yaml. The scheduler stops workloads of env.
+func AddSchedulerToKustomization(k *kustomize.Kustomization, config Config, env EnvironmentConfig) error {
+	if config.Schedule == nil {
+		return nil
+	}
+	schedule := *config.Schedule
+	if e := schedule.Validate(); e != nil {
+		return e
+	}
+
+	k.Bases = append(k.Bases, SchedulerBase)
+	k.ConfigMapGenerator = append(k.ConfigMapGenerator, kustomize.ConfigMapArgs{
+		GeneratorArgs: kustomize.GeneratorArgs{
+			Name:     "scheduler-config",
+			Behavior: "merge",
+			KvPairSources: kustomize.KvPairSources{
+				LiteralSources: []string{
+					fmt.Sprintf("SCHEDULE_TIMEZONE=%s", schedule.timezone()),
+					fmt.Sprintf("SCHEDULE_SHUTDOWN=%s", strings.Join(schedule.Shutdown, ";")),
+					fmt.Sprintf("SCHEDULE_IDLE_MINUTES=%s", strconv.Itoa(schedule.IdleMinutes)),
+					fmt.Sprintf("SCHEDULE_ACTIVITY_PATTERN=%s", schedule.ActivityPattern),
+					fmt.Sprintf("SCHEDULE_NAME_PREFIX=%s", env.NamePrefix),
+					fmt.Sprintf("SCHEDULE_KEEP_POSTGRES=%t", config.KeepsPostgres(env)),
+				},
+			},
+		},
+	})
+
+	name, tag, digest := splitImage(schedule.Image)
+	k.Images = append(k.Images, kustomize.Image{
+		Name:    SchedulerImage,
+		NewName: name,
+		NewTag:  tag,
+		Digest:  digest,
+	})
+
+	return nil
+}
@@ -0,0 +1,62 @@
+package tools
+
+import (
+	"testing"
+
+	kustomize "sigs.k8s.io/kustomize/api/types"
+)
+
+func TestAddSchedulerToKustomization(t *testing.T) {
+	t.Parallel()
+
+	var config Config
+	var k kustomize.Kustomization
+	if e := AddSchedulerToKustomization(&k, config, DefaultEnvironment); e != nil {
+		t.Fatalf("expected no error without schedule; got %v", e)
+	}
+	if len(k.Bases) != 0 {
+		t.Errorf("expected scheduler not to be deployed without schedule; got %v", k.Bases)
+	}
+
+	config.Schedule = &ScheduleConfig{
+		Timezone: "Asia/Tokyo",
+		Shutdown: []string{"someday 23:00"},
+		Image:    "gcr.io/project/automutek8s-scheduler:v1",
+	}
+	if e := AddSchedulerToKustomization(&k, config, DefaultEnvironment); e == nil {
+		t.Errorf("expected error with malformed shutdown")
+	}
+
+	config.Schedule.Shutdown = []string{"weekdays 23:00", "weekends 03:00"}
+	if e := AddSchedulerToKustomization(&k, config, DefaultEnvironment); e != nil {
+		t.Fatalf("expected no error; got %v", e)
+	}
+	if len(k.Bases) != 1 || k.Bases[0] != SchedulerBase {
+		t.Errorf("expected %s to be added; got %v", SchedulerBase, k.Bases)
+	}
+	literals := k.ConfigMapGenerator[0].LiteralSources
+	if literals[1] != "SCHEDULE_SHUTDOWN=weekdays 23:00;weekends 03:00" {
+		t.Errorf("expected shutdown rules to be joined; got %v", literals)
+	}
+	image := k.Images[0]
+	if image.Name != SchedulerImage || image.NewName != "gcr.io/project/automutek8s-scheduler" || image.NewTag != "v1" {
+		t.Errorf("expected scheduler image to be replaced; got %+v", image)
+	}
+}
+
+func TestAddSchedulerToKustomizationWithTenants(t *testing.T) {
+	t.Parallel()
+
+	config := Config{
+		Schedule: &ScheduleConfig{IdleMinutes: 30, Image: "gcr.io/project/automutek8s-scheduler:v1"},
+		Tenants:  []TenantConfig{{Name: "alpha", Namespace: "tenant-alpha", BrokerPort: 8080}},
+	}
+	var k kustomize.Kustomization
+	if e := AddSchedulerToKustomization(&k, config, DefaultEnvironment); e != nil {
+		t.Fatal(e)
+	}
+	literals := k.ConfigMapGenerator[0].LiteralSources
+	if literals[len(literals)-1] != "SCHEDULE_KEEP_POSTGRES=true" {
+		t.Errorf("expected postgres shared with tenants to be kept; got %v", literals)
+	}
+}
@@ -0,0 +1,183 @@
+package tools
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	kustomize "sigs.k8s.io/kustomize/api/types"
+)
+
+// SecretManifestsDir is directory of Secret templates, which name
+// secrets and keys stored in Secret Manager.
+const SecretManifestsDir = "kubernetes/base/secrets"
+
+// SecretSyncBase is kustomization of in-cluster controller which
+// materializes Secrets from Secret Manager.
+const SecretSyncBase = "./kubernetes/base/secretsync"
+
+// SecretSyncImage is image name of the controller in SecretSyncBase.
+const SecretSyncImage = "automutek8s-secretsync"
+
+// SecretSyncServiceAccountID is ID of Google service account
+// which the controller runs as through workload identity.
+const SecretSyncServiceAccountID = "automutek8s-secretsync"
+
+// SecretSyncKSA is Kubernetes service account of the controller.
+const SecretSyncKSA = "secretsync"
+
+// SecretSyncConfig is schema of secret_sync block in config.yaml
+type SecretSyncConfig struct {
+	Image           string `json:"image"`
+	IntervalMinutes int    `json:"interval_minutes"`
+}
+
+// WorkloadIdentity returns true if workload identity is needed by the cluster.
+func (config Config) WorkloadIdentity() bool {
+	return config.SecretSync != nil || config.ScheduledBackup()
+}
+
+// SecretManifestPaths returns paths of Secret templates in dir.
+func SecretManifestPaths(dir string) ([]string, error) {
+	return filepath.Glob(path.Join(dir, "*.yaml"))
+}
+
+// LoadSecretManifests reads Secret templates in dir.
+func LoadSecretManifests(dir string) ([]corev1.Secret, error) {
+	paths, e := SecretManifestPaths(dir)
+	if e != nil {
+		return nil, e
+	}
+
+	secrets := make([]corev1.Secret, 0)
+
+	for _, path := range paths {
+		f, e := os.Open(path)
+		if e != nil {
+			return nil, e
+		}
+
+		var manifest corev1.Secret
+		e = yaml.NewYAMLOrJSONDecoder(f, 4096).Decode(&manifest)
+		f.Close()
+		if e != nil {
+			return nil, e
+		}
+
+		secrets = append(secrets, manifest)
+	}
+	return secrets, nil
+}
+
+// AddSecretSyncToKustomization deploys the controller with the kustomization
+// when secret_sync block is in config.yaml. Secret templates in manifestsDir
+// are passed to the controller as secretsync-manifests ConfigMap.
+func AddSecretSyncToKustomization(k *kustomize.Kustomization, config Config, projectID string, manifestsDir string) error {
+	if config.SecretSync == nil {
+		return nil
+	}
+	if config.SecretSync.Image == "" {
+		return fmt.Errorf("secret_sync: image is required")
+	}
+
+	paths, e := SecretManifestPaths(manifestsDir)
+	if e != nil {
+		return e
+	}
+	files := make([]string, 0, len(paths))
+	for _, p := range paths {
+		files = append(files, fmt.Sprintf("%s=%s", filepath.Base(p), filepath.ToSlash(p)))
+	}
+
+	interval := config.SecretSync.IntervalMinutes
+	if interval <= 0 {
+		interval = 10
+	}
+
+	k.Bases = append(k.Bases, SecretSyncBase)
+	k.ConfigMapGenerator = append(k.ConfigMapGenerator,
+		kustomize.ConfigMapArgs{
+			GeneratorArgs: kustomize.GeneratorArgs{
+				Name:     "secretsync-manifests",
+				Behavior: "create",
+				KvPairSources: kustomize.KvPairSources{
+					FileSources: files,
+				},
+			},
+		},
+		kustomize.ConfigMapArgs{
+			GeneratorArgs: kustomize.GeneratorArgs{
+				Name:     "secretsync-config",
+				Behavior: "merge",
+				KvPairSources: kustomize.KvPairSources{
+					LiteralSources: []string{
+						fmt.Sprintf("SECRETSYNC_INTERVAL_MINUTES=%s", strconv.Itoa(interval)),
+					},
+				},
+			},
+		},
+	)
+	k.Patches = append(k.Patches, kustomize.Patch{
+		Patch: fmt.Sprintf(`apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: %s
+  annotations:
+    iam.gke.io/gcp-service-account: %s@%s.iam.gserviceaccount.com
+`, SecretSyncKSA, SecretSyncServiceAccountID, projectID),
+	})
+
+	name, tag, digest := splitImage(config.SecretSync.Image)
+	k.Images = append(k.Images, kustomize.Image{
+		Name:    SecretSyncImage,
+		NewName: name,
+		NewTag:  tag,
+		Digest:  digest,
+	})
+
+	return nil
+}
+
+// AddTFSecretSync enables workload identity of the cluster and adds
+// service account of the controller, which can access only secrets
+// named automutek8s_*, bound to its Kubernetes service account
+// in namespace of every environment.
+func AddTFSecretSync(doc *TFDocument, config Config) {
+	doc.Variable["workload_identity"] = TFVariable{Default: config.WorkloadIdentity()}
+	if config.SecretSync == nil {
+		return
+	}
+
+	doc.AddData("google_project", "project", TFObject{
+		"project_id": TFExpr("var.gcloud_project"),
+	})
+	doc.AddResource("google_service_account", "secretsync", TFObject{
+		"account_id":   SecretSyncServiceAccountID,
+		"display_name": "service account to sync secrets into cluster",
+	})
+	doc.AddResource("google_project_iam_member", "secretsync-accessor", TFObject{
+		"depends_on": []string{"google_project_service.service"},
+		"role":       "roles/secretmanager.secretAccessor",
+		"member":     "serviceAccount:" + TFExpr("google_service_account.secretsync.email"),
+		"condition": TFObject{
+			"title":      "automutek8s secrets",
+			"expression": fmt.Sprintf(`resource.name.startsWith("projects/%s/secrets/automutek8s_")`, TFExpr("data.google_project.project.number")),
+		},
+	})
+	envs := append([]EnvironmentConfig{DefaultEnvironment}, config.Environments...)
+	for _, env := range envs {
+		name := "secretsync-workload-identity"
+		if !env.IsDefault() {
+			name = fmt.Sprintf("%s-%s", name, env.Name)
+		}
+		doc.AddResource("google_service_account_iam_member", name, TFObject{
+			"service_account_id": TFExpr("google_service_account.secretsync.name"),
+			"role":               "roles/iam.workloadIdentityUser",
+			"member":             fmt.Sprintf("serviceAccount:%s.svc.id.goog[%s/%s]", TFExpr("var.gcloud_project"), env.Namespace, SecretSyncKSA),
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package tools
+
+import (
+	"strings"
+	"testing"
+
+	kustomize "sigs.k8s.io/kustomize/api/types"
+)
+
+func TestAddSecretSync(t *testing.T) {
+	t.Parallel()
+
+	var config Config
+	doc := TFDocument{Variable: map[string]TFVariable{}}
+	AddTFSecretSync(&doc, config)
+	if doc.Variable["workload_identity"].Default != false || len(doc.Resource) != 0 {
+		t.Errorf("expected only workload_identity variable without secret_sync; got %v %v", doc.Variable, doc.Resource)
+	}
+
+	config.SecretSync = &SecretSyncConfig{Image: "gcr.io/project/automutek8s-secretsync:v1"}
+	AddTFSecretSync(&doc, config)
+	if doc.Variable["workload_identity"].Default != true {
+		t.Errorf("expected workload identity to be enabled; got %v", doc.Variable)
+	}
+	binding := doc.Resource["google_service_account_iam_member"]["secretsync-workload-identity"]
+	if binding["member"] != "serviceAccount:${var.gcloud_project}.svc.id.goog[default/secretsync]" {
+		t.Errorf("expected KSA to be bound to service account; got %v", binding)
+	}
+
+	var k kustomize.Kustomization
+	if e := AddSecretSyncToKustomization(&k, config, "project", "../kubernetes/base/secrets"); e != nil {
+		t.Fatal(e)
+	}
+	if len(k.Bases) != 1 || k.Bases[0] != SecretSyncBase {
+		t.Errorf("expected %s to be added; got %v", SecretSyncBase, k.Bases)
+	}
+	files := k.ConfigMapGenerator[0].FileSources
+	if len(files) != 3 || files[0] != "discordbot.yaml=../kubernetes/base/secrets/discordbot.yaml" {
+		t.Errorf("expected secret templates to be passed; got %v", files)
+	}
+	if !strings.Contains(k.Patches[0].Patch, "automutek8s-secretsync@project.iam.gserviceaccount.com") {
+		t.Errorf("expected KSA to be annotated; got %v", k.Patches[0].Patch)
+	}
+}
+
+func TestAddTFNodePoolsWithSecretSync(t *testing.T) {
+	t.Parallel()
+
+	config := Config{NodePoolConfigs: []NodePoolConfig{defaultNodePool}}
+	doc := TFDocument{Variable: map[string]TFVariable{}}
+	AddTFNodePools(&doc, config)
+	nodeConfig := doc.Resource["google_container_node_pool"][defaultNodePool.Name]["node_config"].(TFObject)
+	if _, ok := nodeConfig["workload_metadata_config"]; ok {
+		t.Errorf("expected no GKE metadata server without workload identity; got %v", nodeConfig)
+	}
+
+	config.SecretSync = &SecretSyncConfig{Image: "gcr.io/project/automutek8s-secretsync:v1"}
+	doc = TFDocument{Variable: map[string]TFVariable{}}
+	AddTFNodePools(&doc, config)
+	nodeConfig = doc.Resource["google_container_node_pool"][defaultNodePool.Name]["node_config"].(TFObject)
+	if metadata, ok := nodeConfig["workload_metadata_config"].(TFObject); !ok || metadata["mode"] != "GKE_METADATA" {
+		t.Errorf("expected GKE metadata server with workload identity; got %v", nodeConfig)
+	}
+}
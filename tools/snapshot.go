@@ -0,0 +1,137 @@
+package tools
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	kustomize "sigs.k8s.io/kustomize/api/types"
+)
+
+// SnapshotsBase is kustomization of the CronJob taking VolumeSnapshots
+// of postgres and redis, which is added by AddSnapshotsToKustomization.
+const SnapshotsBase = "./kubernetes/base/snapshots"
+
+// SnapshotClassBase is kustomization of VolumeSnapshotClass used by SnapshotsBase,
+// which is added to DefaultEnvironment only as it is cluster-scoped.
+const SnapshotClassBase = "./kubernetes/base/snapshotclass"
+
+// SnapshotImage is image name of the snapshotter in SnapshotsBase.
+const SnapshotImage = "automutek8s-snapshot"
+
+// SnapshotClassName is name of VolumeSnapshotClass in SnapshotsBase.
+const SnapshotClassName = "automutek8s-snapshot"
+
+// SnapshotCronJobName is name of the CronJob in SnapshotsBase.
+const SnapshotCronJobName = "snapshot"
+
+// SnapshotStorageClass is StorageClass of Compute Engine persistent disk CSI driver,
+// whose volumes can be snapshotted unlike ones of the in-tree `standard`.
+const SnapshotStorageClass = "standard-rwo"
+
+// DefaultSnapshotRetentionDays is how long snapshots are kept without retention_days.
+const DefaultSnapshotRetentionDays = 7
+
+// SnapshotConfig is schema of snapshots block in config.yaml.
+// Persistent disks of postgres and redis in the cluster are snapshotted on Schedule,
+// and snapshots older than RetentionDays are deleted.
+type SnapshotConfig struct {
+	Schedule      string `json:"schedule"`
+	RetentionDays int    `json:"retention_days"`
+	Image         string `json:"image"`
+}
+
+// Validate checks snapshots block can be rendered.
+func (snapshots SnapshotConfig) Validate() error {
+	if snapshots.Schedule == "" {
+		return fmt.Errorf("snapshots: schedule is required")
+	}
+	if snapshots.Image == "" {
+		return fmt.Errorf("snapshots: image is required")
+	}
+	if snapshots.RetentionDays < 0 {
+		return fmt.Errorf("snapshots: retention_days should not be negative")
+	}
+	return nil
+}
+
+// SnapshotRetentionDays returns how many days snapshots are kept.
+func (config Config) SnapshotRetentionDays() int {
+	if config.Snapshots == nil || config.Snapshots.RetentionDays <= 0 {
+		return DefaultSnapshotRetentionDays
+	}
+	return config.Snapshots.RetentionDays
+}
+
+// AddSnapshotsToKustomization deploys the CronJob with the kustomization of env
+// when snapshots block is in config.yaml, and VolumeSnapshotClass with DefaultEnvironment.
+// Volumes of the StatefulSets are claimed from SnapshotStorageClass, which
+// StatefulSets already deployed can't change to; see README for the migration.
+func AddSnapshotsToKustomization(k *kustomize.Kustomization, config Config, env EnvironmentConfig) error {
+	if config.Snapshots == nil {
+		return nil
+	}
+	snapshots := *config.Snapshots
+	if e := snapshots.Validate(); e != nil {
+		return e
+	}
+	volumes := make([]string, 0)
+	for _, volume := range config.InClusterVolumes() {
+		volumes = append(volumes, volume.StatefulSet)
+	}
+	if len(volumes) == 0 {
+		return fmt.Errorf("snapshots: no volumes left in the cluster with managed database and cache")
+	}
+
+	for _, volume := range config.InClusterVolumes() {
+		patch, e := jsonPatch("StatefulSet", volume.StatefulSet, jsonPatchOp{
+			Op:    "add",
+			Path:  "/spec/volumeClaimTemplates/0/spec/storageClassName",
+			Value: SnapshotStorageClass,
+		})
+		if e != nil {
+			return e
+		}
+		// volumes of tenants are not snapshotted
+		patch.Target.LabelSelector = "!" + TenantLabel
+		k.Patches = append(k.Patches, patch)
+	}
+
+	k.Bases = append(k.Bases, SnapshotsBase)
+	if env.IsDefault() {
+		k.Bases = append(k.Bases, SnapshotClassBase)
+	}
+	k.ConfigMapGenerator = append(k.ConfigMapGenerator, kustomize.ConfigMapArgs{
+		GeneratorArgs: kustomize.GeneratorArgs{
+			Name:     "snapshot-config",
+			Behavior: "merge",
+			KvPairSources: kustomize.KvPairSources{
+				LiteralSources: []string{
+					fmt.Sprintf("SNAPSHOT_CLASS=%s", SnapshotClassName),
+					fmt.Sprintf("SNAPSHOT_RETENTION_DAYS=%s", strconv.Itoa(config.SnapshotRetentionDays())),
+					fmt.Sprintf("SNAPSHOT_NAME_PREFIX=%s", env.NamePrefix),
+					fmt.Sprintf("SNAPSHOT_VOLUMES=%s", strings.Join(volumes, ",")),
+				},
+			},
+		},
+	})
+	k.Patches = append(k.Patches, kustomize.Patch{
+		Patch: fmt.Sprintf(`apiVersion: batch/v1beta1
+kind: CronJob
+metadata:
+  name: %s
+spec:
+  schedule: %q
+`, SnapshotCronJobName, snapshots.Schedule),
+	})
+
+	name, tag, digest := splitImage(snapshots.Image)
+	k.Images = append(k.Images, kustomize.Image{
+		Name:    SnapshotImage,
+		NewName: name,
+		NewTag:  tag,
+		Digest:  digest,
+	})
+
+	return nil
+}
@@ -0,0 +1,91 @@
+package tools
+
+import (
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestRenderKustomizationWithSnapshots(t *testing.T) {
+	t.Parallel()
+
+	config := Config{
+		Environments: []EnvironmentConfig{prodEnvironment},
+		Snapshots:    &SnapshotConfig{Schedule: "0 6 * * *", Image: "gcr.io/project/automutek8s-snapshot:v1"},
+	}
+	renderer := fakeRenderer(config)
+	renderer.Environment = prodEnvironment
+
+	objs := buildObjects(t, renderer)
+
+	if class := findObject(objs, "VolumeSnapshotClass", ""); class != nil {
+		t.Errorf("expected VolumeSnapshotClass to be left to the default stack; got %s", class.GetName())
+	}
+	cronJob := mustFindObject(t, objs, prodEnvironment.Namespace, "CronJob", SnapshotCronJobName)
+	if schedule, _, _ := unstructured.NestedString(cronJob.Object, "spec", "schedule"); schedule != "0 6 * * *" {
+		t.Errorf("expected schedule of config; got %q", schedule)
+	}
+	container := nestedFirst(t, cronJob.Object, "spec", "jobTemplate", "spec", "template", "spec", "containers")
+	if image := container["image"]; image != "gcr.io/project/automutek8s-snapshot:v1" {
+		t.Errorf("expected image of config; got %v", image)
+	}
+
+	snapshotConfig := mustFindObject(t, objs, prodEnvironment.Namespace, "ConfigMap", "snapshot-config-")
+	data, _, _ := unstructured.NestedStringMap(snapshotConfig.Object, "data")
+	if data["SNAPSHOT_NAME_PREFIX"] != prodEnvironment.NamePrefix || data["SNAPSHOT_RETENTION_DAYS"] != "7" || data["SNAPSHOT_CLASS"] != SnapshotClassName || data["SNAPSHOT_VOLUMES"] != "postgres,redis" {
+		t.Errorf("unexpected snapshot-config: %v", data)
+	}
+	for _, name := range []string{"b-postgres", "b-redis"} {
+		if class := storageClassOf(t, objs, prodEnvironment.Namespace, name); class != SnapshotStorageClass {
+			t.Errorf("expected %s to claim %s; got %q", name, SnapshotStorageClass, class)
+		}
+	}
+}
+
+// storageClassOf returns storageClassName of the StatefulSet in objs.
+func storageClassOf(t *testing.T, objs []*unstructured.Unstructured, namespace string, name string) string {
+	t.Helper()
+	statefulSet := mustFindObject(t, objs, namespace, "StatefulSet", name)
+	class, _, _ := unstructured.NestedString(nestedFirst(t, statefulSet.Object, "spec", "volumeClaimTemplates"), "spec", "storageClassName")
+	return class
+}
+
+func TestRenderDefaultKustomizationWithSnapshots(t *testing.T) {
+	t.Parallel()
+
+	objs := buildObjects(t, fakeRenderer(Config{Tenants: fakeTenants}))
+	if class := storageClassOf(t, objs, "", "postgres"); class != "" {
+		t.Errorf("expected storage class of existing StatefulSets to be kept without snapshots; got %q", class)
+	}
+
+	config := Config{
+		Snapshots: &SnapshotConfig{Schedule: "0 6 * * *", Image: "gcr.io/project/automutek8s-snapshot:v1"},
+		Tenants:   fakeTenants,
+	}
+	objs = buildObjects(t, fakeRenderer(config))
+	if class := findObject(objs, "VolumeSnapshotClass", SnapshotClassName); class == nil || class.GetName() != SnapshotClassName {
+		t.Errorf("expected VolumeSnapshotClass %s", SnapshotClassName)
+	}
+	for _, name := range []string{"postgres", "redis"} {
+		if class := storageClassOf(t, objs, "", name); class != SnapshotStorageClass {
+			t.Errorf("expected %s to claim %s; got %q", name, SnapshotStorageClass, class)
+		}
+	}
+	if class := storageClassOf(t, objs, "tenant-alpha", "redis"); class != "" {
+		t.Errorf("expected redis of tenant to be left; got %q", class)
+	}
+}
+
+func TestSnapshotConfigValidate(t *testing.T) {
+	t.Parallel()
+
+	snapshots := SnapshotConfig{Image: "automutek8s-snapshot"}
+	if e := snapshots.Validate(); e == nil {
+		t.Errorf("expected error without schedule")
+	}
+	snapshots.Schedule = "0 6 * * *"
+	snapshots.RetentionDays = -1
+	if e := snapshots.Validate(); e == nil {
+		t.Errorf("expected error with negative retention_days")
+	}
+}
@@ -0,0 +1,270 @@
+package tools
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/oakcask/automutek8s/cluster"
+	"google.golang.org/api/container/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes"
+)
+
+// BrokerServiceName is name of the service exposing galactus broker
+// at the reserved ingress address.
+const BrokerServiceName = "broker"
+
+const (
+	// StatusOK means the component is healthy.
+	StatusOK = "ok"
+	// StatusStopped means the workload is scaled to zero by cluster:stop.
+	StatusStopped = "stopped"
+	// StatusNotReady means the component exists but is not ready yet.
+	StatusNotReady = "not ready"
+	// StatusMissing means the component does not exist.
+	StatusMissing = "missing"
+	// StatusError means the status could not be examined.
+	StatusError = "error"
+)
+
+// ComponentStatus is health of a component of the stack.
+type ComponentStatus struct {
+	Component string `json:"component"`
+	Name      string `json:"name"`
+	Status    string `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+}
+
+// StackStatus is health of the whole stack reported by `mage status`.
+type StackStatus struct {
+	Terraform ComponentStatus   `json:"terraform"`
+	Cluster   ComponentStatus   `json:"cluster"`
+	Workloads []ComponentStatus `json:"workloads"`
+	Broker    ComponentStatus   `json:"broker"`
+	Secrets   []ComponentStatus `json:"secrets"`
+}
+
+func errorStatus(component string, name string, e error) ComponentStatus {
+	return ComponentStatus{Component: component, Name: name, Status: StatusError, Detail: e.Error()}
+}
+
+// Components returns every component in the order of the table.
+func (status StackStatus) Components() []ComponentStatus {
+	components := []ComponentStatus{status.Terraform, status.Cluster}
+	components = append(components, status.Workloads...)
+	components = append(components, status.Broker)
+	return append(components, status.Secrets...)
+}
+
+// Healthy returns true if every component is ok.
+// Workloads stopped by cluster:stop are not counted as unhealthy.
+func (status StackStatus) Healthy() bool {
+	for _, component := range status.Components() {
+		if component.Status != StatusOK && component.Status != StatusStopped {
+			return false
+		}
+	}
+	return true
+}
+
+// WriteTable writes status as a table.
+func (status StackStatus) WriteTable(out io.Writer) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "COMPONENT\tNAME\tSTATUS\tDETAIL")
+	for _, c := range status.Components() {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", c.Component, c.Name, c.Status, c.Detail)
+	}
+	return w.Flush()
+}
+
+// GetTFStateStatus tells whether terraform state is present.
+func GetTFStateStatus() ComponentStatus {
+	state, e := ListTFState(RunCommand)
+	if e != nil {
+		return errorStatus("terraform", "state", e)
+	}
+	if len(state) == 0 {
+		return ComponentStatus{Component: "terraform", Name: "state", Status: StatusMissing, Detail: "no resources in state"}
+	}
+	return ComponentStatus{Component: "terraform", Name: "state", Status: StatusOK, Detail: fmt.Sprintf("%d resources", len(state))}
+}
+
+// GetClusterStatus tells whether the GKE cluster exists, with its node count.
+func GetClusterStatus(ctx context.Context, service *container.Service, c cluster.Cluster) ComponentStatus {
+	gke, e := service.Projects.Locations.Clusters.Get(c.Path()).Context(ctx).Do()
+	if IsGoogleAPINotFound(e) {
+		return ComponentStatus{Component: "cluster", Name: c.Name, Status: StatusMissing}
+	} else if e != nil {
+		return errorStatus("cluster", c.Name, e)
+	}
+
+	status := StatusNotReady
+	if gke.Status == "RUNNING" {
+		status = StatusOK
+	}
+	return ComponentStatus{
+		Component: "cluster",
+		Name:      c.Name,
+		Status:    status,
+		Detail:    fmt.Sprintf("%s, %d nodes", gke.Status, gke.CurrentNodeCount),
+	}
+}
+
+// RenderWorkloads builds kustomization of r in dir, and returns Deployments and StatefulSets in it.
+// Secrets are rendered empty since their values don't matter to status.
+func RenderWorkloads(ctx context.Context, r KustomizationRenderer, dir string) ([]*unstructured.Unstructured, error) {
+	r.Secrets = func(context.Context, SecretHandle) ([]byte, error) {
+		return nil, nil
+	}
+	objs, e := r.Build(ctx, dir)
+	if e != nil {
+		return nil, e
+	}
+
+	workloads := make([]*unstructured.Unstructured, 0)
+	for _, obj := range objs {
+		if obj.GetKind() == cluster.KindDeployment || obj.GetKind() == cluster.KindStatefulSet {
+			workloads = append(workloads, obj)
+		}
+	}
+	return workloads, nil
+}
+
+// GetWorkloadStatuses tells readiness of workloads rendered by RenderWorkloads.
+// Workloads without namespace are looked up in namespace,
+// and ones in other namespaces, like of tenants, are named with their namespace.
+func GetWorkloadStatuses(ctx context.Context, client kubernetes.Interface, namespace string, workloads []*unstructured.Unstructured) []ComponentStatus {
+	statuses := make([]ComponentStatus, 0, len(workloads))
+	for _, obj := range workloads {
+		workload := cluster.Workload{Kind: obj.GetKind(), Name: obj.GetName()}
+		s := &cluster.Scaler{Client: client, Namespace: namespace}
+		name := workload.Name
+		if ns := obj.GetNamespace(); ns != "" && ns != namespace {
+			s.Namespace = ns
+			name = ns + "/" + workload.Name
+		}
+
+		status, e := s.GetStatus(ctx, workload)
+		if k8serrors.IsNotFound(e) {
+			statuses = append(statuses, ComponentStatus{Component: workload.Kind, Name: name, Status: StatusMissing})
+			continue
+		} else if e != nil {
+			statuses = append(statuses, errorStatus(workload.Kind, name, e))
+			continue
+		}
+
+		c := ComponentStatus{
+			Component: workload.Kind,
+			Name:      name,
+			Status:    StatusNotReady,
+			Detail:    fmt.Sprintf("%d/%d ready", status.ReadyReplicas, status.Replicas),
+		}
+		if status.Replicas == 0 {
+			c.Status = StatusStopped
+		} else if status.Ready() {
+			c.Status = StatusOK
+		}
+		statuses = append(statuses, c)
+	}
+	return statuses
+}
+
+// GetBrokerStatus compares external IP of broker service with the reserved ingress address.
+func GetBrokerStatus(ctx context.Context, client kubernetes.Interface, namespace string, namePrefix string, reservedIP string) ComponentStatus {
+	name := namePrefix + BrokerServiceName
+	service, e := client.CoreV1().Services(namespace).Get(ctx, name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(e) {
+		return ComponentStatus{Component: "service", Name: name, Status: StatusMissing}
+	} else if e != nil {
+		return errorStatus("service", name, e)
+	}
+
+	externalIP := ""
+	for _, ingress := range service.Status.LoadBalancer.Ingress {
+		if ingress.IP != "" {
+			externalIP = ingress.IP
+			break
+		}
+	}
+
+	c := ComponentStatus{
+		Component: "service",
+		Name:      name,
+		Status:    StatusOK,
+		Detail:    fmt.Sprintf("%s (reserved %s)", externalIP, reservedIP),
+	}
+	if externalIP == "" {
+		c.Status = StatusNotReady
+		c.Detail = fmt.Sprintf("pending (reserved %s)", reservedIP)
+	} else if externalIP != reservedIP {
+		c.Status = StatusError
+	}
+	return c
+}
+
+// GetSecretStatuses tells whether every secret handle exists in Secret Manager.
+func GetSecretStatuses(ctx context.Context, handles []SecretHandle) []ComponentStatus {
+	statuses := make([]ComponentStatus, 0, len(handles))
+	for _, handle := range handles {
+		exists, e := handle.Exists(ctx)
+		if e != nil {
+			statuses = append(statuses, errorStatus("secret", handle.String(), e))
+		} else if exists {
+			statuses = append(statuses, ComponentStatus{Component: "secret", Name: handle.String(), Status: StatusOK})
+		} else {
+			statuses = append(statuses, ComponentStatus{Component: "secret", Name: handle.String(), Status: StatusMissing})
+		}
+	}
+	return statuses
+}
+
+// CollectStackStatus examines every component of the stack in env.
+// Failures are reported in the status rather than returned.
+func CollectStackStatus(ctx context.Context, config Config, env EnvironmentConfig, handles []SecretHandle) (StackStatus, error) {
+	var status StackStatus
+
+	projectID, e := GetProjectID(ctx)
+	if e != nil {
+		return status, e
+	}
+	clusterName, clusterLocation := config.ClusterNameAndLocation()
+	c := cluster.Cluster{
+		ProjectID: projectID,
+		Location:  clusterLocation,
+		Name:      clusterName,
+	}
+
+	status.Terraform = GetTFStateStatus()
+	status.Secrets = GetSecretStatuses(ctx, handles)
+
+	service, e := container.NewService(ctx)
+	if e != nil {
+		return status, e
+	}
+	status.Cluster = GetClusterStatus(ctx, service, c)
+
+	reservedIP, e := env.IngressIP(config)
+	if e != nil {
+		reservedIP = "unknown"
+	}
+
+	client, e := cluster.NewKubernetesClient(ctx, service, c)
+	if e != nil {
+		status.Workloads = []ComponentStatus{errorStatus("kubernetes", c.Name, e)}
+		status.Broker = errorStatus("service", BrokerServiceName, e)
+		return status, nil
+	}
+	workloads, e := RenderWorkloads(ctx, NewKustomizationRenderer(config, env), ".")
+	if e != nil {
+		status.Workloads = []ComponentStatus{errorStatus("kustomization", "workloads", e)}
+	} else {
+		status.Workloads = GetWorkloadStatuses(ctx, client, env.Namespace, workloads)
+	}
+	status.Broker = GetBrokerStatus(ctx, client, env.Namespace, env.NamePrefix, reservedIP)
+
+	return status, nil
+}
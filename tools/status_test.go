@@ -0,0 +1,114 @@
+package tools
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestGetWorkloadAndBrokerStatuses(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	one, zero := int32(1), int32(0)
+	client := fake.NewSimpleClientset(
+		&appsv1.StatefulSet{
+			ObjectMeta: metav1.ObjectMeta{Name: "postgres", Namespace: "default"},
+			Spec:       appsv1.StatefulSetSpec{Replicas: &one},
+			Status:     appsv1.StatefulSetStatus{ReadyReplicas: 1},
+		},
+		&appsv1.StatefulSet{
+			ObjectMeta: metav1.ObjectMeta{Name: "redis", Namespace: "default"},
+			Spec:       appsv1.StatefulSetSpec{Replicas: &zero},
+		},
+		&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: "galactus", Namespace: "default"},
+			Spec:       appsv1.DeploymentSpec{Replicas: &one},
+		},
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: BrokerServiceName, Namespace: "default"},
+			Status: corev1.ServiceStatus{LoadBalancer: corev1.LoadBalancerStatus{
+				Ingress: []corev1.LoadBalancerIngress{{IP: "203.0.113.1"}},
+			}},
+		},
+	)
+
+	expected := map[string]string{
+		"postgres":   StatusOK,
+		"redis":      StatusStopped,
+		"galactus":   StatusNotReady,
+		"automuteus": StatusMissing,
+	}
+	rendered, e := RenderWorkloads(ctx, fakeRenderer(Config{}), "..")
+	if e != nil {
+		t.Fatal(e)
+	}
+	workloads := GetWorkloadStatuses(ctx, client, "default", rendered)
+	if len(workloads) != len(expected) {
+		t.Fatalf("expected %d workloads; got %v", len(expected), workloads)
+	}
+	for _, w := range workloads {
+		if w.Status != expected[w.Name] {
+			t.Errorf("expected %s to be %s; got %+v", w.Name, expected[w.Name], w)
+		}
+	}
+
+	if broker := GetBrokerStatus(ctx, client, "default", "", "203.0.113.1"); broker.Status != StatusOK {
+		t.Errorf("expected broker at reserved address to be ok; got %+v", broker)
+	}
+	broker := GetBrokerStatus(ctx, client, "default", "", "203.0.113.2")
+	if broker.Status != StatusError {
+		t.Errorf("expected broker at other address to be error; got %+v", broker)
+	}
+
+	status := StackStatus{
+		Terraform: ComponentStatus{Component: "terraform", Name: "state", Status: StatusOK},
+		Cluster:   ComponentStatus{Component: "cluster", Name: "automuteus", Status: StatusOK},
+		Workloads: workloads,
+		Broker:    broker,
+	}
+	if status.Healthy() {
+		t.Errorf("expected stack with missing workload not to be healthy")
+	}
+
+	var buf bytes.Buffer
+	if e := status.WriteTable(&buf); e != nil {
+		t.Fatal(e)
+	}
+	if lines := strings.Split(strings.TrimSpace(buf.String()), "\n"); len(lines) != 8 {
+		t.Errorf("expected header and 7 rows; got %q", buf.String())
+	}
+}
+
+func TestRenderWorkloads(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	workloadNames := func(config Config) map[string]bool {
+		workloads, e := RenderWorkloads(ctx, fakeRenderer(config), "..")
+		if e != nil {
+			t.Fatal(e)
+		}
+		names := map[string]bool{}
+		for _, w := range workloads {
+			names[w.GetNamespace()+"/"+w.GetName()] = true
+		}
+		return names
+	}
+
+	names := workloadNames(managedBackends)
+	if names["/postgres"] || names["/redis"] || !names["/galactus"] {
+		t.Errorf("expected StatefulSets replaced by managed backends to be left out; got %v", names)
+	}
+
+	names = workloadNames(Config{Tenants: []TenantConfig{{Name: "alpha", Namespace: "tenant-alpha", BrokerPort: 8124}}})
+	if !names["tenant-alpha/galactus"] || names["tenant-alpha/postgres"] {
+		t.Errorf("expected workloads of tenant to be rendered in its namespace; got %v", names)
+	}
+}
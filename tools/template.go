@@ -9,8 +9,8 @@ import (
 )
 
 // ApplyTextTemplate applies template to source Reader with
-// Config as data. Then returns Reader which reads result text.
-func ApplyTextTemplate(source io.Reader, config Config) (io.Reader, error) {
+// data, such as Config. Then returns Reader which reads result text.
+func ApplyTextTemplate(source io.Reader, data interface{}) (io.Reader, error) {
 	sourceText, e := ioutil.ReadAll(source)
 	if e != nil {
 		return nil, e
@@ -23,7 +23,7 @@ func ApplyTextTemplate(source io.Reader, config Config) (io.Reader, error) {
 
 	var buffer bytes.Buffer
 
-	if e = tmpl.Execute(&buffer, &config); e != nil {
+	if e = tmpl.Execute(&buffer, data); e != nil {
 		return nil, e
 	}
 
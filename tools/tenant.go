@@ -0,0 +1,206 @@
+package tools
+
+import (
+	"fmt"
+	"path"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	kustomize "sigs.k8s.io/kustomize/api/types"
+)
+
+// TenantsDir is directory of kustomize overlays generated per tenant.
+const TenantsDir = "kubernetes/tenants"
+
+// TenantLabel labels resources with name of the tenant.
+const TenantLabel = "automutek8s.oakcask.github.io/tenant"
+
+// TenantSecrets are secrets owned by each tenant.
+// Other secrets such as postgres are shared with the default stack.
+var TenantSecrets = []string{"discordbot", "redis"}
+
+// SharedPostgresAddr is address of postgres of the default stack, which tenants share.
+const SharedPostgresAddr = "postgres.default.svc.cluster.local:5432"
+
+// TenantConfig is schema of an entry of tenants in config.yaml.
+// Each tenant runs its own automuteus, galactus and redis in its namespace,
+// sharing postgres of the default stack.
+// Broker of the tenant listens either on its own address or on BrokerPort
+// of the ingress address of the default stack.
+type TenantConfig struct {
+	Name                string `json:"name"`
+	Namespace           string `json:"namespace"`
+	IngressIPResourceID string `json:"ingress_ip_resource_id"`
+	BrokerPort          int    `json:"broker_port"`
+}
+
+// Validate checks the tenant can be rendered as an overlay.
+func (tenant TenantConfig) Validate() error {
+	if !IsValidK8sMetadataName(tenant.Name) {
+		return fmt.Errorf("tenants: invalid name: %q", tenant.Name)
+	}
+	if !IsValidK8sMetadataName(tenant.Namespace) || tenant.Namespace == DefaultEnvironment.Namespace {
+		return fmt.Errorf("tenants: %s: invalid namespace: %q", tenant.Name, tenant.Namespace)
+	}
+	if (tenant.IngressIPResourceID == "") == (tenant.BrokerPort == 0) {
+		return fmt.Errorf("tenants: %s: either ingress_ip_resource_id or broker_port is required", tenant.Name)
+	}
+	if tenant.BrokerPort == 80 || tenant.BrokerPort < 0 || tenant.BrokerPort > 65535 {
+		return fmt.Errorf("tenants: %s: invalid broker_port: %d", tenant.Name, tenant.BrokerPort)
+	}
+	return nil
+}
+
+// OverlayPath returns directory of the overlay of the tenant.
+func (tenant TenantConfig) OverlayPath() string {
+	return path.Join(TenantsDir, tenant.Name)
+}
+
+// IngressIP returns IP address which broker of the tenant listens on.
+func (tenant TenantConfig) IngressIP(config Config) (string, error) {
+	if tenant.IngressIPResourceID == "" {
+		return config.IngressIP()
+	}
+	return config.lookupAddress(tenant.IngressIPResourceID)
+}
+
+// NamespaceObject returns Namespace of the tenant to be applied.
+func (tenant TenantConfig) NamespaceObject() *unstructured.Unstructured {
+	return newNamespaceObject(tenant.Namespace)
+}
+
+// ExternalURL returns URL of broker of the tenant.
+func (tenant TenantConfig) ExternalURL(ingressIP string) string {
+	if tenant.BrokerPort == 0 {
+		return fmt.Sprintf("http://%s/", ingressIP)
+	}
+	return fmt.Sprintf("http://%s:%d/", ingressIP, tenant.BrokerPort)
+}
+
+// NewSecretHandles builds SecretHandles of secret for the tenant.
+// Handles of TenantSecrets are in namespace of the tenant.
+func (tenant TenantConfig) NewSecretHandles(secret corev1.Secret) []SecretHandle {
+	handles := NewSecretHandles(secret)
+	for _, name := range TenantSecrets {
+		if secret.Name != name {
+			continue
+		}
+		for i := range handles {
+			handles[i].Namespace = tenant.Namespace
+		}
+	}
+	return handles
+}
+
+// SecretHandles returns handles of secrets of the default stack and ones owned by tenants.
+func (config Config) SecretHandles(secrets []corev1.Secret) []SecretHandle {
+	handles := make([]SecretHandle, 0)
+	for _, secret := range secrets {
+		handles = append(handles, NewSecretHandles(secret)...)
+	}
+	for _, tenant := range config.Tenants {
+		for _, secret := range secrets {
+			for _, handle := range tenant.NewSecretHandles(secret) {
+				if handle.Namespace == tenant.Namespace {
+					handles = append(handles, handle)
+				}
+			}
+		}
+	}
+	return handles
+}
+
+// Tenant returns the tenant in config.yaml named name.
+func (config Config) Tenant(name string) (TenantConfig, error) {
+	for _, tenant := range config.Tenants {
+		if tenant.Name == name {
+			return tenant, tenant.Validate()
+		}
+	}
+	return TenantConfig{}, fmt.Errorf("tenant %s is not in config.yaml", name)
+}
+
+// KeepsPostgres returns true if postgres of env is shared with tenants,
+// so that stopping env should leave postgres running.
+func (config Config) KeepsPostgres(env EnvironmentConfig) bool {
+	return env.IsDefault() && len(config.Tenants) > 0 && config.DatabaseMode() == BackendInCluster
+}
+
+// ValidateTenants checks tenants don't conflict with each other or environments.
+func (config Config) ValidateTenants() error {
+	namespaces := map[string]string{}
+	for _, env := range config.Environments {
+		namespaces[env.Namespace] = "environment " + env.Name
+	}
+	ports := map[int]string{}
+	for _, tenant := range config.Tenants {
+		if e := tenant.Validate(); e != nil {
+			return e
+		}
+		if owner, ok := namespaces[tenant.Namespace]; ok {
+			return fmt.Errorf("tenants: %s: namespace %s is used by %s", tenant.Name, tenant.Namespace, owner)
+		}
+		namespaces[tenant.Namespace] = "tenant " + tenant.Name
+		if tenant.BrokerPort == 0 {
+			continue
+		}
+		if owner, ok := ports[tenant.BrokerPort]; ok {
+			return fmt.Errorf("tenants: %s: broker_port %d is used by %s", tenant.Name, tenant.BrokerPort, owner)
+		}
+		ports[tenant.BrokerPort] = tenant.Name
+	}
+	return nil
+}
+
+// NewTenantOverlay builds overlay of kubernetes/base for the tenant,
+// without postgres which is shared with the default stack at postgresAddr.
+func NewTenantOverlay(tenant TenantConfig, ingressIP string, postgresAddr string) (kustomize.Kustomization, error) {
+	brokerOps := []jsonPatchOp{{Op: "add", Path: "/spec/loadBalancerIP", Value: ingressIP}}
+	if tenant.BrokerPort != 0 {
+		brokerOps = append(brokerOps, jsonPatchOp{Op: "replace", Path: "/spec/ports/0/port", Value: tenant.BrokerPort})
+	}
+	broker, e := jsonPatch("Service", BrokerServiceName, brokerOps...)
+	if e != nil {
+		return kustomize.Kustomization{}, e
+	}
+	discovery, e := jsonPatch("ConfigMap", "discovery",
+		jsonPatchOp{Op: "replace", Path: "/data/GALACTUS_EXTERNAL_URL", Value: tenant.ExternalURL(ingressIP)},
+		jsonPatchOp{Op: "replace", Path: "/data/POSTGRES_ADDR", Value: postgresAddr},
+	)
+	if e != nil {
+		return kustomize.Kustomization{}, e
+	}
+
+	return kustomize.Kustomization{
+		TypeMeta: kustomize.TypeMeta{
+			APIVersion: kustomize.KustomizationVersion,
+			Kind:       kustomize.KustomizationKind,
+		},
+		Bases:        []string{"../../base"},
+		Namespace:    tenant.Namespace,
+		CommonLabels: map[string]string{TenantLabel: tenant.Name},
+		PatchesStrategicMerge: []kustomize.PatchStrategicMerge{
+			"apiVersion: apps/v1\nkind: StatefulSet\nmetadata:\n  name: postgres\n$patch: delete\n",
+			"apiVersion: v1\nkind: Service\nmetadata:\n  name: postgres\n$patch: delete\n",
+		},
+		PatchesJson6902: []kustomize.Patch{broker, discovery},
+	}, nil
+}
+
+// AddTFTenants reserves ingress address of tenants having their own.
+func AddTFTenants(doc *TFDocument, config Config) error {
+	if e := config.ValidateTenants(); e != nil {
+		return e
+	}
+	for _, tenant := range config.Tenants {
+		if tenant.IngressIPResourceID == "" {
+			continue
+		}
+		doc.AddResource("google_compute_address", fmt.Sprintf("tenant-%s", tenant.Name), TFObject{
+			"depends_on": []string{"google_project_service.service"},
+			"name":       tenant.IngressIPResourceID,
+			"region":     TFExpr("var.region"),
+		})
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package tools
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+var fakeTenants = []TenantConfig{
+	{Name: "alpha", Namespace: "tenant-alpha", IngressIPResourceID: "ingress-ip-alpha"},
+	{Name: "beta", Namespace: "tenant-beta", BrokerPort: 8080},
+}
+
+func TestValidateTenants(t *testing.T) {
+	t.Parallel()
+
+	if e := (Config{Tenants: fakeTenants}).ValidateTenants(); e != nil {
+		t.Errorf("expected tenants to be valid; got %v", e)
+	}
+	for _, tenants := range [][]TenantConfig{
+		{{Name: "alpha", Namespace: "default", BrokerPort: 8080}},
+		{{Name: "alpha", Namespace: "tenant-alpha"}},
+		{{Name: "alpha", Namespace: "tenant-alpha", BrokerPort: 8080, IngressIPResourceID: "ingress-ip-alpha"}},
+		{{Name: "alpha", Namespace: "tenant-alpha", BrokerPort: 8080}, {Name: "beta", Namespace: "tenant-beta", BrokerPort: 8080}},
+		{{Name: "alpha", Namespace: "tenant", BrokerPort: 8080}, {Name: "beta", Namespace: "tenant", BrokerPort: 8081}},
+	} {
+		if e := (Config{Tenants: tenants}).ValidateTenants(); e == nil {
+			t.Errorf("expected %v to be invalid", tenants)
+		}
+	}
+}
+
+func TestTenantSecretHandles(t *testing.T) {
+	t.Parallel()
+
+	secrets, e := LoadSecretManifests("../" + SecretManifestsDir)
+	if e != nil {
+		t.Fatal(e)
+	}
+	for _, secret := range secrets {
+		for _, handle := range fakeTenants[0].NewSecretHandles(secret) {
+			shared := secret.Name == "postgres"
+			if shared != (handle.Namespace == "") {
+				t.Errorf("expected only postgres to be shared; got %s", handle.String())
+			}
+		}
+	}
+
+	shared := SecretHandle{MetadataName: "redis", Key: "REDIS_PASSWORD"}
+	owned := SecretHandle{Namespace: "tenant-alpha", MetadataName: "redis", Key: "REDIS_PASSWORD"}
+	if shared.String() != "redis REDIS_PASSWORD" {
+		t.Errorf("expected cloud secret name of the default stack to be kept; got %s", shared.String())
+	}
+	sharedName, _ := shared.buildCloudSecretName(context.Background())
+	ownedName, _ := owned.buildCloudSecretName(context.Background())
+	if sharedName == ownedName {
+		t.Errorf("expected secrets of tenants not to collide; got %s", ownedName)
+	}
+}
+
+func TestRenderTenants(t *testing.T) {
+	t.Parallel()
+
+	objs := buildObjects(t, fakeRenderer(Config{Tenants: fakeTenants}))
+
+	if postgres := findNamespacedObject(objs, "tenant-alpha", "StatefulSet", "postgres"); postgres != nil {
+		t.Errorf("expected postgres to be shared with the default stack")
+	}
+	if findNamespacedObject(objs, "", "StatefulSet", "postgres") == nil {
+		t.Errorf("expected postgres of the default stack")
+	}
+
+	alphaBroker := mustFindObject(t, objs, "tenant-alpha", "Service", "broker")
+	if ip, _, _ := unstructured.NestedString(alphaBroker.Object, "spec", "loadBalancerIP"); ip != "203.0.113.20" {
+		t.Errorf("expected alpha to have its own ingress IP; got %q", ip)
+	}
+	betaBroker := mustFindObject(t, objs, "tenant-beta", "Service", "broker")
+	if port := nestedFirst(t, betaBroker.Object, "spec", "ports")["port"]; port != 8080 && port != int64(8080) && port != float64(8080) {
+		t.Errorf("expected beta to listen on broker_port; got %v", port)
+	}
+
+	discovery := mustFindObject(t, objs, "tenant-beta", "ConfigMap", "discovery-")
+	if url, _, _ := unstructured.NestedString(discovery.Object, "data", "GALACTUS_EXTERNAL_URL"); url != "http://203.0.113.10:8080/" {
+		t.Errorf("expected GALACTUS_EXTERNAL_URL with broker_port; got %q", url)
+	}
+	if addr, _, _ := unstructured.NestedString(discovery.Object, "data", "POSTGRES_ADDR"); addr != SharedPostgresAddr {
+		t.Errorf("expected POSTGRES_ADDR to point postgres of the default stack; got %q", addr)
+	}
+
+	secret := mustFindObject(t, objs, "tenant-beta", "Secret", "discordbot-")
+	token, _, _ := unstructured.NestedString(secret.Object, "data", "DISCORD_BOT_TOKEN")
+	if decoded, _ := base64.StdEncoding.DecodeString(token); string(decoded) != "fake-tenant-beta-discord_bot_token" {
+		t.Errorf("expected bot token of beta; got %q", decoded)
+	}
+	automuteus := mustFindObject(t, objs, "tenant-beta", "Deployment", "automuteus")
+	container := nestedFirst(t, automuteus.Object, "spec", "template", "spec", "containers")
+	if name, _, _ := unstructured.NestedString(nestedFirst(t, container, "envFrom"), "secretRef", "name"); name != secret.GetName() {
+		t.Errorf("expected automuteus of beta to refer its own secret %s; got %v", secret.GetName(), name)
+	}
+}
@@ -18,8 +18,23 @@ type TFObject map[string]interface{}
 // TFDocument corresponds to terraform source file we are going to
 // generate
 type TFDocument struct {
-	Terraform TFTerraform           `json:"terraform"`
-	Variable  map[string]TFVariable `json:"variable"`
+	Terraform TFTerraform                    `json:"terraform"`
+	Variable  map[string]TFVariable          `json:"variable"`
+	Resource  map[string]map[string]TFObject `json:"resource,omitempty"`
+	Data      map[string]map[string]TFObject `json:"data,omitempty"`
+	Output    map[string]TFOutput            `json:"output,omitempty"`
+}
+
+// AddResource puts resource block of resourceType named name
+// into the document.
+func (doc *TFDocument) AddResource(resourceType string, name string, body TFObject) {
+	if doc.Resource == nil {
+		doc.Resource = map[string]map[string]TFObject{}
+	}
+	if doc.Resource[resourceType] == nil {
+		doc.Resource[resourceType] = map[string]TFObject{}
+	}
+	doc.Resource[resourceType][name] = body
 }
 
 // TFTerraformBackend is backend configuration using GCS.
@@ -37,17 +52,45 @@ type TFVariable struct {
 	Default interface{} `json:"default"`
 }
 
+// AddData puts data block of dataType named name
+// into the document.
+func (doc *TFDocument) AddData(dataType string, name string, body TFObject) {
+	if doc.Data == nil {
+		doc.Data = map[string]map[string]TFObject{}
+	}
+	if doc.Data[dataType] == nil {
+		doc.Data[dataType] = map[string]TFObject{}
+	}
+	doc.Data[dataType][name] = body
+}
+
+// TFExpr formats terraform expression and wraps it with
+// interpolation sequence, like "${var.region}".
+func TFExpr(format string, args ...interface{}) string {
+	return fmt.Sprintf("${%s}", fmt.Sprintf(format, args...))
+}
+
+// TFOutput is "output" block in terraform source file.
+type TFOutput struct {
+	Value       interface{} `json:"value"`
+	Description string      `json:"description,omitempty"`
+	Sensitive   bool        `json:"sensitive,omitempty"`
+}
+
 // CreateOrGetTFBackendBucket generates Cloud Storage bucket name for
 // terraform backend and create new bucket with that name if it does not exists.
 func CreateOrGetTFBackendBucket(ctx context.Context, client *storage.Client) (string, error) {
+	return createOrGetLabeledBucket(ctx, client, buckendBucketName, "tfstate", &storage.BucketAttrs{})
+}
+
+// createOrGetLabeledBucket returns name of the bucket labeled with label,
+// creating one named with prefix and attrs if there is none.
+func createOrGetLabeledBucket(ctx context.Context, client *storage.Client, label string, prefix string, attrs *storage.BucketAttrs) (string, error) {
 	projectID, e := GetProjectID(ctx)
 	if e != nil {
 		return "", e
 	}
 	itr := client.Buckets(ctx, projectID)
-	if e != nil {
-		return "", e
-	}
 
 	for {
 		battrs, e := itr.Next()
@@ -58,27 +101,27 @@ func CreateOrGetTFBackendBucket(ctx context.Context, client *storage.Client) (st
 			return "", e
 		}
 
-		if _, ok := battrs.Labels[buckendBucketName]; ok {
-			log.Printf("using existing backend bucket: %s", battrs.Name)
+		if _, ok := battrs.Labels[label]; ok {
+			log.Printf("using existing bucket: %s", battrs.Name)
 			return battrs.Name, nil
 		}
 	}
 
-	bucketAttrs := &storage.BucketAttrs{
-		Labels: map[string]string{},
+	if attrs.Labels == nil {
+		attrs.Labels = map[string]string{}
 	}
-	bucketAttrs.Labels[buckendBucketName] = ""
+	attrs.Labels[label] = ""
 	random, e := uuid.NewRandom()
 	if e != nil {
 		return "", e
 	}
-	bucketName := fmt.Sprintf("tfstate-%s", random.String())
+	bucketName := fmt.Sprintf("%s-%s", prefix, random.String())
 
-	e = client.Bucket(bucketName).Create(ctx, projectID, bucketAttrs)
+	e = client.Bucket(bucketName).Create(ctx, projectID, attrs)
 	if e != nil {
 		return "", e
 	}
 
-	log.Printf("bucket for backend created: %s", bucketName)
+	log.Printf("bucket created: %s", bucketName)
 	return bucketName, nil
 }
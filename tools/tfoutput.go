@@ -0,0 +1,127 @@
+package tools
+
+import (
+	"encoding/json"
+	"fmt"
+
+	gopipeline "github.com/mattn/go-pipeline"
+)
+
+const (
+	tfOutputClusterName        = "cluster_name"
+	tfOutputClusterLocation    = "cluster_location"
+	tfOutputClusterEndpoint    = "cluster_endpoint"
+	tfOutputIngressIP          = "ingress_ip"
+	tfOutputNATIP              = "nat_ip"
+	tfOutputNodeServiceAccount = "node_service_account"
+	tfOutputPostgresAddr       = "postgres_addr"
+	tfOutputRedisAddr          = "redis_addr"
+	tfOutputRedisAuthString    = "redis_auth_string"
+)
+
+// TFOutputs holds values of outputs declared by AddTFOutputs and AddTFBackends
+// and read from terraform state.
+// Fields will be empty if corresponding resources are not applied yet.
+type TFOutputs struct {
+	ClusterName        string
+	ClusterLocation    string
+	ClusterEndpoint    string
+	IngressIP          string
+	NATIP              string
+	NodeServiceAccount string
+	PostgresAddr       string
+	RedisAddr          string
+}
+
+type tfOutputValue struct {
+	Sensitive bool        `json:"sensitive"`
+	Value     interface{} `json:"value"`
+}
+
+var tfOutputsMemo *TFOutputs = nil
+
+// AddTFOutputs declares outputs which mage tasks consume after `terraform apply`.
+func AddTFOutputs(doc *TFDocument) {
+	if doc.Output == nil {
+		doc.Output = map[string]TFOutput{}
+	}
+
+	doc.Output[tfOutputClusterName] = TFOutput{
+		Value:       TFExpr("google_container_cluster.primary.name"),
+		Description: "name of the GKE cluster",
+	}
+	doc.Output[tfOutputClusterLocation] = TFOutput{
+		Value:       TFExpr("google_container_cluster.primary.location"),
+		Description: "location of the GKE cluster",
+	}
+	doc.Output[tfOutputClusterEndpoint] = TFOutput{
+		Value:       TFExpr("google_container_cluster.primary.endpoint"),
+		Description: "IP address of the cluster master",
+	}
+	doc.Output[tfOutputIngressIP] = TFOutput{
+		Value:       TFExpr("google_compute_address.primary-vpc-ingress.address"),
+		Description: "IP address reserved for broker service",
+	}
+	doc.Output[tfOutputNATIP] = TFOutput{
+		Value:       TFExpr("google_compute_address.primary-vpc-nat.address"),
+		Description: "IP address of outgoing traffic from the cluster",
+	}
+	doc.Output[tfOutputNodeServiceAccount] = TFOutput{
+		Value:       TFExpr("google_service_account.node.email"),
+		Description: "service account of cluster nodes",
+	}
+}
+
+// ParseTFOutputs parses output of `terraform output -json`.
+func ParseTFOutputs(b []byte) (TFOutputs, error) {
+	var values map[string]tfOutputValue
+	if e := json.Unmarshal(b, &values); e != nil {
+		return TFOutputs{}, fmt.Errorf("failed to parse terraform output: %v", e)
+	}
+
+	str := func(name string) string {
+		value, ok := values[name]
+		if !ok {
+			return ""
+		}
+		s, ok := value.Value.(string)
+		if !ok {
+			return ""
+		}
+		return s
+	}
+
+	return TFOutputs{
+		ClusterName:        str(tfOutputClusterName),
+		ClusterLocation:    str(tfOutputClusterLocation),
+		ClusterEndpoint:    str(tfOutputClusterEndpoint),
+		IngressIP:          str(tfOutputIngressIP),
+		NATIP:              str(tfOutputNATIP),
+		NodeServiceAccount: str(tfOutputNodeServiceAccount),
+		PostgresAddr:       str(tfOutputPostgresAddr),
+		RedisAddr:          str(tfOutputRedisAddr),
+	}, nil
+}
+
+// GetTFOutputs calls `terraform output -json` in current directory
+// and returns outputs recorded in terraform state.
+func GetTFOutputs() (TFOutputs, error) {
+	if tfOutputsMemo != nil {
+		return *tfOutputsMemo, nil
+	}
+
+	out, e := gopipeline.Output(
+		[]string{"terraform", "output", "-json"},
+	)
+	if e != nil {
+		return TFOutputs{}, fmt.Errorf("failed to invoke terraform command: %v", e.Error())
+	}
+
+	outputs, e := ParseTFOutputs(out)
+	if e != nil {
+		return TFOutputs{}, e
+	}
+	tfOutputsMemo = &outputs
+
+	return outputs, nil
+}
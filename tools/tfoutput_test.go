@@ -0,0 +1,41 @@
+package tools
+
+import (
+	"testing"
+)
+
+func TestParseTFOutputs(t *testing.T) {
+	t.Parallel()
+
+	out := []byte(`{
+  "cluster_endpoint": {"sensitive": false, "type": "string", "value": "203.0.113.1"},
+  "cluster_location": {"sensitive": false, "type": "string", "value": "asia-northeast1-b"},
+  "cluster_name": {"sensitive": false, "type": "string", "value": "au-cluster"},
+  "ingress_ip": {"sensitive": false, "type": "string", "value": "198.51.100.10"},
+  "unknown": {"sensitive": false, "type": "number", "value": 1}
+}`)
+
+	outputs, e := ParseTFOutputs(out)
+	if e != nil {
+		t.Fatalf("expected no error; got %v", e)
+	}
+
+	expected := TFOutputs{
+		ClusterName:     "au-cluster",
+		ClusterLocation: "asia-northeast1-b",
+		ClusterEndpoint: "203.0.113.1",
+		IngressIP:       "198.51.100.10",
+	}
+	if outputs != expected {
+		t.Errorf("expected %v; got %v", expected, outputs)
+	}
+
+	outputs, e = ParseTFOutputs([]byte(`{}`))
+	if e != nil || outputs != (TFOutputs{}) {
+		t.Errorf("expected empty outputs for empty state; got %v, %v", outputs, e)
+	}
+
+	if _, e = ParseTFOutputs([]byte(`not json`)); e == nil {
+		t.Errorf("expected error for malformed output")
+	}
+}
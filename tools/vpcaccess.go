@@ -0,0 +1,45 @@
+package tools
+
+import (
+	"fmt"
+)
+
+// HasVPCConnector returns true if Serverless VPC Access connector
+// is configured in config.yaml.
+func (config Config) HasVPCConnector() bool {
+	return config.Cluster.VPCConnectorName != ""
+}
+
+// AddTFVPCConnector adds Serverless VPC Access connector, which makes
+// App Engine reach internal load balancer of the cluster, to doc.
+// Nothing will be added unless vpc_connector_name is configured.
+func AddTFVPCConnector(doc *TFDocument, config Config) error {
+	if !config.HasVPCConnector() {
+		return nil
+	}
+	if config.Network.VPCConnectorCidrRange == "" {
+		return fmt.Errorf("vpc_connector_cidr_range is required to create VPC connector %s", config.Cluster.VPCConnectorName)
+	}
+
+	doc.Variable["vpc_connector_name"] = TFVariable{
+		Default: config.Cluster.VPCConnectorName,
+	}
+	doc.Variable["vpc_connector_cidr_range"] = TFVariable{
+		Default: config.Network.VPCConnectorCidrRange,
+	}
+
+	doc.AddResource("google_project_service", "vpcaccess", TFObject{
+		"project":            TFExpr("var.gcloud_project"),
+		"service":            "vpcaccess.googleapis.com",
+		"disable_on_destroy": false,
+	})
+	doc.AddResource("google_vpc_access_connector", "primary-vpc-connector", TFObject{
+		"depends_on":    []string{"google_project_service.vpcaccess"},
+		"name":          TFExpr("var.vpc_connector_name"),
+		"region":        TFExpr("var.region"),
+		"network":       TFExpr("google_compute_network.primary-vpc.name"),
+		"ip_cidr_range": TFExpr("var.vpc_connector_cidr_range"),
+	})
+
+	return nil
+}
@@ -0,0 +1,47 @@
+package tools
+
+import (
+	"testing"
+)
+
+func TestAddTFVPCConnector(t *testing.T) {
+	t.Parallel()
+
+	newDoc := func() TFDocument {
+		return TFDocument{Variable: map[string]TFVariable{}}
+	}
+
+	var config Config
+	doc := newDoc()
+	if e := AddTFVPCConnector(&doc, config); e != nil {
+		t.Fatalf("expected no error without connector; got %v", e)
+	}
+	if len(doc.Resource) != 0 || len(doc.Variable) != 0 {
+		t.Errorf("expected nothing to be added without connector; got %v %v", doc.Variable, doc.Resource)
+	}
+
+	config.Cluster.VPCConnectorName = "au-vpc-conn"
+	doc = newDoc()
+	if e := AddTFVPCConnector(&doc, config); e == nil {
+		t.Errorf("expected error without vpc_connector_cidr_range")
+	}
+
+	config.Network.VPCConnectorCidrRange = "172.31.255.224/28"
+	doc = newDoc()
+	if e := AddTFVPCConnector(&doc, config); e != nil {
+		t.Fatalf("expected no error; got %v", e)
+	}
+	if doc.Variable["vpc_connector_name"].Default != "au-vpc-conn" {
+		t.Errorf("expected vpc_connector_name to be emitted; got %v", doc.Variable)
+	}
+	connector, ok := doc.Resource["google_vpc_access_connector"]["primary-vpc-connector"]
+	if !ok {
+		t.Fatalf("expected google_vpc_access_connector to be emitted; got %v", doc.Resource)
+	}
+	if connector["ip_cidr_range"] != "${var.vpc_connector_cidr_range}" {
+		t.Errorf("unexpected ip_cidr_range: %v", connector["ip_cidr_range"])
+	}
+	if _, ok := doc.Resource["google_project_service"]["vpcaccess"]; !ok {
+		t.Errorf("expected vpcaccess.googleapis.com to be enabled; got %v", doc.Resource)
+	}
+}